@@ -0,0 +1,243 @@
+package mqti
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/spf13/viper"
+)
+
+const (
+	archiveContentsPayload string = "payload"
+	archiveContentsPoint   string = "point"
+
+	archiveFormatJSONL string = "jsonl"
+
+	archiveDefaultPartition     string = "year=2006/month=01/day=02/hour=15"
+	archiveDefaultMaxSize       int    = 64 << 20
+	archiveDefaultFlushInterval        = 5 * time.Minute
+)
+
+type archiveConfiguration struct {
+	Bucket string
+	Prefix string
+	// Partition is the Go time layout of the path objects are put under,
+	// after the UTC time of their messages.
+	Partition string
+	// Contents is payload, to archive the raw messages, or point for the
+	// points built from them.
+	Contents string
+	// Format is jsonl, the only one supported: Parquet would need an
+	// encoder dependency and a schema per mapping.
+	Format string
+	Gzip   *bool
+	// MaxSize is the uncompressed size in bytes of the buffered lines, of
+	// every partition together, past which they are uploaded before
+	// flush_interval.
+	MaxSize       int           `mapstructure:"max_size"`
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+	// Canonical re-encodes lines with sorted keys, see Serialize.
+	Canonical bool
+	Region    string
+	Profile   string
+	// Endpoint is set for other S3 compatible stores, e.g.
+	// https://storage.googleapis.com with HMAC keys for GCS.
+	Endpoint       string
+	ForcePathStyle bool `mapstructure:"force_path_style"`
+}
+
+// archiveRecord is a line of the objects of contents payload.  JSON
+// payloads are kept as they are, others as a string.
+type archiveRecord struct {
+	Topic   string      `json:"topic"`
+	Mapping string      `json:"mapping,omitempty"`
+	Time    time.Time   `json:"time"`
+	Payload interface{} `json:"payload"`
+}
+
+// archiveSink archives messages as JSON lines objects in S3, or another
+// S3 compatible store, for batch analytics whatever the other outputs
+// retain.  Lines are buffered and uploaded every flush_interval, or once
+// they make max_size bytes in all, as an object per partition.  Uploads are
+// retried by the SDK.
+type archiveSink struct {
+	config   archiveConfiguration
+	gzip     bool
+	uploader *s3manager.Uploader
+}
+
+// archiveLine is a line of an object, and the partition it goes to.
+type archiveLine struct {
+	partition string
+	line      []byte
+}
+
+func newArchiveSink(settings map[string]interface{}) (Sink, error) {
+	v := viper.New()
+	if err := v.MergeConfigMap(settings); err != nil {
+		return nil, err
+	}
+
+	var c archiveConfiguration
+	if err := v.Unmarshal(&c); err != nil {
+		return nil, err
+	}
+	if c.Bucket == "" {
+		return nil, fmt.Errorf("bucket must be set")
+	}
+	if c.Partition == "" {
+		c.Partition = archiveDefaultPartition
+	}
+	switch c.Contents {
+	case "":
+		c.Contents = archiveContentsPayload
+	case archiveContentsPayload, archiveContentsPoint:
+	default:
+		return nil, fmt.Errorf("invalid contents '%s', must be one of payload or point", c.Contents)
+	}
+	switch c.Format {
+	case "", archiveFormatJSONL:
+	default:
+		return nil, fmt.Errorf("invalid format '%s', only jsonl is supported", c.Format)
+	}
+	if c.MaxSize <= 0 {
+		c.MaxSize = archiveDefaultMaxSize
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = archiveDefaultFlushInterval
+	}
+
+	opts := session.Options{Profile: c.Profile, SharedConfigState: session.SharedConfigEnable}
+	if c.Region != "" {
+		opts.Config.Region = aws.String(c.Region)
+	}
+	if c.Endpoint != "" {
+		opts.Config.Endpoint = aws.String(c.Endpoint)
+	}
+	if c.ForcePathStyle {
+		opts.Config.S3ForcePathStyle = aws.Bool(true)
+	}
+	sess, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &archiveSink{
+		config:   c,
+		gzip:     c.Gzip == nil || *c.Gzip,
+		uploader: s3manager.NewUploader(sess),
+	}
+
+	b := newBatchedSink(s, c.MaxSize, c.FlushInterval)
+	b.weigh = func(encoded interface{}) int {
+		return len(encoded.(archiveLine).line) + 1
+	}
+	return b, nil
+}
+
+func (s *archiveSink) line(p *Point) ([]byte, error) {
+	if s.config.Contents == archiveContentsPoint {
+		return marshalJSON(p, s.config.Canonical)
+	}
+
+	if p.Message == nil {
+		return nil, fmt.Errorf("archive output needs the message a point was built from")
+	}
+
+	r := archiveRecord{Topic: p.Message.Topic(), Mapping: p.Message.MappingName(), Time: p.Time}
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	payload, err := p.Message.Serialize(s.config.Canonical)
+	if err != nil {
+		return nil, err
+	}
+	if json.Valid(payload) {
+		r.Payload = json.RawMessage(payload)
+	} else {
+		r.Payload = string(payload)
+	}
+
+	return marshalJSON(r, s.config.Canonical)
+}
+
+// encode returns the line of p, in the partition of its time.
+func (s *archiveSink) encode(p *Point) (interface{}, error) {
+	line, err := s.line(p)
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return archiveLine{partition: t.UTC().Format(s.config.Partition), line: line}, nil
+}
+
+// writeBatch uploads the lines of a batch of points, an object per
+// partition.
+func (s *archiveSink) writeBatch(ctx context.Context, batch []interface{}) error {
+	partitions := make(map[string]*bytes.Buffer)
+	for _, l := range batch {
+		l := l.(archiveLine)
+		b, ok := partitions[l.partition]
+		if !ok {
+			b = &bytes.Buffer{}
+			partitions[l.partition] = b
+		}
+		b.Write(l.line)
+		b.WriteByte('\n')
+	}
+
+	for partition, b := range partitions {
+		if err := s.upload(ctx, partition, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upload puts the lines of a partition as a new object, named after the
+// time of the upload and a random suffix so concurrent instances don't
+// overwrite each other.
+func (s *archiveSink) upload(ctx context.Context, partition string, lines *bytes.Buffer) error {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	name := fmt.Sprintf("%s-%s.jsonl", time.Now().UTC().Format("20060102T150405Z"), hex.EncodeToString(suffix))
+
+	input := &s3manager.UploadInput{
+		Bucket:      aws.String(s.config.Bucket),
+		ContentType: aws.String("application/x-ndjson"),
+		Body:        lines,
+	}
+
+	if s.gzip {
+		var body bytes.Buffer
+		gz := gzip.NewWriter(&body)
+		if _, err := lines.WriteTo(gz); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		name += ".gz"
+		input.Body = &body
+		input.ContentEncoding = aws.String("gzip")
+	}
+
+	input.Key = aws.String(path.Join(s.config.Prefix, partition, name))
+
+	_, err := s.uploader.UploadWithContext(ctx, input)
+	return err
+}
@@ -0,0 +1,54 @@
+package mqti
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	mQTTDefaultReconnectInitialInterval = time.Second
+	mQTTDefaultReconnectMaxInterval     = 2 * time.Minute
+)
+
+// backoff yields exponentially growing intervals between initial and max,
+// each jittered to between half and all of its nominal value so that many
+// clients dropped by the same broker restart don't reconnect in lockstep.
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	next    time.Duration
+}
+
+func newBackoff(initial, max time.Duration) *backoff {
+	return &backoff{initial: initial, max: max, next: initial}
+}
+
+func (b *backoff) duration() time.Duration {
+	d := b.next
+
+	if b.next *= 2; b.next > b.max {
+		b.next = b.max
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (b broker) reconnectInitialInterval() time.Duration {
+	if d := b.GetDuration("reconnect_initial_interval"); d > 0 {
+		return d
+	}
+	return mQTTDefaultReconnectInitialInterval
+}
+
+func (b broker) reconnectMaxInterval() time.Duration {
+	if d := b.GetDuration("reconnect_max_interval"); d > 0 {
+		return d
+	}
+	return mQTTDefaultReconnectMaxInterval
+}
+
+// reconnectMaxRetries is the number of failed reconnects after which
+// mqti gives up and exits, 0 meaning retry forever.
+func (b broker) reconnectMaxRetries() int {
+	return b.GetInt("reconnect_max_retries")
+}
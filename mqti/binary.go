@@ -0,0 +1,130 @@
+package mqti
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+const (
+	binaryEndianBig    string = "big"
+	binaryEndianLittle string = "little"
+)
+
+// binaryTypeSizes are the types of binary fields, and their size in bytes.
+var binaryTypeSizes = map[string]int{
+	"int8":    1,
+	"uint8":   1,
+	"bool":    1,
+	"int16":   2,
+	"uint16":  2,
+	"int32":   4,
+	"uint32":  4,
+	"float32": 4,
+	"int64":   8,
+	"uint64":  8,
+	"float64": 8,
+}
+
+// BinaryPayloadConfiguration describes fixed binary frames, such as raw
+// Modbus registers or CAN dumps, by the layout of their fields.  Endian
+// is the default byte order of the fields, big as Modbus uses unless set.
+type BinaryPayloadConfiguration struct {
+	Endian string
+	Layout []BinaryFieldConfiguration
+}
+
+// BinaryFieldConfiguration is a field of a binary frame, read at Offset
+// bytes from its start.  Numbers are multiplied by Scale, when set, which
+// makes them floats.  Floats that are NaN or infinite, as unset Modbus
+// registers often read, give no field.
+type BinaryFieldConfiguration struct {
+	Name   string
+	Offset int
+	Type   string
+	Endian string
+	Scale  float64
+}
+
+func validBinaryEndian(e string) bool {
+	switch e {
+	case "", binaryEndianBig, binaryEndianLittle:
+		return true
+	}
+	return false
+}
+
+func (c BinaryPayloadConfiguration) byteOrder(f BinaryFieldConfiguration) binary.ByteOrder {
+	e := f.Endian
+	if e == "" {
+		e = c.Endian
+	}
+	if e == binaryEndianLittle {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// decode reads the fields of the layout from payload, leaving out those
+// that aren't finite.
+func (c BinaryPayloadConfiguration) decode(payload []byte) (map[string]interface{}, error) {
+	fields := make(map[string]interface{}, len(c.Layout))
+
+	for _, f := range c.Layout {
+		size, ok := binaryTypeSizes[f.Type]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown type '%s'", f.Name, f.Type)
+		}
+		if f.Offset < 0 || f.Offset+size > len(payload) {
+			return nil, fmt.Errorf("%s: frame of %d bytes too short for %s at offset %d", f.Name, len(payload), f.Type, f.Offset)
+		}
+
+		b := payload[f.Offset : f.Offset+size]
+		order := c.byteOrder(f)
+
+		var v interface{}
+		switch f.Type {
+		case "int8":
+			v = int64(int8(b[0]))
+		case "uint8":
+			v = uint64(b[0])
+		case "bool":
+			v = b[0] != 0
+		case "int16":
+			v = int64(int16(order.Uint16(b)))
+		case "uint16":
+			v = uint64(order.Uint16(b))
+		case "int32":
+			v = int64(int32(order.Uint32(b)))
+		case "uint32":
+			v = uint64(order.Uint32(b))
+		case "float32":
+			v = float64(math.Float32frombits(order.Uint32(b)))
+		case "int64":
+			v = int64(order.Uint64(b))
+		case "uint64":
+			v = order.Uint64(b)
+		case "float64":
+			v = math.Float64frombits(order.Uint64(b))
+		}
+
+		if f.Scale != 0 {
+			switch n := v.(type) {
+			case int64:
+				v = float64(n) * f.Scale
+			case uint64:
+				v = float64(n) * f.Scale
+			case float64:
+				v = n * f.Scale
+			}
+		}
+
+		if n, ok := v.(float64); ok && (math.IsNaN(n) || math.IsInf(n, 0)) {
+			continue
+		}
+
+		fields[f.Name] = v
+	}
+
+	return fields, nil
+}
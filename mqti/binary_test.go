@@ -0,0 +1,50 @@
+package mqti
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func TestBinaryFields(t *testing.T) {
+	frame := make([]byte, 14)
+	binary.LittleEndian.PutUint64(frame[0:], 1<<53+1)
+	binary.LittleEndian.PutUint16(frame[8:], uint16(0xffff-214)) // -215
+	binary.LittleEndian.PutUint32(frame[10:], math.Float32bits(float32(math.NaN())))
+
+	var mapping MappingConfiguration
+	mapping.MQTT.PayloadFormat = payloadFormatBinary
+	mapping.MQTT.Binary = BinaryPayloadConfiguration{
+		Endian: binaryEndianLittle,
+		Layout: []BinaryFieldConfiguration{
+			{Name: "energy", Offset: 0, Type: "uint64"},
+			{Name: "temperature", Offset: 8, Type: "int16", Scale: 0.1},
+			{Name: "pressure", Offset: 10, Type: "float32"},
+		},
+	}
+
+	m, err := newMQTTMessage(testMessage{topic: "modbus/1", payload: frame}, mapping, "").decode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields, err := m.Fields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := fields["energy"].(uint64); !ok || v != 1<<53+1 {
+		t.Errorf("got energy %v, want %d", fields["energy"], uint64(1<<53+1))
+	}
+	if v, ok := fields["temperature"].(float64); !ok || math.Abs(v+21.5) > 1e-9 {
+		t.Errorf("got temperature %v, want -21.5", fields["temperature"])
+	}
+	if v, ok := fields["pressure"]; ok {
+		t.Errorf("got pressure %v, want none for NaN", v)
+	}
+
+	// Fields are a copy, which transforms may change.
+	fields["energy"] = 0
+	if again, _ := m.Fields(); again["energy"] != uint64(1<<53+1) {
+		t.Error("changing the fields changed the message's")
+	}
+}
@@ -0,0 +1,80 @@
+package mqti
+
+import (
+	"fmt"
+	"sort"
+)
+
+// BoundsConfiguration are the plausible values of a field.  Points with a
+// value below Min or above Max, or without the field when Required, are
+// rejected: counted as such, and sent to the dead-letter output if there
+// is one, rather than written.
+type BoundsConfiguration struct {
+	Min      *float64
+	Max      *float64
+	Required bool
+}
+
+// rejectedError is why a point was rejected as implausible.
+type rejectedError struct {
+	field  string
+	reason string
+}
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("implausible field '%s': %s", e.field, e.reason)
+}
+
+func isRejected(err error) bool {
+	_, ok := err.(*rejectedError)
+	return ok
+}
+
+// checkBounds returns a rejectedError for the first field of fields, in
+// name order, that is out of its bounds.  Names match ignoring case.
+func checkBounds(bounds map[string]BoundsConfiguration, fields map[string]interface{}) error {
+	names := make([]string, 0, len(bounds))
+	for k := range bounds {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		b := bounds[name]
+		k, ok := fieldKey(fields, name)
+		if !ok {
+			k = name
+		}
+		v := fields[k]
+		if v == nil {
+			if b.Required {
+				return &rejectedError{k, "missing or null"}
+			}
+			continue
+		}
+		if b.Min == nil && b.Max == nil {
+			continue
+		}
+
+		var f float64
+		switch v := v.(type) {
+		case float64:
+			f = v
+		case int64:
+			f = float64(v)
+		case uint64:
+			f = float64(v)
+		default:
+			return &rejectedError{k, fmt.Sprintf("%v is not a number", v)}
+		}
+
+		if b.Min != nil && f < *b.Min {
+			return &rejectedError{k, fmt.Sprintf("%v is below %v", f, *b.Min)}
+		}
+		if b.Max != nil && f > *b.Max {
+			return &rejectedError{k, fmt.Sprintf("%v is above %v", f, *b.Max)}
+		}
+	}
+
+	return nil
+}
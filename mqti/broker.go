@@ -0,0 +1,166 @@
+package mqti
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// broker is the configuration of one MQTT connection.  The mqtt section is
+// either a single broker, or a list of them each with a unique name, so
+// that one process can ingest from several; mappings pick theirs by name
+// and otherwise use the first.  Settings are read through a viper instance
+// of the broker's own, not the global one, so a Config built in code works
+// as well as one loaded from a file.
+type broker struct {
+	*viper.Viper
+
+	Name    string
+	Default bool
+}
+
+// brokers returns every broker of the config, the default one first.
+func (c *Config) brokers() ([]broker, error) {
+	list, ok := c.MQTT.([]interface{})
+	if !ok {
+		v := viper.New()
+		if c.MQTT != nil {
+			m, err := stringMap(c.MQTT)
+			if err != nil {
+				return nil, fmt.Errorf("mqtt %s", err)
+			}
+			if err = checkBrokerKeys(m); err != nil {
+				return nil, fmt.Errorf("mqtt: %s", err)
+			}
+			if err = v.MergeConfigMap(m); err != nil {
+				return nil, fmt.Errorf("mqtt: %s", err)
+			}
+		}
+		overrideBroker(v)
+		return []broker{{Viper: v, Name: v.GetString("name"), Default: true}}, nil
+	}
+
+	if len(list) == 0 {
+		return nil, fmt.Errorf("mqtt must list at least one broker")
+	}
+
+	bs := make([]broker, 0, len(list))
+	names := make(map[string]bool, len(list))
+
+	for i, e := range list {
+		m, err := stringMap(e)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt[%d]: %s", i, err)
+		}
+
+		if err = checkBrokerKeys(m); err != nil {
+			return nil, fmt.Errorf("mqtt[%d]: %s", i, err)
+		}
+
+		v := viper.New()
+		if err = v.MergeConfigMap(m); err != nil {
+			return nil, fmt.Errorf("mqtt[%d]: %s", i, err)
+		}
+
+		if i == 0 {
+			overrideBroker(v)
+		}
+
+		name := v.GetString("name")
+		if name == "" {
+			return nil, fmt.Errorf("mqtt[%d]: name must be set when listing several brokers", i)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("mqtt[%d]: name '%s' is used by another broker", i, name)
+		}
+		names[name] = true
+
+		bs = append(bs, broker{Viper: v, Name: name, Default: i == 0})
+	}
+
+	return bs, nil
+}
+
+var brokerOverrides = make(map[string]interface{})
+
+// OverrideBroker sets key of the default broker whatever the config says,
+// e.g. from a command-line flag.
+func OverrideBroker(key string, value interface{}) {
+	brokerOverrides[key] = value
+}
+
+func overrideBroker(v *viper.Viper) {
+	for k, value := range brokerOverrides {
+		v.Set(k, value)
+	}
+}
+
+// brokerKeys are the settings of a broker.  The mqtt section isn't decoded
+// into a struct, so unknown keys, most likely typos, are caught here.
+var brokerKeys = map[string]bool{
+	"name": true, "host": true, "hosts": true, "hosts_order": true, "port": true,
+	"protocol": true, "path": true, "version": true, "client_id": true, "client_id_max_length": true,
+	"username": true, "password": true, "username_file": true, "password_file": true,
+	"clean_session": true, "store_dir": true, "keep_alive": true, "connect_timeout": true,
+	"ping_timeout": true, "ready_timeout": true, "on_subscribe_failure": true,
+	"will_topic": true, "will_payload": true, "will_qos": true, "will_retain": true,
+	"shared_subscription": true, "proxy_url": true,
+	"tls_ca": true, "tls_cert": true, "tls_private_key": true, "tls_server_name": true,
+	"tls_min_version": true, "tls_cipher_suites": true, "tls_insecure_skip_verify": true,
+	"tls_psk": true, "tls_psk_identity": true, "tls_reload_interval": true,
+	"reconnect_initial_interval": true, "reconnect_max_interval": true, "reconnect_max_retries": true,
+	"metrics_topic": true, "metrics_interval": true, "outage_alert_after": true,
+}
+
+func checkBrokerKeys(m map[string]interface{}) error {
+	var unknown []string
+	for k := range m {
+		if !brokerKeys[strings.ToLower(k)] {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown key(s) %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// stringMap converts a map decoded from YAML, whose keys may not be strings,
+// into a map[string]interface{}.
+func stringMap(e interface{}) (map[string]interface{}, error) {
+	switch m := e.(type) {
+	case map[string]interface{}:
+		return m, nil
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			out[fmt.Sprint(k)] = v
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("must be a map, got %T", e)
+}
+
+// serves is true when the mapping subscribes on this broker.
+func (b broker) serves(m MappingConfiguration) bool {
+	if m.MQTT.Broker == "" {
+		return b.Default
+	}
+	return m.MQTT.Broker == b.Name
+}
+
+// String names the broker in logs, the default one of a single-broker
+// config has no name.
+func (b broker) String() string {
+	if b.Name == "" {
+		return "default"
+	}
+	return b.Name
+}
+
+func (b broker) config() map[string]interface{} {
+	return b.AllSettings()
+}
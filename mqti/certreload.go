@@ -0,0 +1,85 @@
+package mqti
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// certReloader holds a client certificate that is re-read from disk, so
+// short-lived certificates can be rotated without restarting mqti.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+	pem  []byte
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload re-reads the certificate and key, and returns true when they have
+// changed since last read.  On error the previous certificate is kept.
+func (r *certReloader) reload() (bool, error) {
+	certPEM, err := ioutil.ReadFile(r.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyPEM, err := ioutil.ReadFile(r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	both := append(certPEM, keyPEM...)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if bytes.Equal(both, r.pem) {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, err
+	}
+
+	r.cert, r.pem = &cert, both
+	return true, nil
+}
+
+func (r *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
+
+func (b broker) tlsReloadInterval() time.Duration {
+	return b.GetDuration("tls_reload_interval")
+}
+
+// reloadCertificates checks the client certificate every interval and,
+// when it has been rotated, reconnects so the new one is presented.
+func (s *Subscriber) reloadCertificates(interval time.Duration) {
+	for s.sleep(interval) {
+		changed, err := s.certs.reload()
+		if err != nil {
+			Log.Errorf("Reloading TLS certificate failed, keeping the current one: %s", err)
+			continue
+		}
+
+		if changed && s.client.IsConnected() {
+			Log.Infof("TLS certificate %s changed, reconnecting", s.certs.certFile)
+			s.reconnect(s.client)
+		}
+	}
+}
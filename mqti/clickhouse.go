@@ -0,0 +1,136 @@
+package mqti
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	// Registers the clickhouse driver, which speaks the native protocol.
+	_ "github.com/ClickHouse/clickhouse-go"
+	"github.com/spf13/viper"
+)
+
+const (
+	clickHouseDefaultTable         string = "mqti"
+	clickHouseDefaultBatchSize     int    = 1000
+	clickHouseDefaultFlushInterval        = time.Second
+)
+
+type clickHouseConfiguration struct {
+	// DSN is e.g. tcp://localhost:9000?username=mqti&database=telemetry.
+	DSN   string
+	Table string
+	// Columns maps column names to what they hold, see pointColumns.
+	// Columns of tag:<key> or field:<key> must be Nullable, for points
+	// without that tag or field.
+	Columns       map[string]string
+	BatchSize     int           `mapstructure:"batch_size"`
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+}
+
+// clickHouseSink writes points into a ClickHouse table, which must already
+// exist.  Points are queued and inserted as one block of batch_size rows,
+// or at least every flush_interval, as ClickHouse much prefers few large
+// inserts to many small ones.
+type clickHouseSink struct {
+	pointColumns
+	db     *sql.DB
+	query  string
+	config clickHouseConfiguration
+}
+
+func newClickHouseSink(settings map[string]interface{}) (Sink, error) {
+	v := viper.New()
+	if err := v.MergeConfigMap(settings); err != nil {
+		return nil, err
+	}
+
+	var c clickHouseConfiguration
+	if err := v.Unmarshal(&c); err != nil {
+		return nil, err
+	}
+	if c.DSN == "" {
+		return nil, fmt.Errorf("dsn must be set")
+	}
+	if c.Table == "" {
+		c.Table = clickHouseDefaultTable
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = clickHouseDefaultBatchSize
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = clickHouseDefaultFlushInterval
+	}
+
+	columns, err := newPointColumns(c.Columns)
+	if err != nil {
+		return nil, err
+	}
+
+	quoted := make([]string, len(columns.columns))
+	for i, column := range columns.columns {
+		quoted[i] = clickHouseIdentifier(column)
+	}
+	table := strings.Split(c.Table, ".")
+	for i, t := range table {
+		table[i] = clickHouseIdentifier(t)
+	}
+
+	db, err := sql.Open("clickhouse", c.DSN)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &clickHouseSink{
+		pointColumns: columns,
+		db:           db,
+		query: fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", strings.Join(table, "."), strings.Join(quoted, ", "),
+			strings.TrimSuffix(strings.Repeat("?, ", len(quoted)), ", ")),
+		config: c,
+	}
+
+	return newBatchedSink(s, c.BatchSize, c.FlushInterval), nil
+}
+
+func clickHouseIdentifier(s string) string {
+	return "`" + strings.Replace(s, "`", "\\`", -1) + "`"
+}
+
+func (s *clickHouseSink) encode(p *Point) (interface{}, error) {
+	return s.row(p)
+}
+
+// writeBatch inserts a batch of rows as one block.  The driver buffers the
+// rows of a transaction and sends them when it commits.
+func (s *clickHouseSink) writeBatch(ctx context.Context, batch []interface{}) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, s.query)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, row := range batch {
+		if _, err = stmt.ExecContext(ctx, row.([]interface{})...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *clickHouseSink) ready(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *clickHouseSink) Close() error {
+	return s.db.Close()
+}
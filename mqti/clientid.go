@@ -0,0 +1,71 @@
+package mqti
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"text/template"
+)
+
+// mQTTDefaultClientID is used when client_id is unset, so that replicas
+// sharing a config don't take over each other's connection.
+const mQTTDefaultClientID string = "mqti-{{.Random}}"
+
+// ClientIDTemplateData is made available to client_id templates, e.g.
+// mqti-{{.Hostname}}-{{.Env "POD_NAME"}} or mqti-{{.Random}}
+type ClientIDTemplateData struct{}
+
+// Hostname ...
+func (ClientIDTemplateData) Hostname() string {
+	h, err := os.Hostname()
+	if err != nil {
+		Log.Warn(err)
+		return ""
+	}
+	return h
+}
+
+// Env ...
+func (ClientIDTemplateData) Env(key string) string {
+	return os.Getenv(key)
+}
+
+// Random returns 8 random hex characters, different on every start.  A
+// client ID using it can't resume a persistent session after a restart.
+func (ClientIDTemplateData) Random() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		Log.Warn(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// RenderClientID renders the client_id template and checks the result is
+// usable as an MQTT client ID, and no longer than maxLength when it is set.
+func RenderClientID(in string, maxLength int) (string, error) {
+	var err error
+	var t *template.Template
+	var out bytes.Buffer
+
+	if t, err = template.New("client_id").Parse(in); err != nil {
+		return "", fmt.Errorf("invalid client_id template: %s", err)
+	}
+
+	if err = t.Execute(&out, ClientIDTemplateData{}); err != nil {
+		return "", fmt.Errorf("can't render client_id template: %s", err)
+	}
+
+	id := out.String()
+
+	if len(id) == 0 {
+		return "", fmt.Errorf("client_id '%s' rendered to an empty string", in)
+	}
+
+	if maxLength > 0 && len(id) > maxLength {
+		return "", fmt.Errorf("client_id '%s' is %d characters long, the limit is %d", id, len(id), maxLength)
+	}
+
+	return id, nil
+}
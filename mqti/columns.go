@@ -0,0 +1,97 @@
+package mqti
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultPointColumns store a point the way InfluxDB would, with tags and
+// fields as JSON.
+var defaultPointColumns = map[string]string{
+	"time":        "time",
+	"measurement": "measurement",
+	"tags":        "tags",
+	"fields":      "fields",
+}
+
+// pointColumns lay points out as table rows, for the SQL outputs.  Columns
+// map names to what they hold: time, database, measurement, tags or fields
+// (as JSON), tag:<key> or field:<key>.
+type pointColumns struct {
+	columns []string
+	sources []string
+}
+
+func newPointColumns(columns map[string]string) (pointColumns, error) {
+	var c pointColumns
+
+	if len(columns) == 0 {
+		columns = defaultPointColumns
+	}
+
+	// Columns are written in name order, so statements are the same every
+	// time.
+	for column := range columns {
+		c.columns = append(c.columns, column)
+	}
+	sort.Strings(c.columns)
+	for _, column := range c.columns {
+		source := columns[column]
+		if !validPointSource(source) {
+			return c, fmt.Errorf("columns.%s: '%s' must be one of time, database, measurement, tags, fields, tag:<key> or field:<key>", column, source)
+		}
+		c.sources = append(c.sources, source)
+	}
+
+	return c, nil
+}
+
+func validPointSource(s string) bool {
+	switch s {
+	case "time", "database", "measurement", "tags", "fields":
+		return true
+	}
+	return strings.HasPrefix(s, "tag:") || strings.HasPrefix(s, "field:")
+}
+
+// row returns the column values of p, in column order, nil for tags and
+// fields p doesn't have.
+func (c pointColumns) row(p *Point) ([]interface{}, error) {
+	row := make([]interface{}, len(c.sources))
+
+	for i, source := range c.sources {
+		switch {
+		case source == "time":
+			t := p.Time
+			if t.IsZero() {
+				t = time.Now()
+			}
+			row[i] = t
+		case source == "database":
+			row[i] = p.Database
+		case source == "measurement":
+			row[i] = p.Measurement
+		case source == "tags", source == "fields":
+			var v interface{} = p.Tags
+			if source == "fields" {
+				v = p.Fields
+			}
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			row[i] = string(b)
+		case strings.HasPrefix(source, "tag:"):
+			if v, ok := p.Tags[strings.TrimPrefix(source, "tag:")]; ok {
+				row[i] = v
+			}
+		case strings.HasPrefix(source, "field:"):
+			row[i] = p.Fields[strings.TrimPrefix(source, "field:")]
+		}
+	}
+
+	return row, nil
+}
@@ -26,9 +26,14 @@ func forwardMessages() {
 	incoming := make(chan *mqti.MQTTMessage)
 	forward := make(chan *mqti.MQTTMessage)
 
+	ready := make(chan struct{})
+
+	go mqti.SinksReady(ready)
 	go mqti.CreateWorkers(influxDB, forward)
 	go mqti.MQTTSubscribe(incoming)
 
+	mqti.BufferUntilReady(incoming, forward, ready)
+
 	for m := range incoming {
 		mqti.DebugLogMQTTMessage(m)
 		forward <- m
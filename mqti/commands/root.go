@@ -6,11 +6,31 @@ import (
 
 	"github.com/ashmckenzie/go-mqti/mqti"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
-var configFile string
+var configFile, configDir string
+var remoteProvider, remoteEndpoint, remotePath string
 var debug, showVersion bool
+var logLevel string
+
+// brokerFlags override settings of the default MQTT broker, and
+// settingFlags other settings, so deployments can be tuned with arguments
+// rather than a config file each.
+var brokerFlags = map[string]string{
+	"mqtt-host":     "host",
+	"mqtt-port":     "port",
+	"mqtt-protocol": "protocol",
+	"mqtt-username": "username",
+	"client-id":     "client_id",
+}
+
+var settingFlags = map[string]string{
+	"influxdb-host": "influxdb.host",
+	"influxdb-port": "influxdb.port",
+	"workers":       "mqti.workers",
+}
 
 // RootCmd ...
 var RootCmd = &cobra.Command{
@@ -23,6 +43,12 @@ var RootCmd = &cobra.Command{
 			return err
 		}
 
+		if logLevel != "" {
+			if err := mqti.SetLogLevel(logLevel); err != nil {
+				return err
+			}
+		}
+
 		mqti.EnableDebugging(debug)
 
 		return nil
@@ -51,11 +77,32 @@ func init() {
 	RootCmd.Flags().BoolVarP(&showVersion, "version", "v", false, "show version")
 	RootCmd.PersistentFlags().BoolVar(&debug, "debug", false, "enable debugging")
 
+	RootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "", "log level, one of debug, info, warn or error (default info)")
+
 	RootCmd.PersistentFlags().StringVar(&configFile, "config", "", "config file (default is config.yaml)")
+	RootCmd.PersistentFlags().StringVar(&configDir, "config-dir", "", "merge every *.yaml file of a directory instead of reading one config file")
+	RootCmd.PersistentFlags().StringVar(&remoteProvider, "remote-provider", "", "read the config from etcd, etcd3 or consul instead of a file")
+	RootCmd.PersistentFlags().StringVar(&remoteEndpoint, "remote-endpoint", "", "remote config endpoint, e.g. http://127.0.0.1:2379 or localhost:8500")
+	RootCmd.PersistentFlags().StringVar(&remotePath, "remote-path", "/mqti/config.yaml", "remote config key")
+
+	RootCmd.PersistentFlags().String("mqtt-host", "", "override mqtt.host")
+	RootCmd.PersistentFlags().String("mqtt-port", "", "override mqtt.port")
+	RootCmd.PersistentFlags().String("mqtt-protocol", "", "override mqtt.protocol")
+	RootCmd.PersistentFlags().String("mqtt-username", "", "override mqtt.username")
+	RootCmd.PersistentFlags().String("client-id", "", "override mqtt.client_id")
+	RootCmd.PersistentFlags().String("influxdb-host", "", "override influxdb.host")
+	RootCmd.PersistentFlags().String("influxdb-port", "", "override influxdb.port")
+	RootCmd.PersistentFlags().Int("workers", 0, "override mqti.workers")
 }
 
 func initConfig() {
-	if configFile != "" {
+	if remoteProvider != "" {
+		if err := mqti.SetRemoteConfig(remoteProvider, remoteEndpoint, remotePath); err != nil {
+			mqti.Log.Fatal("Can't read config:", err)
+		}
+	} else if configDir != "" {
+		mqti.SetConfigDir(configDir)
+	} else if configFile != "" {
 		viper.SetConfigFile(configFile)
 	} else {
 		viper.AddConfigPath(".")
@@ -64,7 +111,19 @@ func initConfig() {
 
 	viper.AutomaticEnv()
 
-	if err := viper.ReadInConfig(); err != nil {
+	// Flags are only applied when given, so the config file's value is
+	// kept otherwise.  With several brokers, the mqtt flags apply to the
+	// first.
+	RootCmd.PersistentFlags().Visit(func(f *pflag.Flag) {
+		if k, ok := brokerFlags[f.Name]; ok {
+			mqti.OverrideBroker(k, f.Value.String())
+		}
+		if k, ok := settingFlags[f.Name]; ok {
+			viper.Set(k, f.Value.String())
+		}
+	})
+
+	if err := mqti.ReadConfig(); err != nil {
 		mqti.Log.Fatal("Can't read config:", err)
 		os.Exit(1)
 	}
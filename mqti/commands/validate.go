@@ -0,0 +1,49 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ashmckenzie/go-mqti/mqti"
+	"github.com/spf13/cobra"
+)
+
+var probe bool
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check the config for problems",
+	Run: func(cmd *cobra.Command, args []string) {
+		if !validateConfig() {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	validateCmd.Flags().BoolVar(&probe, "probe", false, "also check that the brokers, InfluxDB and the outputs can be reached")
+	RootCmd.AddCommand(validateCmd)
+}
+
+// validateConfig prints every problem found and returns false when any of
+// them is an error.
+func validateConfig() bool {
+	problems := mqti.Validate()
+	if probe {
+		problems = append(problems, mqti.Probe()...)
+	}
+
+	ok := true
+	for _, p := range problems {
+		fmt.Println(p)
+		if p.Severity == mqti.SeverityError {
+			ok = false
+		}
+	}
+
+	if ok {
+		fmt.Println("Config OK")
+	}
+
+	return ok
+}
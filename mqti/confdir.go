@@ -0,0 +1,111 @@
+package mqti
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+var configDir string
+
+// SetConfigDir makes ReadConfig merge every *.yaml fragment of dir, in
+// name order, rather than read a single file.  Later fragments override
+// the settings of earlier ones, except mappings, which are concatenated so
+// each team can keep theirs in a file of its own.
+func SetConfigDir(dir string) {
+	configDir = dir
+}
+
+func readConfigDir() error {
+	files, err := filepath.Glob(filepath.Join(configDir, "*.yaml"))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no *.yaml files in %s", configDir)
+	}
+
+	// Drop the settings of fragments read before, which may have been
+	// removed since.
+	viper.SetConfigType("yaml")
+	if err = viper.ReadConfig(strings.NewReader("")); err != nil {
+		return err
+	}
+
+	var mappings []interface{}
+	var conflicts []string
+	definedIn := make(map[string]string)
+
+	for _, f := range files {
+		v := viper.New()
+		v.SetConfigFile(f)
+		if err = v.ReadInConfig(); err != nil {
+			return fmt.Errorf("%s: %s", f, err)
+		}
+
+		settings := v.AllSettings()
+
+		if list, ok := settings["mappings"].([]interface{}); ok {
+			for _, e := range list {
+				if m, err := stringMap(e); err == nil {
+					if name, _ := m["name"].(string); name != "" {
+						if g, ok := definedIn[name]; ok {
+							conflicts = append(conflicts, fmt.Sprintf("mapping '%s' is defined in both %s and %s", name, g, f))
+						}
+						definedIn[name] = f
+					}
+				}
+				mappings = append(mappings, e)
+			}
+			delete(settings, "mappings")
+		}
+
+		if err = viper.MergeConfigMap(settings); err != nil {
+			return fmt.Errorf("%s: %s", f, err)
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%s", strings.Join(conflicts, ", "))
+	}
+
+	return viper.MergeConfigMap(map[string]interface{}{"mappings": mappings})
+}
+
+// watchConfigDir reloads the config whenever a fragment is added, changed
+// or removed.
+func watchConfigDir(subscribers []*Subscriber) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		Log.Errorf("Watching %s failed: %s", configDir, err)
+		return
+	}
+	defer watcher.Close()
+
+	if err = watcher.Add(configDir); err != nil {
+		Log.Errorf("Watching %s failed: %s", configDir, err)
+		return
+	}
+
+	for {
+		select {
+		case e, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Ext(e.Name) != ".yaml" || e.Op == fsnotify.Chmod {
+				continue
+			}
+			Log.Infof("Config %s changed, reloading", e.Name)
+			reloadConfig(subscribers)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			Log.Errorf("Watching %s failed: %s", configDir, err)
+		}
+	}
+}
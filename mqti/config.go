@@ -1,16 +1,37 @@
 package mqti
 
+import "time"
+
 type mQtiConfiguration struct {
-	Workers int
+	Workers       int
+	StartupBuffer startupBufferConfiguration `mapstructure:"startup_buffer"`
+	WatchConfig   bool                       `mapstructure:"watch_config"`
+	// DeadLetter names the output messages that fail to be parsed,
+	// transformed or written are sent to, see sendDeadLetter.
+	DeadLetter string `mapstructure:"dead_letter"`
+	// FlushSignal makes SIGUSR1 write what batching outputs have queued.
+	FlushSignal bool `mapstructure:"flush_signal"`
+
+	SecretsRefreshInterval time.Duration `mapstructure:"secrets_refresh_interval"`
 }
 
-type mQTTConfiguration struct {
-	Host     string
-	Port     string
-	ClientID string
+type startupBufferConfiguration struct {
+	Size     int
+	Overflow string
 }
 
 type influxDBConfiguration struct {
-	Host string
-	Port string
+	Host     string
+	Port     string
+	TLS      bool
+	Username string
+	Password string
+
+	// Version 2 writes through the InfluxDB 2.x API, with the settings
+	// below; mappings' database is then the bucket, defaulting to Bucket.
+	Version      int
+	Token        string
+	Organization string `mapstructure:"org"`
+	Bucket       string
+	Precision    string
 }
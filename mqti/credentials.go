@@ -0,0 +1,73 @@
+package mqti
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// CredentialsProvider returns the username and password to connect with.
+// It is called on every connect, so credentials can be rotated without a
+// restart.
+type CredentialsProvider func() (username, password string)
+
+// readSecret reads a credential from a file, e.g. a mounted Kubernetes
+// secret, without its trailing newline.
+func readSecret(file string) string {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		Log.Error(err)
+		return ""
+	}
+	return strings.TrimRight(string(b), "\r\n")
+}
+
+// brokerCredentials are a broker's username and password, or the files
+// they are read from, which reloads replace while paho's connect
+// goroutine reads them.
+type brokerCredentials struct {
+	mu                         sync.RWMutex
+	username, password         string
+	usernameFile, passwordFile string
+}
+
+func newBrokerCredentials(b broker) *brokerCredentials {
+	c := &brokerCredentials{}
+	c.set(b)
+	return c
+}
+
+// set takes the credentials of b.
+func (c *brokerCredentials) set(b broker) {
+	username, _ := b.config()["username"].(string)
+	password, _ := b.config()["password"].(string)
+	usernameFile, passwordFile := b.GetString("username_file"), b.GetString("password_file")
+
+	c.mu.Lock()
+	c.username, c.password = username, password
+	c.usernameFile, c.passwordFile = usernameFile, passwordFile
+	c.mu.Unlock()
+}
+
+// get returns the username and password, re-reading their files.
+func (c *brokerCredentials) get() (string, string) {
+	c.mu.RLock()
+	username, password := c.username, c.password
+	usernameFile, passwordFile := c.usernameFile, c.passwordFile
+	c.mu.RUnlock()
+
+	if len(usernameFile) > 0 {
+		username = readSecret(usernameFile)
+	}
+	if len(passwordFile) > 0 {
+		password = readSecret(passwordFile)
+	}
+	return username, password
+}
+
+// SetCredentialsProvider replaces the configured username and password, or
+// the username_file and password_file, which are otherwise re-read on
+// every connect.  It must be called before Start.
+func (s *Subscriber) SetCredentialsProvider(f CredentialsProvider) {
+	s.credentials = f
+}
@@ -0,0 +1,97 @@
+package mqti
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const csvDefaultDelimiter rune = ','
+
+// CSVPayloadConfiguration describes comma-separated payloads.  Columns
+// names the columns in order, "-" skipping one, and defaults to the
+// header line when Header is set.  Values are parsed as numbers or
+// booleans when possible, except those of the Tags columns which become
+// the point's tags.
+type CSVPayloadConfiguration struct {
+	Delimiter string
+	Header    bool
+	Columns   []string
+	Tags      []string
+}
+
+func (c CSVPayloadConfiguration) delimiter() rune {
+	if len(c.Delimiter) > 0 {
+		r, _ := utf8.DecodeRuneInString(c.Delimiter)
+		return r
+	}
+	return csvDefaultDelimiter
+}
+
+func (c CSVPayloadConfiguration) isTag(column string) bool {
+	for _, t := range c.Tags {
+		if t == column {
+			return true
+		}
+	}
+	return false
+}
+
+// decode returns an object per line of payload, keyed by column name.
+func (c CSVPayloadConfiguration) decode(payload []byte) ([]interface{}, error) {
+	r := csv.NewReader(bytes.NewReader(payload))
+	r.Comma = c.delimiter()
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := c.Columns
+	if c.Header && len(records) > 0 {
+		if len(columns) == 0 {
+			columns = records[0]
+		}
+		records = records[1:]
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no columns, set csv.columns or csv.header")
+	}
+
+	rows := make([]interface{}, 0, len(records))
+	for _, record := range records {
+		row := make(map[string]interface{}, len(record))
+		for i, raw := range record {
+			if i >= len(columns) || columns[i] == "" || columns[i] == "-" {
+				continue
+			}
+			raw = strings.TrimSpace(raw)
+			if raw == "" {
+				continue
+			}
+			if c.isTag(columns[i]) {
+				row[columns[i]] = raw
+				continue
+			}
+			v, _ := parseScalar(raw, "")
+			row[columns[i]] = v
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// apply moves the values of the Tags columns from fields to tags.
+func (c CSVPayloadConfiguration) apply(fields map[string]interface{}, tags map[string]string) {
+	for _, t := range c.Tags {
+		if v, ok := fields[t].(string); ok {
+			tags[t] = v
+			delete(fields, t)
+		}
+	}
+}
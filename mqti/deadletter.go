@@ -0,0 +1,76 @@
+package mqti
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const deadLetterMeasurement string = "dead_letter"
+
+// Stages messages are dead-lettered at.
+const (
+	deadLetterStageExec   string = "exec"
+	deadLetterStagePoint  string = "point"
+	deadLetterStageBounds string = "bounds"
+	deadLetterStageOutput string = "output"
+)
+
+// deadLetter is the output of mqti.dead_letter, which messages that fail
+// to be parsed, transformed or written are sent to rather than only
+// logged.
+var deadLetter struct {
+	sync.RWMutex
+	name string
+	sink Sink
+}
+
+func setDeadLetter(name string, sink Sink) {
+	deadLetter.Lock()
+	deadLetter.name, deadLetter.sink = name, sink
+	deadLetter.Unlock()
+}
+
+// sendDeadLetter writes m, with why and where it failed, to the dead
+// letter output if there is one.  The point has the measurement
+// dead_letter, topic, mapping, stage and output tags, and the raw payload
+// and error as fields, so file, Kafka, and mqtt or NATS outputs with
+// format point all carry them.  Messages whose batch failed to be written
+// to a batched output are sent once the batch is, each on its own.
+func sendDeadLetter(m *MQTTMessage, stage, output string, err error) {
+	deadLetter.RLock()
+	name, sink := deadLetter.name, deadLetter.sink
+	deadLetter.RUnlock()
+
+	if stage == deadLetterStageOutput && output == "" {
+		output = defaultOutput
+	}
+	if sink == nil || (stage == deadLetterStageOutput && strings.EqualFold(output, name)) {
+		return
+	}
+
+	tags := map[string]string{"topic": m.Topic(), "stage": stage}
+	if mapping := m.MappingName(); mapping != "" {
+		tags["mapping"] = mapping
+	}
+	if output != "" {
+		tags["output"] = output
+	}
+
+	p := &Point{
+		Measurement: deadLetterMeasurement,
+		Tags:        tags,
+		Fields:      map[string]interface{}{"payload": m.PayloadAsString(), "error": err.Error()},
+		Time:        time.Now(),
+		Message:     m,
+	}
+
+	writePoint(sink, p, func(err error) {
+		if err != nil {
+			countOutput(name, statFailed)
+			Log.Errorf("Dead-lettering %s failed: %s", m.Topic(), err)
+			return
+		}
+		countOutput(name, statForwarded)
+	})
+}
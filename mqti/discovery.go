@@ -0,0 +1,221 @@
+package mqti
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+const discoveryDefaultMaxSubscriptions int = 100
+
+const (
+	discoveryActionAdd    string = "add"
+	discoveryActionRemove string = "remove"
+)
+
+// discoveryAnnouncement is published on the discovery topic by devices that
+// want to be collected, e.g. {"action": "add", "topic": "devices/42/data"}
+type discoveryAnnouncement struct {
+	Action string `json:"action"`
+	Topic  string `json:"topic"`
+}
+
+// discoveryRejected counts the discovery announcements ignored since
+// startup, whether invalid, not allowed or past max_subscriptions.
+var discoveryRejected int64
+
+// rejectAnnouncement logs why an announcement is ignored and counts it.
+func rejectAnnouncement(format string, a ...interface{}) {
+	atomic.AddInt64(&discoveryRejected, 1)
+	Log.Warnf("Ignoring discovery announcement: "+format, a...)
+}
+
+func (d DiscoveryConfiguration) enabled() bool {
+	return len(d.Topic) > 0
+}
+
+func (d DiscoveryConfiguration) maxSubscriptions() int {
+	if d.MaxSubscriptions > 0 {
+		return d.MaxSubscriptions
+	}
+	return discoveryDefaultMaxSubscriptions
+}
+
+// allows returns why topic may not be subscribed to, or nil: a filter
+// with wildcards unless allow_wildcards is set, or one outside every
+// filter of allow when set.
+func (d DiscoveryConfiguration) allows(topic string) error {
+	if !d.AllowWildcards && strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("topic %s has wildcards, which allow_wildcards isn't set for", topic)
+	}
+	if len(d.Allow) == 0 {
+		return nil
+	}
+	for _, allow := range d.Allow {
+		if filterWithin(topic, allow) {
+			return nil
+		}
+	}
+	return fmt.Errorf("topic %s is not within discovery.allow", topic)
+}
+
+// filterWithin is true when every topic matching filter matches allow,
+// e.g. devices/42/# within devices/#, but not devices/# within
+// devices/+/data.
+func filterWithin(filter, allow string) bool {
+	filterLevels := strings.Split(filter, "/")
+	allowLevels := strings.Split(allow, "/")
+
+	for i, a := range allowLevels {
+		if a == "#" {
+			return true
+		}
+		if i >= len(filterLevels) {
+			return false
+		}
+		f := filterLevels[i]
+		if f == "#" || (a != "+" && a != f) {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(allowLevels)
+}
+
+// mapping returns the template mapping bound to topic.
+func (d DiscoveryConfiguration) mapping(topic string) MappingConfiguration {
+	m := d.Template
+	m.MQTT.Topic = topic
+	if len(m.Name) > 0 {
+		m.Name = m.Name + ":" + topic
+	} else {
+		m.Name = topic
+	}
+	return m
+}
+
+// DynamicSubscriptions returns the topics currently subscribed to through
+// discovery announcements.
+func (s *Subscriber) DynamicSubscriptions() []string {
+	s.dynamicMu.Lock()
+	defer s.dynamicMu.Unlock()
+
+	topics := make([]string, 0, len(s.dynamic))
+	for t := range s.dynamic {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+
+	return topics
+}
+
+// subscribeDiscovery subscribes to the discovery topic and restores any
+// dynamic subscriptions made before a reconnect.
+func (s *Subscriber) subscribeDiscovery(c MQTT.Client, d DiscoveryConfiguration) {
+	f := s.discoveryHandler(d)
+
+	if err := mQTTSubscribeTopic(c, d.Topic, mQTTDefaultQoS, f); err != nil {
+		s.handleSubscribeFailure(c, d.Topic, mQTTDefaultQoS, f, err)
+	} else {
+		s.subscribed()
+	}
+
+	s.dynamicMu.Lock()
+	mappings := make([]MappingConfiguration, 0, len(s.dynamic))
+	for _, m := range s.dynamic {
+		mappings = append(mappings, m)
+	}
+	s.dynamicMu.Unlock()
+
+	for _, m := range mappings {
+		s.subscribeDynamic(c, m)
+	}
+}
+
+func (s *Subscriber) discoveryHandler(d DiscoveryConfiguration) MQTT.MessageHandler {
+	return func(c MQTT.Client, msg MQTT.Message) {
+		var a discoveryAnnouncement
+
+		if err := json.Unmarshal(msg.Payload(), &a); err != nil {
+			rejectAnnouncement("'%s': %s", msg.Payload(), err)
+			return
+		}
+
+		// Subscribing waits on a token, which must not happen on paho's
+		// message handling goroutine.
+		switch a.Action {
+		case discoveryActionAdd:
+			s.goroutine(func() { s.addDynamic(c, d, a.Topic) })
+		case discoveryActionRemove:
+			s.goroutine(func() { s.removeDynamic(c, a.Topic) })
+		default:
+			rejectAnnouncement("unknown action '%s'", a.Action)
+		}
+	}
+}
+
+func (s *Subscriber) addDynamic(c MQTT.Client, d DiscoveryConfiguration, topic string) {
+	if err := ValidateTopicFilter(topic); err != nil {
+		rejectAnnouncement("%s", err)
+		return
+	}
+	if err := d.allows(topic); err != nil {
+		rejectAnnouncement("%s", err)
+		return
+	}
+
+	s.dynamicMu.Lock()
+	if _, ok := s.dynamic[topic]; ok {
+		s.dynamicMu.Unlock()
+		return
+	}
+	if len(s.dynamic) >= d.maxSubscriptions() {
+		s.dynamicMu.Unlock()
+		rejectAnnouncement("topic %s, limit of %d dynamic subscriptions reached", topic, d.maxSubscriptions())
+		return
+	}
+	m := d.mapping(topic)
+	s.dynamic[topic] = m
+	s.dynamicMu.Unlock()
+
+	s.subscribeDynamic(c, m)
+}
+
+func (s *Subscriber) subscribeDynamic(c MQTT.Client, m MappingConfiguration) {
+	f, err := s.messageHandler(m)
+	if err == nil {
+		err = mQTTSubscribeTopic(c, m.MQTT.subscription(s.broker), m.MQTT.QoS, f)
+	}
+
+	if err != nil {
+		Log.Errorf("Subscribe to discovered topic %s failed: %s", m.MQTT.Topic, err)
+		s.dynamicMu.Lock()
+		delete(s.dynamic, m.MQTT.Topic)
+		s.dynamicMu.Unlock()
+		return
+	}
+
+	Log.Infof("Subscribed to discovered topic %s", m.MQTT.Topic)
+}
+
+func (s *Subscriber) removeDynamic(c MQTT.Client, topic string) {
+	s.dynamicMu.Lock()
+	m, ok := s.dynamic[topic]
+	delete(s.dynamic, topic)
+	s.dynamicMu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if token := c.Unsubscribe(m.MQTT.subscription(s.broker)); token.Wait() && token.Error() != nil {
+		Log.Errorf("Unsubscribe from discovered topic %s failed: %s", topic, token.Error())
+		return
+	}
+
+	Log.Infof("Unsubscribed from discovered topic %s", topic)
+}
@@ -0,0 +1,32 @@
+package mqti
+
+import "testing"
+
+func TestDiscoveryAllows(t *testing.T) {
+	tests := []struct {
+		allow     []string
+		wildcards bool
+		topic     string
+		want      bool
+	}{
+		{nil, false, "devices/42/data", true},
+		{nil, false, "#", false},
+		{nil, true, "#", true},
+		{[]string{"devices/+/data"}, false, "devices/42/data", true},
+		{[]string{"devices/+/data"}, false, "devices/42/config", false},
+		{[]string{"devices/+/data"}, false, "other/42/data", false},
+		{[]string{"devices/+/data"}, true, "devices/+/data", true},
+		{[]string{"devices/+/data"}, true, "devices/#", false},
+		{[]string{"devices/#"}, true, "devices/42/#", true},
+		{[]string{"devices/#"}, false, "devices/42/#", false},
+		{[]string{"devices/42"}, true, "devices/+", false},
+		{[]string{"sensors/#", "devices/#"}, false, "devices/42/data", true},
+	}
+
+	for _, tt := range tests {
+		d := DiscoveryConfiguration{Allow: tt.allow, AllowWildcards: tt.wildcards}
+		if err := d.allows(tt.topic); (err == nil) != tt.want {
+			t.Errorf("allow %v, wildcards %v: %s got %v, want allowed %v", tt.allow, tt.wildcards, tt.topic, err, tt.want)
+		}
+	}
+}
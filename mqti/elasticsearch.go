@@ -0,0 +1,272 @@
+package mqti
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	elasticsearchDefaultIndex         string = "mqti"
+	elasticsearchDefaultDateFormat    string = "2006.01.02"
+	elasticsearchDefaultBatchSize     int    = 500
+	elasticsearchDefaultFlushInterval        = time.Second
+	elasticsearchDefaultTimeout              = 30 * time.Second
+	elasticsearchDefaultMaxRetries    int    = 5
+
+	elasticsearchRetryInitialInterval = 500 * time.Millisecond
+	elasticsearchRetryMaxInterval     = 30 * time.Second
+)
+
+type elasticsearchConfiguration struct {
+	URL      string
+	Username string
+	Password string
+	APIKey   string `mapstructure:"api_key"`
+	// Index is the prefix of the daily indices written to, e.g.
+	// mqti-2020.06.30, named after each document's time in UTC.
+	Index string
+	// DateFormat is the Go time layout of the date suffix, e.g. 2006.01
+	// for monthly indices; none makes Index the only index.
+	DateFormat            *string       `mapstructure:"date_format"`
+	TLSCA                 string        `mapstructure:"tls_ca"`
+	TLSInsecureSkipVerify bool          `mapstructure:"tls_insecure_skip_verify"`
+	BatchSize             int           `mapstructure:"batch_size"`
+	FlushInterval         time.Duration `mapstructure:"flush_interval"`
+	Timeout               time.Duration
+	// MaxRetries is how often documents rejected with 429 Too Many
+	// Requests are sent again, with exponential backoff.
+	MaxRetries *int `mapstructure:"max_retries"`
+}
+
+// elasticsearchSink bulk-indexes points as documents into Elasticsearch or
+// OpenSearch.  A document is the message's JSON payload, or the point's
+// fields when it isn't JSON, with @timestamp, topic, mapping and tags
+// added.
+type elasticsearchSink struct {
+	config     elasticsearchConfiguration
+	dateFormat string
+	maxRetries int
+	client     *http.Client
+}
+
+type elasticsearchDocument struct {
+	index  string
+	source []byte
+}
+
+func newElasticsearchSink(settings map[string]interface{}) (Sink, error) {
+	v := viper.New()
+	if err := v.MergeConfigMap(settings); err != nil {
+		return nil, err
+	}
+
+	var c elasticsearchConfiguration
+	if err := v.Unmarshal(&c); err != nil {
+		return nil, err
+	}
+	if c.URL == "" {
+		return nil, fmt.Errorf("url must be set")
+	}
+	c.URL = strings.TrimSuffix(c.URL, "/")
+	if c.Index == "" {
+		c.Index = elasticsearchDefaultIndex
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = elasticsearchDefaultBatchSize
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = elasticsearchDefaultFlushInterval
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = elasticsearchDefaultTimeout
+	}
+
+	s := &elasticsearchSink{config: c, dateFormat: elasticsearchDefaultDateFormat, maxRetries: elasticsearchDefaultMaxRetries}
+	if c.DateFormat != nil {
+		s.dateFormat = *c.DateFormat
+	}
+	if c.MaxRetries != nil {
+		s.maxRetries = *c.MaxRetries
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.TLSInsecureSkipVerify}
+	if c.TLSCA != "" {
+		pool, err := NewCertPool(c.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	s.client = &http.Client{
+		Timeout:   c.Timeout,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+	}
+
+	return newBatchedSink(s, c.BatchSize, c.FlushInterval), nil
+}
+
+// encode builds the document p is indexed as, and the index it goes to.
+func (s *elasticsearchSink) encode(p *Point) (interface{}, error) {
+	t := p.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	var doc map[string]interface{}
+	if p.Message != nil {
+		doc, _ = p.Message.PayloadAsJSON()
+	}
+	if doc == nil {
+		doc = make(map[string]interface{}, len(p.Fields)+4)
+		for k, v := range p.Fields {
+			doc[k] = v
+		}
+	}
+
+	doc["@timestamp"] = t.UTC().Format(time.RFC3339Nano)
+	if p.Message != nil {
+		doc["topic"] = p.Message.Topic()
+		doc["mapping"] = p.Message.MappingName()
+	}
+	if len(p.Tags) > 0 {
+		doc["tags"] = p.Tags
+	}
+
+	source, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	index := s.config.Index
+	if s.dateFormat != "" {
+		index += "-" + t.UTC().Format(s.dateFormat)
+	}
+
+	return elasticsearchDocument{index: index, source: source}, nil
+}
+
+// writeBatch indexes a batch of documents, sending those rejected with
+// 429 again after a backoff.  Documents rejected for any other reason are
+// logged.
+func (s *elasticsearchSink) writeBatch(ctx context.Context, batch []interface{}) error {
+	docs := make([]elasticsearchDocument, len(batch))
+	for i, doc := range batch {
+		docs[i] = doc.(elasticsearchDocument)
+	}
+
+	b := newBackoff(elasticsearchRetryInitialInterval, elasticsearchRetryMaxInterval)
+
+	for attempt := 0; len(docs) > 0; attempt++ {
+		if attempt > 0 {
+			if attempt > s.maxRetries {
+				return fmt.Errorf("%d documents still rejected with 429 Too Many Requests after %d retries", len(docs), s.maxRetries)
+			}
+
+			d := b.duration()
+			Log.Warnf("%s is overloaded, sending %d documents again in %s", s.config.URL, len(docs), d)
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		var err error
+		if docs, err = s.bulk(ctx, docs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bulk sends docs as one bulk request, returning those to send again.
+func (s *elasticsearchSink) bulk(ctx context.Context, docs []elasticsearchDocument) ([]elasticsearchDocument, error) {
+	var body bytes.Buffer
+	for _, doc := range docs {
+		action, err := json.Marshal(map[string]interface{}{"index": map[string]string{"_index": doc.index}})
+		if err != nil {
+			return nil, err
+		}
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(doc.source)
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.config.URL+"/_bulk", &body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("User-Agent", "mqti/"+Version)
+	if s.config.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+s.config.APIKey)
+	} else if s.config.Username != "" {
+		req.SetBasicAuth(s.config.Username, s.config.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return docs, nil
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("bulk request to %s failed: %s: %s", s.config.URL, resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	var result struct {
+		Errors bool
+		Items  []map[string]struct {
+			Status int
+			Error  json.RawMessage
+		}
+	}
+	if err = json.Unmarshal(respBody, &result); err != nil {
+		return nil, err
+	}
+	if !result.Errors {
+		return nil, nil
+	}
+
+	var retry []elasticsearchDocument
+	var failed int
+	var firstError json.RawMessage
+	for i, item := range result.Items {
+		for _, r := range item {
+			switch {
+			case r.Status == http.StatusTooManyRequests && i < len(docs):
+				retry = append(retry, docs[i])
+			case r.Status/100 != 2:
+				if failed++; firstError == nil {
+					firstError = r.Error
+				}
+			}
+		}
+	}
+
+	if failed > 0 {
+		Log.Errorf("%s rejected %d documents, the first with: %s", s.config.URL, failed, firstError)
+	}
+
+	return retry, nil
+}
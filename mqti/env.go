@@ -0,0 +1,115 @@
+package mqti
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/spf13/viper"
+)
+
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ReadConfig reads the config file, directory or remote config, and
+// expands ${VAR} references in every string value from the environment, so
+// the same file can be promoted across environments.  A reference to an
+// unset variable is an error rather than an empty value.
+func ReadConfig() error {
+	var err error
+	switch {
+	case remote != nil:
+		err = readRemoteConfig()
+	case configDir != "":
+		err = readConfigDir()
+	default:
+		err = viper.ReadInConfig()
+	}
+	if err != nil {
+		return err
+	}
+	return expandConfig()
+}
+
+// expandConfig expands ${VAR} references in the config already read, then
+// resolves secret references such as vault:secret/mqtt#password.
+func expandConfig() error {
+	var refs []secretRef
+	settings, err := expandEnv(viper.AllSettings(), nil, &refs)
+	if err != nil {
+		return err
+	}
+	if err = viper.MergeConfigMap(settings.(map[string]interface{})); err != nil {
+		return err
+	}
+	secretRefs = refs
+	return nil
+}
+
+// expandEnv expands v, found at path, adding the secret references it
+// resolves to refs.
+func expandEnv(v interface{}, path []interface{}, refs *[]secretRef) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		s, err := expandEnvString(v)
+		if err != nil {
+			return nil, err
+		}
+		secret, err := resolveSecret(s)
+		if err != nil {
+			return nil, err
+		}
+		if secret != s {
+			*refs = append(*refs, secretRef{path: path, ref: s, value: secret})
+		}
+		return secret, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			x, err := expandEnv(e, appendPath(path, k), refs)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = x
+		}
+		return out, nil
+	case map[interface{}]interface{}:
+		out := make(map[interface{}]interface{}, len(v))
+		for k, e := range v {
+			x, err := expandEnv(e, appendPath(path, k), refs)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = x
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			x, err := expandEnv(e, appendPath(path, i), refs)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = x
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// appendPath returns path with k added, leaving path as it was.
+func appendPath(path []interface{}, k interface{}) []interface{} {
+	return append(path[:len(path):len(path)], k)
+}
+
+func expandEnvString(s string) (string, error) {
+	var err error
+	out := envReference.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envReference.FindStringSubmatch(ref)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value
+	})
+	return out, err
+}
@@ -0,0 +1,133 @@
+package mqti
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+const execDefaultTimeout = 5 * time.Second
+
+const execDefaultConcurrency int = 1
+
+const (
+	execModeFilter    string = "filter"
+	execModeTransform string = "transform"
+)
+
+// execMunger pipes message payloads through an external command.  In filter
+// mode a zero exit status keeps the message, in transform mode the command's
+// stdout replaces the payload.  At most Concurrency commands run at once,
+// each holding a slot from acquire to release.
+type execMunger struct {
+	config ExecMungerConfiguration
+	slots  chan struct{}
+}
+
+// transformedMessage overrides the payload of the message it wraps.
+type transformedMessage struct {
+	MQTT.Message
+	payload []byte
+}
+
+// Payload ...
+func (t transformedMessage) Payload() []byte {
+	return t.payload
+}
+
+func (e ExecMungerConfiguration) defined() bool {
+	return len(e.Command) > 0
+}
+
+func newExecMunger(c ExecMungerConfiguration) (*execMunger, error) {
+	switch c.Mode {
+	case execModeFilter, execModeTransform:
+	default:
+		return nil, fmt.Errorf("invalid exec mode '%s', must be one of filter or transform", c.Mode)
+	}
+
+	concurrency := c.Concurrency
+	if concurrency <= 0 {
+		concurrency = execDefaultConcurrency
+	}
+
+	Log.Warnf("External %s command '%s' receives raw payloads, make sure it treats them as untrusted input",
+		c.Mode, strings.Join(c.Command, " "))
+
+	return &execMunger{config: c, slots: make(chan struct{}, concurrency)}, nil
+}
+
+func (e *execMunger) timeout() time.Duration {
+	if e.config.Timeout > 0 {
+		return e.config.Timeout
+	}
+	return execDefaultTimeout
+}
+
+// acquire waits for a free slot, and returns false if ctx is done first.
+func (e *execMunger) acquire(ctx context.Context) bool {
+	select {
+	case e.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (e *execMunger) release() {
+	<-e.slots
+}
+
+func (e *execMunger) run(payload []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout())
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, e.config.Command[0], e.config.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", e.timeout())
+	}
+	if stderr.Len() > 0 {
+		Log.Debugf("%s: %s", e.config.Command[0], stderr.String())
+	}
+
+	return stdout.Bytes(), err
+}
+
+// apply returns the message to forward, or nil when it should be skipped.
+func (e *execMunger) apply(m *MQTTMessage) *MQTTMessage {
+	out, err := e.run(m.Payload())
+
+	if e.config.Mode == execModeFilter {
+		if _, exited := err.(*exec.ExitError); err != nil && !exited {
+			Log.Errorf("exec filter on %s failed: %s", m.Topic(), err)
+			sendDeadLetter(m, deadLetterStageExec, "", err)
+		}
+		if err != nil {
+			return nil
+		}
+		return m
+	}
+
+	if err != nil {
+		Log.Errorf("exec transform on %s failed: %s", m.Topic(), err)
+		sendDeadLetter(m, deadLetterStageExec, "", err)
+		return nil
+	}
+
+	t := *m
+	t.Message = transformedMessage{m.Message, out}
+
+	return &t
+}
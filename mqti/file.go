@@ -0,0 +1,153 @@
+package mqti
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	InfluxDBClient "github.com/influxdata/influxdb/client"
+	"github.com/spf13/viper"
+)
+
+const fileDefaultMaxBackups int = 5
+
+type fileConfiguration struct {
+	// Path is the file written to, stdout when empty or -.
+	Path      string
+	Precision string
+	// MaxSize is the size in bytes past which the file is rotated to
+	// <path>.1, <path>.2 and so on, 0 meaning never.
+	MaxSize    int64 `mapstructure:"max_size"`
+	MaxBackups *int  `mapstructure:"max_backups"`
+}
+
+// fileSink writes points as InfluxDB line protocol, one per line, to
+// stdout or a file, for debugging mappings or piping into other tools.
+type fileSink struct {
+	config     fileConfiguration
+	precision  string
+	maxBackups int
+
+	mu   sync.Mutex
+	w    io.Writer
+	f    *os.File
+	size int64
+}
+
+func newFileSink(settings map[string]interface{}) (Sink, error) {
+	v := viper.New()
+	if err := v.MergeConfigMap(settings); err != nil {
+		return nil, err
+	}
+
+	var c fileConfiguration
+	if err := v.Unmarshal(&c); err != nil {
+		return nil, err
+	}
+
+	s := &fileSink{config: c, precision: c.Precision, maxBackups: fileDefaultMaxBackups}
+	if s.precision == "" {
+		s.precision = influxDBDefaultPrecision
+	}
+	if !validInfluxDBPrecision(s.precision) {
+		return nil, fmt.Errorf("invalid precision '%s', must be one of ns, us, ms or s", c.Precision)
+	}
+	if c.MaxBackups != nil {
+		s.maxBackups = *c.MaxBackups
+	}
+
+	if c.Path == "" || c.Path == "-" {
+		s.w = os.Stdout
+		return s, nil
+	}
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.w, s.f, s.size = f, f, info.Size()
+	return nil
+}
+
+// rotate moves the file to <path>.1, shifting older ones up and dropping
+// the one past max_backups, and starts a new file.
+func (s *fileSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+
+	if s.maxBackups > 0 {
+		for i := s.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", s.config.Path, i), fmt.Sprintf("%s.%d", s.config.Path, i+1))
+		}
+		if err := os.Rename(s.config.Path, s.config.Path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.config.Path); err != nil {
+		return err
+	}
+
+	return s.open()
+}
+
+// Write writes points as one block of lines, so lines of concurrent
+// workers don't interleave.
+func (s *fileSink) Write(ctx context.Context, points []*Point) error {
+	var lines strings.Builder
+	for _, p := range points {
+		line, err := lineProtocol(InfluxDBClient.Point{
+			Measurement: p.Measurement,
+			Tags:        p.Tags,
+			Fields:      p.Fields,
+			Time:        p.Time,
+		}, s.precision)
+		if err != nil {
+			return err
+		}
+		lines.WriteString(line)
+		lines.WriteByte('\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f != nil && s.config.MaxSize > 0 && s.size > 0 && s.size+int64(lines.Len()) > s.config.MaxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := io.WriteString(s.w, lines.String())
+	s.size += int64(n)
+
+	return err
+}
+
+// Close closes the file, if writing to one.
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
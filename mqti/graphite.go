@@ -0,0 +1,189 @@
+package mqti
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	graphiteDefaultProtocol string = "tcp"
+	graphiteDefaultPath     string = "{{.Measurement}}.{{.FieldName}}"
+	graphiteDefaultTimeout         = 10 * time.Second
+)
+
+type graphiteConfiguration struct {
+	// Address is the host:port of the plaintext listener, usually 2003.
+	Address  string
+	Protocol string
+	// Path is a template rendered per field with graphitePathData, e.g.
+	// sensors.{{.Tag "device"}}.{{.FieldName}}.
+	Path    string
+	Timeout time.Duration
+}
+
+// graphitePathData is what path templates are rendered with, the
+// message's data plus the point's measurement and tags and the name of
+// the field.
+type graphitePathData struct {
+	messageTemplateData
+	Measurement string
+	FieldName   string
+	tags        map[string]string
+}
+
+// Tag returns the value of a tag of the point, or an empty string.
+func (d graphitePathData) Tag(key string) string {
+	return d.tags[key]
+}
+
+// graphiteSink writes every numeric or boolean field of a point as one
+// Graphite plaintext metric, path value timestamp.  String fields are
+// dropped.
+type graphiteSink struct {
+	config graphiteConfiguration
+	path   *messageTemplate
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newGraphiteSink(settings map[string]interface{}) (Sink, error) {
+	v := viper.New()
+	if err := v.MergeConfigMap(settings); err != nil {
+		return nil, err
+	}
+
+	var c graphiteConfiguration
+	if err := v.Unmarshal(&c); err != nil {
+		return nil, err
+	}
+	if c.Address == "" {
+		return nil, fmt.Errorf("address must be set")
+	}
+	switch c.Protocol {
+	case "":
+		c.Protocol = graphiteDefaultProtocol
+	case "tcp", "udp":
+	default:
+		return nil, fmt.Errorf("invalid protocol '%s', must be one of tcp or udp", c.Protocol)
+	}
+	if c.Path == "" {
+		c.Path = graphiteDefaultPath
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = graphiteDefaultTimeout
+	}
+
+	path, err := newMessageTemplate("path", c.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &graphiteSink{config: c, path: path}, nil
+}
+
+// graphitePath replaces what would split a plaintext line, and turns the
+// slashes of MQTT topics into the dots separating path nodes.
+func graphitePath(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/':
+			return '.'
+		case ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// lines renders the metrics of p, in field name order.
+func (s *graphiteSink) lines(b *bytes.Buffer, p *Point) error {
+	if p.Message == nil {
+		return fmt.Errorf("graphite output needs the message a point was built from")
+	}
+
+	t := p.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	names := make([]string, 0, len(p.Fields))
+	for k := range p.Fields {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value, ok := numericValue(p.Fields[name])
+		if !ok {
+			continue
+		}
+
+		var path bytes.Buffer
+		data := graphitePathData{messageTemplateData{p.Message}, p.Measurement, name, p.Tags}
+		if err := s.path.Execute(&path, data); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(b, "%s %s %d\n", graphitePath(path.String()), strconv.FormatFloat(value, 'f', -1, 64), t.Unix())
+	}
+
+	return nil
+}
+
+// Write sends the metrics of points, dialling first when there is no
+// connection.  A failed write drops the connection for the next Write to
+// dial again.
+func (s *graphiteSink) Write(ctx context.Context, points []*Point) error {
+	var b bytes.Buffer
+	for _, p := range points {
+		if err := s.lines(&b, p); err != nil {
+			return err
+		}
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.config.Protocol, s.config.Address, s.config.Timeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(s.config.Timeout))
+	if _, err := s.conn.Write(b.Bytes()); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+
+	return nil
+}
+
+// Close closes the connection, if there is one.
+func (s *graphiteSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
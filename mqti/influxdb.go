@@ -1,26 +1,29 @@
 package mqti
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"time"
 
 	InfluxDBClient "github.com/influxdata/influxdb/client"
 	"github.com/mmcloughlin/geohash"
-	"github.com/spf13/viper"
 )
 
 // InfluxDBConnection ...
 type InfluxDBConnection struct {
 	*InfluxDBClient.Client
+
+	// v2 is set when writing to InfluxDB 2.x.
+	v2 *influxDBv2
 }
 
-func (i InfluxDBConnection) geoHashFieldsDefined(g GeohashMungerConfiguration) bool {
+func (g GeohashMungerConfiguration) defined() bool {
 	return len(g.LatitudeField) > 0 && len(g.LongitudeField) > 0 && len(g.ResultField) > 0
 }
 
-func (i InfluxDBConnection) applyGeohashMunger(g GeohashMungerConfiguration, fields map[string]interface{}, tags map[string]string) error {
-	if i.geoHashFieldsDefined(g) {
+func (g GeohashMungerConfiguration) apply(fields map[string]interface{}, tags map[string]string) error {
+	if g.defined() {
 		tags[g.ResultField] = geohash.Encode(
 			fields[g.LatitudeField].(float64),
 			fields[g.LongitudeField].(float64))
@@ -29,7 +32,7 @@ func (i InfluxDBConnection) applyGeohashMunger(g GeohashMungerConfiguration, fie
 	return nil
 }
 
-func (i InfluxDBConnection) applyTagsMunger(t TagsMungerConfiguration, fields map[string]interface{}, tags map[string]string) error {
+func (t TagsMungerConfiguration) apply(fields map[string]interface{}, tags map[string]string) error {
 	for _, x := range t.From {
 		for k, v := range x {
 			if fields[k] != nil {
@@ -40,105 +43,214 @@ func (i InfluxDBConnection) applyTagsMunger(t TagsMungerConfiguration, fields ma
 	return nil
 }
 
-func (i InfluxDBConnection) applyMungers(m struct {
+func applyInfluxDBMungers(m struct {
 	Tags    TagsMungerConfiguration
 	Geohash GeohashMungerConfiguration
 }, fields map[string]interface{}, tags map[string]string) error {
 	var err error
 
-	if err = i.applyGeohashMunger(m.Geohash, fields, tags); err != nil {
+	if err = m.Geohash.apply(fields, tags); err != nil {
 		Log.Warn(err)
 	}
 
-	if err = i.applyTagsMunger(m.Tags, fields, tags); err != nil {
+	if err = m.Tags.apply(fields, tags); err != nil {
 		Log.Warn(err)
 	}
 
 	return err
 }
 
-// Forward ...
-func (i InfluxDBConnection) Forward(m *MQTTMessage) error {
+// newPoint turns m into a point, applying the mapping's mungers and
+// schema.
+func newPoint(m *MQTTMessage) (*Point, error) {
 	var err error
 	var fields map[string]interface{}
 
 	config := m.MappingConfiguration.InfluxDB
 
-	tags := config.Tags
-	if tags == nil {
-		tags = make(map[string]string)
+	// The mapping's tags are shared by every message, copy them before the
+	// mungers add to them.
+	tags := make(map[string]string, len(config.Tags))
+	for k, v := range config.Tags {
+		tags[k] = v
+	}
+	for k, v := range m.topicTags() {
+		tags[k] = v
+	}
+
+	start := time.Now()
+	fields, err = m.Fields()
+	m.timings.since(StageParse, start)
+
+	if err != nil && m.MQTT.PayloadFormat == payloadFormatScalar {
+		return nil, err
 	}
 
-	fields, err = m.PayloadAsJSON()
 	if err == nil {
-		mungers := m.MappingConfiguration.InfluxDB.Mungers
-		if err = i.applyMungers(mungers, fields, tags); err != nil {
+		renameFields(config.Rename, fields)
+	}
+
+	var t time.Time
+	var timed bool
+	if err == nil && m.MQTT.Timestamp.defined() {
+		if t, timed, err = m.MQTT.Timestamp.apply(m, fields); err != nil {
+			return nil, fmt.Errorf("%s: %s", m.Topic(), err)
+		}
+	}
+
+	if err == nil {
+		start = time.Now()
+		switch m.MQTT.PayloadFormat {
+		case payloadFormatCSV:
+			m.MQTT.CSV.apply(fields, tags)
+		case payloadFormatSparkplug:
+			// The metric's timestamp, unless mqtt.timestamp is set.
+			if st, ok := applySparkplugMetadata(fields, tags); ok && !timed {
+				t, timed = st, true
+			}
+		}
+		if err = applyInfluxDBMungers(config.Mungers, fields, tags); err != nil {
 			Log.Warn(err)
 		}
+		if err = coerceFields(config.Coerce, fields); err != nil {
+			return nil, fmt.Errorf("%s: %s", m.Topic(), err)
+		}
+		if err = convertFields(config.Convert, fields); err != nil {
+			return nil, fmt.Errorf("%s: %s", m.Topic(), err)
+		}
+		if err = checkBounds(config.Bounds, fields); err != nil {
+			return nil, err
+		}
+		m.timings.since(StageTransform, start)
 	} else {
 		fields = map[string]interface{}{"value": m.PayloadAsString()}
 	}
 
-	p := InfluxDBClient.Point{
-		Measurement: config.Measurement,
-		Tags:        tags,
-		Fields:      fields,
-		Time:        time.Now(),
+	if config.Schema.defined() {
+		start = time.Now()
+		fields, err = config.Schema.apply(fields, tags)
+		m.timings.since(StageTransform, start)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", m.Topic(), err)
+		}
+	}
+
+	if err = config.filterKeys(fields, tags); err != nil {
+		return nil, fmt.Errorf("%s: %s", m.Topic(), err)
+	}
+
+	measurement, err := renderMeasurement(config.Measurement, m, tags)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", m.Topic(), err)
 	}
 
-	Log.Info(p)
+	if err = checkTagCardinality(measurement, tags, config.Schema.MaxTagValues); err != nil {
+		return nil, err
+	}
 
-	_, err = i.Write(InfluxDBClient.BatchPoints{
-		Points:   []InfluxDBClient.Point{p},
-		Database: m.MappingConfiguration.InfluxDB.Database,
-	})
+	start = time.Now()
+	p := &Point{
+		Database:        config.database(),
+		RetentionPolicy: config.RetentionPolicy,
+		Organization:    config.Organization,
+		Measurement:     measurement,
+		Tags:            tags,
+		Fields:          fields,
+		Time:            m.received,
+		Message:         m,
+	}
+	if timed {
+		p.Time = t
+	} else if p.Time.IsZero() {
+		p.Time = time.Now()
+	}
+	m.timings.since(StageSerialize, start)
 
-	return err
+	return p, nil
 }
 
-func influxDBConfig() map[string]interface{} {
-	return viper.GetStringMap("influxdb")
+// Forward writes m to this InfluxDB, whatever output its mapping selects.
+func (i InfluxDBConnection) Forward(m *MQTTMessage) error {
+	return forward(i, m)
 }
 
-func influxDBURI() *url.URL {
-	host, _ := url.Parse(fmt.Sprintf("%s://%s:%s", influxDBProtocol(), influxDBConfig()["host"], influxDBConfig()["port"]))
-	return host
+// influxDBTarget is where points are written: a database and retention
+// policy, or a bucket and organization with version 2.
+type influxDBTarget struct {
+	database, retentionPolicy, organization string
 }
 
-func influxDBProtocol() string {
-	t := influxDBConfig()["tls"]
-	if t != nil && t.(bool) {
-		return "https"
+// Write writes points, each into its database and retention policy, or
+// bucket and organization with version 2, with a request per target.
+func (i InfluxDBConnection) Write(ctx context.Context, points []*Point) error {
+	var targets []influxDBTarget
+	batches := make(map[influxDBTarget][]InfluxDBClient.Point)
+
+	for _, p := range points {
+		Log.Info(p)
+
+		t := influxDBTarget{p.Database, p.RetentionPolicy, p.Organization}
+		if _, ok := batches[t]; !ok {
+			targets = append(targets, t)
+		}
+		batches[t] = append(batches[t], InfluxDBClient.Point{
+			Measurement: p.Measurement,
+			Tags:        p.Tags,
+			Fields:      p.Fields,
+			Time:        p.Time,
+		})
 	}
-	return "http"
+
+	for _, t := range targets {
+		var err error
+		if i.v2 != nil {
+			err = i.v2.write(ctx, batches[t], t.database, t.organization)
+		} else {
+			_, err = i.Client.Write(InfluxDBClient.BatchPoints{
+				Points:          batches[t],
+				Database:        t.database,
+				RetentionPolicy: t.retentionPolicy,
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func influxDBUsername() string {
-	u := influxDBConfig()["username"]
-	if u != nil {
-		return u.(string)
+// Close releases the 2.x client's connections.
+func (i InfluxDBConnection) Close() error {
+	if i.v2 != nil {
+		return i.v2.Close()
 	}
-	return ""
+	return nil
 }
 
-func influxDBPassword() string {
-	p := influxDBConfig()["password"]
-	if p != nil {
-		return p.(string)
+func (c influxDBConfiguration) uRI() *url.URL {
+	host, _ := url.Parse(fmt.Sprintf("%s://%s:%s", c.protocol(), c.Host, c.Port))
+	return host
+}
+
+func (c influxDBConfiguration) protocol() string {
+	if c.TLS {
+		return "https"
 	}
-	return ""
+	return "http"
 }
 
-// NewInfluxDBConnection ...
-func NewInfluxDBConnection() (*InfluxDBConnection, error) {
+// NewWriter connects to the InfluxDB of config.
+func NewWriter(config *Config) (*InfluxDBConnection, error) {
 	var err error
 	var influxDBConn *InfluxDBClient.Client
 
-	opts := InfluxDBClient.Config{URL: *influxDBURI()}
+	c := config.InfluxDB
+	opts := InfluxDBClient.Config{URL: *c.uRI()}
 
-	if influxDBUsername() != "" && influxDBPassword() != "" {
-		opts.Username = influxDBUsername()
-		opts.Password = influxDBPassword()
+	if c.Username != "" && c.Password != "" {
+		opts.Username = c.Username
+		opts.Password = c.Password
 	}
 
 	influxDBConn, err = InfluxDBClient.NewClient(opts)
@@ -146,5 +258,19 @@ func NewInfluxDBConnection() (*InfluxDBConnection, error) {
 		return nil, err
 	}
 
-	return &InfluxDBConnection{influxDBConn}, nil
+	conn := &InfluxDBConnection{Client: influxDBConn}
+	if c.Version == influxDBVersion2 {
+		conn.v2 = newInfluxDBv2(c)
+	}
+
+	return conn, nil
+}
+
+// NewInfluxDBConnection connects to the InfluxDB of the loaded config.
+func NewInfluxDBConnection() (*InfluxDBConnection, error) {
+	config, err := GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewWriter(config)
 }
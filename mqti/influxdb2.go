@@ -0,0 +1,106 @@
+package mqti
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	InfluxDBClient "github.com/influxdata/influxdb/client"
+	"github.com/influxdata/influxdb/models"
+)
+
+const (
+	influxDBVersion1 int = 1
+	influxDBVersion2 int = 2
+)
+
+const influxDBDefaultPrecision string = "ns"
+
+// influxDBv2 writes to the InfluxDB 2.x API through influxdb-client-go,
+// authenticating with an API token and writing into buckets of an
+// organization rather than databases.  Pings go through the 1.x client, as
+// 2.x answers /ping as well.
+type influxDBv2 struct {
+	client influxdb2.Client
+	org    string
+	bucket string
+}
+
+func newInfluxDBv2(c influxDBConfiguration) *influxDBv2 {
+	opts := influxdb2.DefaultOptions().
+		SetPrecision(influxDBPrecisions[c.Precision]).
+		SetHTTPRequestTimeout(10)
+
+	return &influxDBv2{
+		client: influxdb2.NewClientWithOptions(c.uRI().String(), c.Token, opts),
+		org:    c.Organization,
+		bucket: c.Bucket,
+	}
+}
+
+// defaultDatabase is where mappings without a database write to, the
+// bucket with version 2 and nowhere otherwise.
+func (c influxDBConfiguration) defaultDatabase() string {
+	if c.Version == influxDBVersion2 {
+		return c.Bucket
+	}
+	return ""
+}
+
+// influxDBPrecisions maps influxdb.precision to the client's, the
+// default "" being ns.
+var influxDBPrecisions = map[string]time.Duration{
+	"":   time.Nanosecond,
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+func validInfluxDBPrecision(p string) bool {
+	_, ok := influxDBPrecisions[p]
+	return ok
+}
+
+// lineProtocol renders p with its timestamp in precision, or without one
+// when p.Time is zero so InfluxDB assigns it.
+func lineProtocol(p InfluxDBClient.Point, precision string) (string, error) {
+	pt, err := models.NewPoint(p.Measurement, models.NewTags(p.Tags), p.Fields, p.Time)
+	if err != nil {
+		return "", err
+	}
+	// The 2.x API says us, the models package u.
+	if precision == "us" {
+		precision = "u"
+	}
+	return pt.PrecisionString(precision), nil
+}
+
+// write writes points into bucket of org, or the configured ones when
+// empty, with one request.  Points without a time get none, so InfluxDB
+// assigns it.
+func (w *influxDBv2) write(ctx context.Context, points []InfluxDBClient.Point, bucket, org string) error {
+	if bucket == "" {
+		bucket = w.bucket
+	}
+	if org == "" {
+		org = w.org
+	}
+
+	pts := make([]*write.Point, len(points))
+	for i, p := range points {
+		pts[i] = write.NewPoint(p.Measurement, p.Tags, p.Fields, p.Time)
+	}
+
+	if err := w.client.WriteAPIBlocking(org, bucket).WritePoint(ctx, pts...); err != nil {
+		return fmt.Errorf("writing to bucket %s failed: %s", bucket, err)
+	}
+	return nil
+}
+
+func (w *influxDBv2) Close() error {
+	w.client.Close()
+	return nil
+}
@@ -0,0 +1,175 @@
+package mqti
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/spf13/viper"
+)
+
+const kafkaDefaultBatchTimeout = time.Second
+
+type kafkaConfiguration struct {
+	Brokers []string
+	// Topic is a template rendered per message, e.g.
+	// mqtt.{{.TopicSegment 0}}, see messageTemplateData.
+	Topic                 string
+	TLS                   bool
+	TLSCA                 string `mapstructure:"tls_ca"`
+	TLSCert               string `mapstructure:"tls_cert"`
+	TLSPrivateKey         string `mapstructure:"tls_private_key"`
+	TLSInsecureSkipVerify bool   `mapstructure:"tls_insecure_skip_verify"`
+	SASL                  struct {
+		Username string
+		Password string
+	}
+	// BatchSize over 1 queues points and produces them batch_size at a
+	// time, at least every batch_timeout.
+	BatchSize    int           `mapstructure:"batch_size"`
+	BatchTimeout time.Duration `mapstructure:"batch_timeout"`
+	// Canonical encodes points with sorted keys, see CanonicalJSON.
+	Canonical bool
+}
+
+// kafkaSink produces points as JSON to Kafka, keyed by the message's
+// routing key so a device's messages stay in order on one partition.
+// Every write waits for all in-sync replicas to acknowledge it.
+type kafkaSink struct {
+	producer  sarama.SyncProducer
+	topic     *messageTemplate
+	canonical bool
+}
+
+func newKafkaSink(settings map[string]interface{}) (Sink, error) {
+	v := viper.New()
+	if err := v.MergeConfigMap(settings); err != nil {
+		return nil, err
+	}
+
+	var c kafkaConfiguration
+	if err := v.Unmarshal(&c); err != nil {
+		return nil, err
+	}
+	if len(c.Brokers) == 0 {
+		return nil, fmt.Errorf("brokers must be set")
+	}
+	if c.Topic == "" {
+		return nil, fmt.Errorf("topic must be set")
+	}
+
+	topic, err := newMessageTemplate("topic", c.Topic)
+	if err != nil {
+		return nil, err
+	}
+
+	config := sarama.NewConfig()
+	config.ClientID = "mqti"
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+
+	if c.TLS {
+		tlsConfig := &tls.Config{InsecureSkipVerify: c.TLSInsecureSkipVerify}
+		if c.TLSCA != "" {
+			if tlsConfig.RootCAs, err = NewCertPool(c.TLSCA); err != nil {
+				return nil, err
+			}
+		}
+		if c.TLSCert != "" {
+			cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSPrivateKey)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+
+	if c.SASL.Username != "" {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		config.Net.SASL.User = c.SASL.Username
+		config.Net.SASL.Password = c.SASL.Password
+	}
+
+	producer, err := sarama.NewSyncProducer(c.Brokers, config)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &kafkaSink{producer: producer, topic: topic, canonical: c.Canonical}
+	if c.BatchSize > 1 {
+		if c.BatchTimeout <= 0 {
+			c.BatchTimeout = kafkaDefaultBatchTimeout
+		}
+		return newBatchedSink(s, c.BatchSize, c.BatchTimeout), nil
+	}
+	return s, nil
+}
+
+// kafkaTopicName replaces what Kafka doesn't allow in topic names, slashes
+// of MQTT topics becoming dots.
+func kafkaTopicName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		case r == '/':
+			return '.'
+		}
+		return '_'
+	}, s)
+}
+
+// encode builds the message p is produced as.
+func (s *kafkaSink) encode(p *Point) (interface{}, error) {
+	if p.Message == nil {
+		return nil, fmt.Errorf("kafka output needs the message a point was built from")
+	}
+
+	topic, err := s.topic.render(p.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := marshalJSON(p, s.canonical)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sarama.ProducerMessage{
+		Topic: kafkaTopicName(topic),
+		Key:   sarama.StringEncoder(p.Message.RoutingKey()),
+		Value: sarama.ByteEncoder(value),
+	}, nil
+}
+
+// Write produces points as one batch.
+func (s *kafkaSink) Write(ctx context.Context, points []*Point) error {
+	batch := make([]interface{}, len(points))
+	for i, p := range points {
+		msg, err := s.encode(p)
+		if err != nil {
+			return err
+		}
+		batch[i] = msg
+	}
+	return s.writeBatch(ctx, batch)
+}
+
+func (s *kafkaSink) writeBatch(ctx context.Context, batch []interface{}) error {
+	msgs := make([]*sarama.ProducerMessage, len(batch))
+	for i, msg := range batch {
+		msgs[i] = msg.(*sarama.ProducerMessage)
+	}
+	return s.producer.SendMessages(msgs)
+}
+
+// Close waits for what is being produced.
+func (s *kafkaSink) Close() error {
+	return s.producer.Close()
+}
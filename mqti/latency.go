@@ -0,0 +1,108 @@
+package mqti
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Stage is a step of the message pipeline.
+type Stage int
+
+// Pipeline stages, in the order a message passes through them.
+const (
+	StageParse Stage = iota
+	StageFilter
+	StageTransform
+	StageSerialize
+	StageSink
+	stageCount
+)
+
+var stageNames = [stageCount]string{"parse", "filter", "transform", "serialize", "sink"}
+
+func (s Stage) String() string {
+	return stageNames[s]
+}
+
+// StageTimings holds the time a single message spent in each stage.  A
+// message is only handled by one goroutine at a time, so it isn't locked.
+type StageTimings [stageCount]time.Duration
+
+// StageLatency aggregates the time spent in a stage across all messages.
+type StageLatency struct {
+	Count int64
+	Total time.Duration
+	Max   time.Duration
+}
+
+// Mean ...
+func (l StageLatency) Mean() time.Duration {
+	if l.Count == 0 {
+		return 0
+	}
+	return l.Total / time.Duration(l.Count)
+}
+
+var stageLatencies struct {
+	sync.Mutex
+	stages [stageCount]StageLatency
+}
+
+// since adds the time elapsed since start to stage s.
+func (t *StageTimings) since(s Stage, start time.Time) {
+	if t != nil {
+		t[s] += time.Since(start)
+	}
+}
+
+func (t *StageTimings) String() string {
+	var b bytes.Buffer
+	for s, d := range t {
+		if s > 0 {
+			b.WriteString(" ")
+		}
+		fmt.Fprintf(&b, "%s=%s", Stage(s), d)
+	}
+	return b.String()
+}
+
+// record adds the timings of a message that has left the pipeline to the
+// aggregate per-stage latencies, and logs the breakdown when debugging.
+func (t *StageTimings) record(topic string) {
+	if t == nil {
+		return
+	}
+
+	stageLatencies.Lock()
+	for s, d := range t {
+		l := &stageLatencies.stages[s]
+		l.Count++
+		l.Total += d
+		if d > l.Max {
+			l.Max = d
+		}
+	}
+	stageLatencies.Unlock()
+
+	if Log.Level >= logrus.DebugLevel {
+		Log.WithField("topic", topic).Debugf("Stage latencies: %s", t)
+	}
+}
+
+// StageLatencies returns the latency of each pipeline stage aggregated over
+// every message forwarded so far, keyed by stage name.
+func StageLatencies() map[string]StageLatency {
+	stageLatencies.Lock()
+	defer stageLatencies.Unlock()
+
+	out := make(map[string]StageLatency, stageCount)
+	for s, l := range stageLatencies.stages {
+		out[Stage(s).String()] = l
+	}
+
+	return out
+}
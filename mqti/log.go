@@ -49,6 +49,17 @@ func EnableDebugging(yes bool) {
 	}
 }
 
+// SetLogLevel sets the level logged to stderr, one of debug, info, warn,
+// error, fatal or panic.
+func SetLogLevel(level string) error {
+	l, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	setLogLevelFor(Log, l)
+	return nil
+}
+
 func setupStderrLogging() {
 	Log.Out = os.Stderr
 	setLogLevelFor(Log, logrus.InfoLevel)
@@ -82,6 +93,9 @@ func logMQTTMessage(m *MQTTMessage, level logrus.Level) {
 		"mqtt":     m.MappingConfiguration.MQTT,
 		"influxdb": m.MappingConfiguration.InfluxDB,
 	}
+	if name := m.MappingName(); len(name) > 0 {
+		fields["mapping"] = name
+	}
 
 	switch level {
 	case logrus.InfoLevel:
@@ -1,19 +1,85 @@
 package mqti
 
-import "github.com/spf13/viper"
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
 
 type mQTTMappingConfiguration struct {
-	Topic   string
-	Mungers struct {
+	Topic          string
+	Broker         string
+	QoS            byte   `mapstructure:"qos"`
+	SharedGroup    string `mapstructure:"shared_group"`
+	IgnoreRetained bool   `mapstructure:"ignore_retained"`
+	Timestamp      TimestampConfiguration
+	// TopicRegex narrows Topic to the topics it matches, for what
+	// wildcards can't express, e.g. ^devices/[0-9]+/data$.
+	TopicRegex string `mapstructure:"topic_regex"`
+	// TopicTags names the wildcard levels of Topic, in order, which are
+	// then tags of the message's point.
+	TopicTags []string `mapstructure:"topic_tags"`
+	// Decode lists the encodings to undo, in order, before the payload
+	// is parsed: base64, gzip or zlib.  DecodeMaxSize bounds the size in
+	// bytes of a decompressed payload.
+	Decode        []string
+	DecodeMaxSize int    `mapstructure:"decode_max_size"`
+	PayloadFormat string `mapstructure:"payload_format"`
+	Scalar        ScalarPayloadConfiguration
+	Protobuf      ProtobufPayloadConfiguration
+	CSV           CSVPayloadConfiguration
+	Binary        BinaryPayloadConfiguration
+	// ArrayPath is the gjson path of an array of readings inside the
+	// payload, each becoming a point.  Payloads that are arrays are split
+	// without it.
+	ArrayPath string `mapstructure:"array_path"`
+	// Fields maps field names to the gjson paths of their values in JSON
+	// payloads, for nested ones.
+	Fields map[string]string
+	// Flatten turns nested JSON into fields named by their path, joined
+	// by FlattenSeparator, "_" by default, FlattenMaxDepth levels deep at
+	// most when set.
+	Flatten          bool
+	FlattenSeparator string `mapstructure:"flatten_separator"`
+	FlattenMaxDepth  int    `mapstructure:"flatten_max_depth"`
+	Mungers          struct {
 		Filter FilterMungerConfiguration `mapstructure:"filter"`
+		Exec   ExecMungerConfiguration   `mapstructure:"exec"`
+		Sample SampleMungerConfiguration `mapstructure:"sample"`
 	}
 }
 
 type influxDBMappingConfiguration struct {
-	Database    string
-	Measurement string
-	Tags        map[string]string
-	Mungers     struct {
+	Database string
+	// Bucket is Database's name with InfluxDB 2.x, and Organization
+	// overrides the influxdb section's org for the mapping's writes.
+	Bucket       string
+	Organization string `mapstructure:"org"`
+	// RetentionPolicy is written into with InfluxDB 1.x, rather than the
+	// database's default.
+	RetentionPolicy string `mapstructure:"retention_policy"`
+	Measurement     string
+	Tags            map[string]string
+	Schema          InfluxDBSchemaConfiguration
+	// Rename maps payload keys to the field names they are written as.
+	Rename map[string]string
+	// Coerce maps fields to the type they are converted to, one of
+	// float, integer, boolean or string.
+	Coerce map[string]string
+	// Convert maps fields to the unit conversion applied to them, after
+	// coercion.
+	Convert map[string]ConversionConfiguration
+	// Bounds maps fields to their plausible values, points out of them
+	// being rejected.
+	Bounds map[string]BoundsConfiguration
+	// FieldsInclude and TagsInclude, when set, list the only fields and
+	// tags written, FieldsExclude and TagsExclude those never written, as
+	// globs such as debug_*.
+	FieldsInclude []string `mapstructure:"fields_include"`
+	FieldsExclude []string `mapstructure:"fields_exclude"`
+	TagsInclude   []string `mapstructure:"tags_include"`
+	TagsExclude   []string `mapstructure:"tags_exclude"`
+	Mungers       struct {
 		Tags    TagsMungerConfiguration
 		Geohash GeohashMungerConfiguration
 	}
@@ -30,6 +96,20 @@ type FilterJSONMungerConfiguration struct {
 	Or  []map[string]string
 }
 
+// ExecMungerConfiguration ...
+type ExecMungerConfiguration struct {
+	Command     []string
+	Mode        string
+	Timeout     time.Duration
+	Concurrency int
+}
+
+// SampleMungerConfiguration ...
+type SampleMungerConfiguration struct {
+	Window  time.Duration
+	Samples int
+}
+
 // TagsMungerConfiguration ...
 type TagsMungerConfiguration struct {
 	From []map[string]string
@@ -44,25 +124,76 @@ type GeohashMungerConfiguration struct {
 
 // MappingConfiguration ...
 type MappingConfiguration struct {
-	Name     string
-	MQTT     mQTTMappingConfiguration
-	InfluxDB influxDBMappingConfiguration
+	Name       string
+	Enabled    *bool
+	Output     string
+	Outputs    []string
+	MQTT       mQTTMappingConfiguration
+	InfluxDB   influxDBMappingConfiguration
+	RoutingKey RoutingKeyConfiguration `mapstructure:"routing_key"`
+	Rules      []RuleConfiguration
+}
+
+// enabled is true unless the mapping is switched off with enabled: false,
+// which keeps it in the config without subscribing.
+func (m MappingConfiguration) enabled() bool {
+	return m.Enabled == nil || *m.Enabled
+}
+
+// outputs names the outputs the mapping's points are written to, the
+// influxdb section being "".
+func (m MappingConfiguration) outputs() []string {
+	if len(m.Outputs) > 0 {
+		return m.Outputs
+	}
+	return []string{m.Output}
+}
+
+// label names the mapping in logs, by its topic when it has no name.
+func (m MappingConfiguration) label() string {
+	if len(m.Name) > 0 {
+		return m.Name
+	}
+	return m.MQTT.Topic
+}
+
+// DiscoveryConfiguration ...
+type DiscoveryConfiguration struct {
+	Topic            string
+	MaxSubscriptions int `mapstructure:"max_subscriptions"`
+	// Allow are the topic filters announced topics must fall within, e.g.
+	// devices/+/data; any topic is subscribed unless set.
+	Allow []string
+	// AllowWildcards lets announcements subscribe to filters with + or #,
+	// still within Allow.
+	AllowWildcards bool `mapstructure:"allow_wildcards"`
+	Template       MappingConfiguration
 }
 
 // Config ...
 type Config struct {
-	MQti     mQtiConfiguration
-	MQTT     mQTTConfiguration
-	InfluxDB influxDBConfiguration
-	Mappings []MappingConfiguration
+	MQti mQtiConfiguration
+	// MQTT is the mqtt section as decoded, either the settings of a single
+	// broker or a list of named brokers, see brokers.
+	MQTT      interface{}
+	InfluxDB  influxDBConfiguration
+	Mappings  []MappingConfiguration
+	Discovery DiscoveryConfiguration
+	// Outputs are sinks mappings can select by name instead of the
+	// influxdb section, each with a type and that type's settings.
+	Outputs map[string]map[string]interface{}
+	// Routes pick the outputs of mappings that don't, see
+	// RouteConfiguration.
+	Routes []RouteConfiguration
 }
 
-// GetConfig ...
+// GetConfig decodes the loaded config, failing on keys that don't belong
+// to any setting rather than silently ignoring a typo.
 func GetConfig() (*Config, error) {
 	var err error
 	var c Config
 
-	if err = viper.Unmarshal(&c); err != nil {
+	if err = viper.UnmarshalExact(&c); err != nil {
 		return nil, err
 	}
 
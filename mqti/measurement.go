@@ -0,0 +1,56 @@
+package mqti
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// measurementTemplates caches the parsed templates of measurements, by
+// their text.
+var measurementTemplates sync.Map
+
+// measurementData is what measurement templates are rendered with, the
+// message's data plus the point's tags, e.g.
+// {{.TopicSegment 1}}_{{.Tag "device"}}.
+type measurementData struct {
+	messageTemplateData
+	tags map[string]string
+}
+
+// Tag returns the value of a tag of the point, or an empty string.
+func (d measurementData) Tag(key string) string {
+	return d.tags[key]
+}
+
+func isMeasurementTemplate(name string) bool {
+	return strings.Contains(name, "{{")
+}
+
+// renderMeasurement returns the measurement of the point of m, rendering
+// name when it is a template.
+func renderMeasurement(name string, m *MQTTMessage, tags map[string]string) (string, error) {
+	if !isMeasurementTemplate(name) {
+		return name, nil
+	}
+
+	t, ok := measurementTemplates.Load(name)
+	if !ok {
+		parsed, err := newMessageTemplate("measurement", name)
+		if err != nil {
+			return "", err
+		}
+		t, _ = measurementTemplates.LoadOrStore(name, parsed)
+	}
+
+	var out bytes.Buffer
+	if err := t.(*messageTemplate).Execute(&out, measurementData{messageTemplateData{m}, tags}); err != nil {
+		return "", fmt.Errorf("measurement template: %s", err)
+	}
+	if out.Len() == 0 {
+		return "", fmt.Errorf("measurement template '%s' rendered empty", name)
+	}
+
+	return out.String(), nil
+}
@@ -0,0 +1,177 @@
+package mqti
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const mQTTDefaultMetricsInterval = time.Minute
+
+const (
+	statReceived = iota
+	statSkipped
+	statForwarded
+	statFailed
+	statRejected
+	statCount
+)
+
+// counters of messages through the pipeline, since startup, indexed by
+// stat.
+type counters [statCount]int64
+
+var metrics counters
+
+// mappingMetrics holds the counters of each named mapping.
+var mappingMetrics sync.Map
+
+// count adds a message to stat, overall and for the mapping if named.
+func count(mapping string, stat int) {
+	atomic.AddInt64(&metrics[stat], 1)
+	if mapping != "" {
+		c, _ := mappingMetrics.LoadOrStore(mapping, new(counters))
+		atomic.AddInt64(&c.(*counters)[stat], 1)
+	}
+}
+
+// outputMetrics holds the counters of each output, of which only
+// forwarded and failed are used.
+var outputMetrics sync.Map
+
+// countOutput adds a point to stat for the named output.
+func countOutput(name string, stat int) {
+	if name == "" {
+		name = defaultOutput
+	}
+	c, _ := outputMetrics.LoadOrStore(strings.ToLower(name), new(counters))
+	atomic.AddInt64(&c.(*counters)[stat], 1)
+}
+
+// Metrics is a snapshot of the internal counters, as published to
+// metrics_topic.
+type Metrics struct {
+	Received             int64                     `json:"received"`
+	Skipped              int64                     `json:"skipped"`
+	Forwarded            int64                     `json:"forwarded"`
+	Failed               int64                     `json:"failed"`
+	Rejected             int64                     `json:"rejected"`
+	DynamicSubscriptions int                       `json:"dynamic_subscriptions"`
+	DiscoveryRejected    int64                     `json:"discovery_rejected"`
+	Stages               map[string]stageMetrics   `json:"stages"`
+	Mappings             map[string]MappingMetrics `json:"mappings,omitempty"`
+	Outputs              map[string]OutputMetrics  `json:"outputs,omitempty"`
+}
+
+// MappingMetrics are the counters of one named mapping.
+type MappingMetrics struct {
+	Received  int64 `json:"received"`
+	Skipped   int64 `json:"skipped"`
+	Forwarded int64 `json:"forwarded"`
+	Failed    int64 `json:"failed"`
+	Rejected  int64 `json:"rejected"`
+}
+
+// OutputMetrics are the counters of one output, the points written to it
+// and those it failed to write.
+type OutputMetrics struct {
+	Forwarded int64 `json:"forwarded"`
+	Failed    int64 `json:"failed"`
+}
+
+type stageMetrics struct {
+	Count  int64   `json:"count"`
+	MeanMs float64 `json:"mean_ms"`
+	MaxMs  float64 `json:"max_ms"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (b broker) metricsTopic() string {
+	return b.GetString("metrics_topic")
+}
+
+func (b broker) metricsInterval() time.Duration {
+	if d := b.GetDuration("metrics_interval"); d > 0 {
+		return d
+	}
+	return mQTTDefaultMetricsInterval
+}
+
+// Metrics returns the current value of the internal counters.
+func (s *Subscriber) Metrics() Metrics {
+	m := Metrics{
+		Received:             atomic.LoadInt64(&metrics[statReceived]),
+		Skipped:              atomic.LoadInt64(&metrics[statSkipped]),
+		Forwarded:            atomic.LoadInt64(&metrics[statForwarded]),
+		Failed:               atomic.LoadInt64(&metrics[statFailed]),
+		Rejected:             atomic.LoadInt64(&metrics[statRejected]),
+		DynamicSubscriptions: len(s.DynamicSubscriptions()),
+		DiscoveryRejected:    atomic.LoadInt64(&discoveryRejected),
+		Stages:               make(map[string]stageMetrics, stageCount),
+		Mappings:             make(map[string]MappingMetrics),
+		Outputs:              make(map[string]OutputMetrics),
+	}
+
+	mappingMetrics.Range(func(name, v interface{}) bool {
+		c := v.(*counters)
+		m.Mappings[name.(string)] = MappingMetrics{
+			Received:  atomic.LoadInt64(&c[statReceived]),
+			Skipped:   atomic.LoadInt64(&c[statSkipped]),
+			Forwarded: atomic.LoadInt64(&c[statForwarded]),
+			Failed:    atomic.LoadInt64(&c[statFailed]),
+			Rejected:  atomic.LoadInt64(&c[statRejected]),
+		}
+		return true
+	})
+
+	outputMetrics.Range(func(name, v interface{}) bool {
+		c := v.(*counters)
+		m.Outputs[name.(string)] = OutputMetrics{
+			Forwarded: atomic.LoadInt64(&c[statForwarded]),
+			Failed:    atomic.LoadInt64(&c[statFailed]),
+		}
+		return true
+	})
+
+	for name, l := range StageLatencies() {
+		m.Stages[name] = stageMetrics{l.Count, milliseconds(l.Mean()), milliseconds(l.Max)}
+	}
+
+	return m
+}
+
+// publishMetrics publishes Metrics as JSON to metrics_topic every
+// metrics_interval, until the Subscriber is closed.  Ticks while
+// disconnected are skipped.
+func (s *Subscriber) publishMetrics(topic string) {
+	t := time.NewTicker(s.broker.metricsInterval())
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-s.ctx.Done():
+			return
+		}
+
+		if !s.client.IsConnected() {
+			continue
+		}
+
+		payload, err := json.Marshal(s.Metrics())
+		if err != nil {
+			Log.Error(err)
+			continue
+		}
+
+		token := s.client.Publish(topic, 0, false, payload)
+		if token.Wait() && token.Error() != nil {
+			Log.Warnf("Publishing metrics to %s failed: %s", topic, token.Error())
+		}
+	}
+}
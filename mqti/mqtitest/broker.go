@@ -0,0 +1,64 @@
+// Package mqtitest provides helpers for exercising mqti against a real MQTT
+// broker without any external dependencies.
+package mqtitest
+
+import (
+	"net"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// Broker is an in-process MQTT broker listening on a random local port.
+type Broker struct {
+	*mqtt.Server
+
+	// Host and Port are suitable for the mqtt.host and mqtt.port settings.
+	Host string
+	Port string
+}
+
+// StartBroker starts an in-process broker that accepts every client, and
+// stops it when the test finishes.
+func StartBroker(t testing.TB) *Broker {
+	t.Helper()
+
+	addr, err := freeAddress()
+	if err != nil {
+		t.Fatalf("mqtitest: can't find a free port: %s", err)
+	}
+
+	server := mqtt.New(&mqtt.Options{InlineClient: true})
+	if err = server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatalf("mqtitest: %s", err)
+	}
+
+	if err = server.AddListener(listeners.NewTCP(listeners.Config{ID: "mqtitest", Address: addr})); err != nil {
+		t.Fatalf("mqtitest: %s", err)
+	}
+
+	if err = server.Serve(); err != nil {
+		t.Fatalf("mqtitest: %s", err)
+	}
+
+	t.Cleanup(func() {
+		server.Close()
+	})
+
+	host, port, _ := net.SplitHostPort(addr)
+
+	return &Broker{Server: server, Host: host, Port: port}
+}
+
+// freeAddress returns a loopback address with a port nothing listens on.
+func freeAddress() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+
+	return l.Addr().String(), nil
+}
@@ -4,21 +4,75 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
 	"os"
-	"os/signal"
-	"syscall"
+	"sort"
+	"strings"
 	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
-	"github.com/spf13/viper"
 )
 
 const mQTTDefaultPort string = "1883"
 
+const (
+	mQTTDefaultQoS byte = 0
+	mQTTMaxQoS     byte = 2
+)
+
+const mQTTSubscribeRetryInterval = 5 * time.Second
+
+// mQTTSubackFailure is the SUBACK return code of a refused subscription.
+const mQTTSubackFailure byte = 0x80
+
+const mQTTDefaultReadyTimeout = 30 * time.Second
+
+const (
+	subscribeFailureLog       string = "log"
+	subscribeFailureReconnect string = "reconnect"
+	subscribeFailureFatal     string = "fatal"
+)
+
 // MQTTMessage ...
 type MQTTMessage struct {
 	MQTT.Message
 	MappingConfiguration
+
+	timings    *StageTimings
+	routingKey string
+	// broker is the endpoint of the broker the message arrived from.
+	broker string
+	// received is when the message arrived, the time of its point unless
+	// the payload has one, however long sampling or the startup buffer
+	// hold it.
+	received time.Time
+	// decoded are the fields of a binary payload as typed, which its JSON
+	// re-encoding would round to float64 past 2^53.
+	decoded map[string]interface{}
+}
+
+func newMQTTMessage(msg MQTT.Message, m MappingConfiguration, broker string) *MQTTMessage {
+	return &MQTTMessage{Message: msg, MappingConfiguration: m, timings: &StageTimings{}, broker: broker, received: time.Now()}
+}
+
+// Timings returns the time the message has spent in each pipeline stage.
+func (m MQTTMessage) Timings() StageTimings {
+	if m.timings == nil {
+		return StageTimings{}
+	}
+	return *m.timings
+}
+
+// Mapping returns the mapping whose subscription produced the message.
+func (m MQTTMessage) Mapping() MappingConfiguration {
+	return m.MappingConfiguration
+}
+
+// MappingName returns the name of the mapping that produced the message.
+func (m MQTTMessage) MappingName() string {
+	return m.MappingConfiguration.Name
 }
 
 // PayloadAsString ...
@@ -35,6 +89,42 @@ func (m MQTTMessage) PayloadAsJSON() (map[string]interface{}, error) {
 	return fields, err
 }
 
+// topicTags returns the levels of the topic at the wildcards of the
+// mapping's topic, in order, as tags named by mqtt.topic_tags.  A '#'
+// takes every remaining level, names that are empty or "-" skip a
+// wildcard.
+func (m MQTTMessage) topicTags() map[string]string {
+	names := m.MQTT.TopicTags
+	if len(names) == 0 {
+		return nil
+	}
+
+	filter := strings.Split(m.MQTT.Topic, "/")
+	levels := strings.Split(m.Topic(), "/")
+	tags := make(map[string]string, len(names))
+
+	n := 0
+	for i, f := range filter {
+		if n >= len(names) || i >= len(levels) {
+			break
+		}
+		if f != "+" && f != "#" {
+			continue
+		}
+
+		v := levels[i]
+		if f == "#" {
+			v = strings.Join(levels[i:], "/")
+		}
+		if name := names[n]; name != "" && name != "-" {
+			tags[name] = v
+		}
+		n++
+	}
+
+	return tags
+}
+
 func (m MQTTMessage) jSONFilterShouldSkip(j map[string]interface{}, f []map[string]string, invert bool) bool {
 	skip := false
 
@@ -58,7 +148,7 @@ func (m MQTTMessage) jSONFilterShouldSkip(j map[string]interface{}, f []map[stri
 
 func (m MQTTMessage) shouldSkip() bool {
 	if m.jSONFiltersDefined() {
-		payload, err := m.PayloadAsJSON()
+		payload, err := m.Fields()
 
 		if err == nil {
 			jsonFilters := m.MQTT.Mungers.Filter.JSON
@@ -75,17 +165,59 @@ func (m MQTTMessage) jSONFiltersDefined() bool {
 	return (len(m.MQTT.Mungers.Filter.JSON.And) > 0 || len(m.MQTT.Mungers.Filter.JSON.Or) > 0)
 }
 
-func mQTTConfig() map[string]interface{} {
-	return viper.GetStringMap("mqtt")
+func (b broker) brokerURI() string {
+	return b.hostURI(fmt.Sprintf("%s:%s", b.config()["host"], b.port()))
 }
 
-func mQTTBrokerURI() string {
-	return fmt.Sprintf("%s://%s:%s", mQTTProtocol(), mQTTConfig()["host"], mQTTPort())
+// brokerURIs returns a URI per entry of mqtt.hosts, in hosts_order, or
+// just that of mqtt.host.  paho tries them in turn on every (re)connect, so
+// a clustered broker needs no load balancer in front of it.
+func (b broker) brokerURIs() []string {
+	hosts := b.GetStringSlice("hosts")
+	if len(hosts) == 0 {
+		return []string{b.brokerURI()}
+	}
+
+	uris := make([]string, len(hosts))
+	for i, h := range hosts {
+		if _, _, err := net.SplitHostPort(h); err != nil {
+			h = net.JoinHostPort(h, b.port())
+		}
+		uris[i] = b.hostURI(h)
+	}
+
+	if b.hostsOrder() == hostsOrderRandom {
+		rand.Shuffle(len(uris), func(i, j int) { uris[i], uris[j] = uris[j], uris[i] })
+	}
+
+	return uris
+}
+
+func (b broker) hostURI(hostPort string) string {
+	uri := fmt.Sprintf("%s://%s", b.protocol(), hostPort)
+	if b.webSocket() {
+		uri += b.path()
+	}
+	return uri
+}
+
+const (
+	hostsOrderOrdered string = "ordered"
+	hostsOrderRandom  string = "random"
+)
+
+// hostsOrder is ordered to always prefer the first reachable of hosts,
+// or random to spread instances across them.
+func (b broker) hostsOrder() string {
+	if o := b.GetString("hosts_order"); len(o) > 0 {
+		return o
+	}
+	return hostsOrderOrdered
 }
 
-func mQTTPort() string {
+func (b broker) port() string {
 	var port string
-	if p := mQTTConfig()["port"]; p != nil {
+	if p := b.config()["port"]; p != nil {
 		port = p.(string)
 	} else {
 		port = mQTTDefaultPort
@@ -93,112 +225,315 @@ func mQTTPort() string {
 	return port
 }
 
-func mQTTProtocol() string {
-	if p := mQTTConfig()["protocol"]; p != nil {
+func (b broker) protocol() string {
+	if p := b.config()["protocol"]; p != nil {
 		return p.(string)
 	}
-	if mQTTTLSDefined() {
+	if b.tlsDefined() || len(b.GetString("tls_ca")) > 0 {
 		return "ssl"
 	}
 	return "tcp"
 }
 
-func mQTTClientID() string {
-	return mQTTConfig()["client_id"].(string)
+const (
+	sharedSubscriptionShare string = "share"
+	sharedSubscriptionQueue string = "queue"
+)
+
+// subscription returns the topic filter to subscribe with.  When the
+// mapping has a shared_group the subscription is shared, so the broker
+// load-balances its messages between every mqti instance in the group
+// rather than delivering each to all of them.
+func (c mQTTMappingConfiguration) subscription(b broker) string {
+	if len(c.SharedGroup) == 0 {
+		return c.Topic
+	}
+	if b.sharedSubscription() == sharedSubscriptionQueue {
+		return "$queue/" + c.Topic
+	}
+	return "$share/" + c.SharedGroup + "/" + c.Topic
+}
+
+// sharedSubscription is the broker's shared subscription syntax, share
+// for the standard $share/<group>/<topic> or queue for $queue/<topic>.
+func (b broker) sharedSubscription() string {
+	if s := b.GetString("shared_subscription"); len(s) > 0 {
+		return s
+	}
+	return sharedSubscriptionShare
+}
+
+func validMQTTProtocol(p string) bool {
+	switch p {
+	case "tcp", "ssl", "tls", "ws", "wss":
+		return true
+	}
+	return false
+}
+
+// webSocket is true when connecting over ws or wss, for brokers that
+// only expose MQTT over WebSockets.  TLS settings apply to wss as well.
+func (b broker) webSocket() bool {
+	p := b.protocol()
+	return p == "ws" || p == "wss"
+}
+
+// path is the HTTP path of the WebSocket endpoint, e.g. /mqtt.
+func (b broker) path() string {
+	p := b.GetString("path")
+	if len(p) > 0 && p[0] != '/' {
+		p = "/" + p
+	}
+	return p
+}
+
+func (b broker) clientID() (string, error) {
+	id, _ := b.config()["client_id"].(string)
+	if len(id) == 0 {
+		id = mQTTDefaultClientID
+	}
+	return RenderClientID(id, b.clientIDMaxLen())
 }
 
-func mQTTUsername() string {
-	u := mQTTConfig()["username"]
+// clientIDMaxLen is client_id_max_length, or 0 for no limit.  MQTT 3.1.1
+// only requires brokers to accept 23 characters, but most accept more, so
+// the limit is only checked for brokers that don't.
+func (b broker) clientIDMaxLen() int {
+	return b.GetInt("client_id_max_length")
+}
+
+func (b broker) username() string {
+	if f := b.GetString("username_file"); len(f) > 0 {
+		return readSecret(f)
+	}
+	u := b.config()["username"]
 	if u != nil {
 		return u.(string)
 	}
 	return ""
 }
 
-func mQTTPassword() string {
-	p := mQTTConfig()["password"]
+func (b broker) password() string {
+	if f := b.GetString("password_file"); len(f) > 0 {
+		return readSecret(f)
+	}
+	p := b.config()["password"]
 	if p != nil {
 		return p.(string)
 	}
 	return ""
 }
 
-func mQTTTLSDefined() bool {
-	return mQTTConfig()["tls_cert"] != nil && mQTTConfig()["tls_private_key"] != nil
+func (b broker) tlsDefined() bool {
+	return b.config()["tls_cert"] != nil && b.config()["tls_private_key"] != nil
 }
 
-func mQTTTLSConfig() tls.Config {
-	return *NewTLSConfig(mQTTConfig()["tls_cert"].(string), mQTTConfig()["tls_private_key"].(string))
+// tlsCertificate loads the client certificate of tls_cert and
+// tls_private_key.
+func (b broker) tlsCertificate() (tls.Certificate, error) {
+	return tls.LoadX509KeyPair(b.GetString("tls_cert"), b.GetString("tls_private_key"))
 }
 
-func mQTTCleanSession() bool {
-	return mQTTConfig()["clean_session"] != nil && (mQTTConfig()["clean_session"].(bool) == true)
+func (b broker) tlsCipherSuites() ([]uint16, error) {
+	return CipherSuites(b.GetStringSlice("tls_cipher_suites"))
 }
 
-// MQTTSubscribe ...
-func MQTTSubscribe(incoming chan *MQTTMessage) {
-	var outgoing chan *MQTTMessage
-	outgoing = incoming
+// tlsOptions builds the TLS config from every tls_ setting: a client
+// certificate, a CA bundle for brokers with a private CA, the server name
+// for SNI-routed endpoints, a minimum version and cipher suites.
+func (b broker) tlsOptions() (*tls.Config, error) {
+	c := &tls.Config{}
 
-	cs := make(chan os.Signal, 1)
-	signal.Notify(cs, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-cs
-		Log.Error("signal received, exiting")
-		os.Exit(0)
-	}()
+	if b.tlsDefined() {
+		cert, err := b.tlsCertificate()
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
 
-	opts := MQTT.NewClientOptions()
+	if ca := b.GetString("tls_ca"); len(ca) > 0 {
+		pool, err := NewCertPool(ca)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = pool
+	}
+
+	c.ServerName = b.GetString("tls_server_name")
+	c.InsecureSkipVerify = b.GetBool("tls_insecure_skip_verify")
 
-	opts.ClientID = mQTTClientID()
-	opts.Username = mQTTUsername()
-	opts.Password = mQTTPassword()
-	opts.CleanSession = mQTTCleanSession()
-	opts.TLSConfig = tls.Config{}
+	if v := b.GetString("tls_min_version"); len(v) > 0 {
+		min, err := TLSVersion(v)
+		if err != nil {
+			return nil, err
+		}
+		c.MinVersion = min
+	}
 
-	if mQTTTLSDefined() {
-		opts.TLSConfig = mQTTTLSConfig()
+	cipherSuites, err := b.tlsCipherSuites()
+	if err != nil {
+		return nil, err
+	}
+	if len(cipherSuites) > 0 {
+		c.CipherSuites = cipherSuites
 	}
 
-	opts.AddBroker(mQTTBrokerURI())
+	return c, nil
+}
 
-	opts.OnConnect = func(c MQTT.Client) {
-		var err error
-		var config *Config
+func (b broker) onSubscribeFailure() string {
+	if p := b.config()["on_subscribe_failure"]; p != nil {
+		return p.(string)
+	}
+	return subscribeFailureLog
+}
 
-		config, err = GetConfig()
-		if err != nil {
-			Log.Fatal(err)
-		}
+func validSubscribeFailurePolicy(p string) bool {
+	switch p {
+	case subscribeFailureLog, subscribeFailureReconnect, subscribeFailureFatal:
+		return true
+	}
+	return false
+}
 
-		for _, mapping := range config.Mappings {
-			m := mapping
-			var f MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
-				mQTTMessage := &MQTTMessage{msg, m}
-
-				if mQTTMessage.shouldSkip() {
-					Log.Debugf("No match! %v", mQTTMessage.PayloadAsString())
-				} else {
-					Log.Debugf("Match! %v", mQTTMessage.PayloadAsString())
-					outgoing <- mQTTMessage
-				}
-			}
+func (b broker) readyTimeout() time.Duration {
+	if t := b.GetDuration("ready_timeout"); t > 0 {
+		return t
+	}
+	return mQTTDefaultReadyTimeout
+}
 
-			c.Subscribe(mapping.MQTT.Topic, 0, f)
-		}
+// mQTTWill is the Last Will and Testament the broker publishes should mqti
+// disconnect unexpectedly, it is only set when will_topic is.
+type mQTTWill struct {
+	Topic   string
+	Payload string
+	QoS     byte
+	Retain  bool
+}
+
+func (b broker) will() mQTTWill {
+	return mQTTWill{
+		Topic:   b.GetString("will_topic"),
+		Payload: b.GetString("will_payload"),
+		QoS:     byte(b.GetInt("will_qos")),
+		Retain:  b.GetBool("will_retain"),
 	}
+}
+
+// setTimeouts applies keep_alive, connect_timeout and ping_timeout, leaving
+// paho's defaults for those unset.  Links with high latency, e.g. cellular,
+// need them longer than the defaults.
+func (b broker) setTimeouts(opts *MQTT.ClientOptions) {
+	if d := b.GetDuration("keep_alive"); d > 0 {
+		opts.SetKeepAlive(d)
+	}
+	if d := b.GetDuration("connect_timeout"); d > 0 {
+		opts.SetConnectTimeout(d)
+	}
+	if d := b.GetDuration("ping_timeout"); d > 0 {
+		opts.SetPingTimeout(d)
+	}
+}
+
+// store is where paho keeps inflight QoS 1 and 2 messages, store_dir so
+// they survive a crash, or nil for memory.  The directory is created, and
+// checked to be writable, now rather than failing on the first message.
+func (b broker) store() (MQTT.Store, error) {
+	dir := b.GetString("store_dir")
+	if len(dir) == 0 {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("store_dir: %s", err)
+	}
+	f, err := ioutil.TempFile(dir, ".mqti-")
+	if err != nil {
+		return nil, fmt.Errorf("store_dir %s isn't writable: %s", dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	return MQTT.NewFileStore(dir), nil
+}
+
+// clientOptions are the client options every connection to the broker
+// shares, whether subscribing or only publishing: its client ID, session,
+// protocol version, timeouts, store, TLS, proxy, will and hosts.
+// Credentials and reconnects are up to the caller.
+func (b broker) clientOptions() (*MQTT.ClientOptions, error) {
+	var err error
+
+	opts := MQTT.NewClientOptions()
 
-	opts.OnConnectionLost = func(c MQTT.Client, e error) {
-		Log.Error(e)
+	if opts.ClientID, err = b.clientID(); err != nil {
+		return nil, err
+	}
+	opts.CleanSession = b.cleanSession()
+	if opts.ProtocolVersion, err = b.protocolVersion(); err != nil {
+		return nil, err
+	}
+	b.setTimeouts(opts)
+
+	// Inflight QoS 1 and 2 messages are kept in memory unless store_dir is
+	// set, in which case they survive a crash.
+	store, err := b.store()
+	if err != nil {
+		return nil, err
+	}
+	if store != nil {
+		opts.SetStore(store)
+	}
+
+	if opts.TLSConfig, err = b.tlsOptions(); err != nil {
+		return nil, err
+	}
+
+	if err = b.setProxy(opts); err != nil {
+		return nil, err
 	}
 
-	client := MQTT.NewClient(opts)
+	if w := b.will(); len(w.Topic) > 0 {
+		if w.QoS > mQTTMaxQoS {
+			return nil, fmt.Errorf("invalid will_qos %d, must be one of 0, 1 or 2", w.QoS)
+		}
+		opts.SetWill(w.Topic, w.Payload, w.QoS, w.Retain)
+	}
 
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
+	for _, uri := range b.brokerURIs() {
+		opts.AddBroker(uri)
 	}
 
-	for {
-		time.Sleep(1 * time.Second)
+	return opts, nil
+}
+
+// endpoint identifies the broker by the URIs it is reached at, whatever
+// their order.
+func (b broker) endpoint() string {
+	uris := b.brokerURIs()
+	sort.Strings(uris)
+	return strings.Join(uris, ",")
+}
+
+func (b broker) cleanSession() bool {
+	return b.config()["clean_session"] != nil && (b.config()["clean_session"].(bool) == true)
+}
+
+// protocolVersion maps mqtt.version to paho's protocol version, 0
+// meaning negotiate 3.1.1 falling back to 3.1.
+func (b broker) protocolVersion() (uint, error) {
+	switch v := b.GetString("version"); v {
+	case "":
+		return 0, nil
+	case "3.1":
+		return 3, nil
+	case "3.1.1":
+		return 4, nil
+	case "5", "5.0":
+		return 0, fmt.Errorf("mqtt version %s is not supported by the paho.mqtt.golang client, use 3.1 or 3.1.1", v)
+	default:
+		return 0, fmt.Errorf("invalid mqtt version '%s', must be one of 3.1 or 3.1.1", v)
 	}
 }
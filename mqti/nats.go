@@ -0,0 +1,156 @@
+package mqti
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/spf13/viper"
+)
+
+type natsConfiguration struct {
+	URL string
+	// Subject is a template rendered per message, e.g.
+	// mqtt.{{.TopicSegment 0}}, see messageTemplateData.
+	Subject string
+	// JetStream publishes into the stream bound to the subject and waits
+	// for its ack, for at-least-once delivery.
+	JetStream bool `mapstructure:"jetstream"`
+	// Format is payload, to republish the message as transformed by the
+	// mapping, or point for the point as JSON.
+	Format string
+	// Canonical re-encodes JSON with sorted keys, see Serialize.
+	Canonical     bool
+	Username      string
+	Password      string
+	Token         string
+	Credentials   string
+	TLSCA         string `mapstructure:"tls_ca"`
+	TLSCert       string `mapstructure:"tls_cert"`
+	TLSPrivateKey string `mapstructure:"tls_private_key"`
+}
+
+// natsSink republishes messages to NATS subjects, or a JetStream stream.
+type natsSink struct {
+	conn      *nats.Conn
+	js        nats.JetStreamContext
+	subject   *messageTemplate
+	format    string
+	canonical bool
+}
+
+func newNATSSink(settings map[string]interface{}) (Sink, error) {
+	v := viper.New()
+	if err := v.MergeConfigMap(settings); err != nil {
+		return nil, err
+	}
+
+	var c natsConfiguration
+	if err := v.Unmarshal(&c); err != nil {
+		return nil, err
+	}
+	if c.URL == "" {
+		return nil, fmt.Errorf("url must be set")
+	}
+	if c.Subject == "" {
+		return nil, fmt.Errorf("subject must be set")
+	}
+	if c.Format == "" {
+		c.Format = pointFormatPayload
+	}
+	if !validPointFormat(c.Format) {
+		return nil, fmt.Errorf("invalid format '%s', must be one of payload or point", c.Format)
+	}
+
+	subject, err := newMessageTemplate("subject", c.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []nats.Option{nats.Name("mqti"), nats.MaxReconnects(-1)}
+	switch {
+	case c.Credentials != "":
+		opts = append(opts, nats.UserCredentials(c.Credentials))
+	case c.Token != "":
+		opts = append(opts, nats.Token(c.Token))
+	case c.Username != "":
+		opts = append(opts, nats.UserInfo(c.Username, c.Password))
+	}
+	if c.TLSCA != "" {
+		opts = append(opts, nats.RootCAs(c.TLSCA))
+	}
+	if c.TLSCert != "" {
+		opts = append(opts, nats.ClientCert(c.TLSCert, c.TLSPrivateKey))
+	}
+
+	conn, err := nats.Connect(c.URL, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &natsSink{conn: conn, subject: subject, format: c.Format, canonical: c.Canonical}
+	if c.JetStream {
+		if s.js, err = conn.JetStream(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// natsSubject replaces what NATS doesn't allow in published subjects,
+// slashes of MQTT topics becoming the dots separating its tokens.
+func natsSubject(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/':
+			return '.'
+		case ' ', '\t', '\r', '\n', '*', '>':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// Write publishes points.  Plain NATS publishes are flushed, JetStream
+// ones wait for the stream's ack.
+func (s *natsSink) Write(ctx context.Context, points []*Point) error {
+	for _, p := range points {
+		if p.Message == nil {
+			return fmt.Errorf("nats output needs the message a point was built from")
+		}
+
+		subject, err := s.subject.render(p.Message)
+		if err != nil {
+			return err
+		}
+		subject = natsSubject(subject)
+
+		data, err := p.encode(s.format, s.canonical)
+		if err != nil {
+			return err
+		}
+
+		if s.js != nil {
+			_, err = s.js.Publish(subject, data, nats.Context(ctx))
+		} else {
+			err = s.conn.Publish(subject, data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.js == nil {
+		return s.conn.FlushWithContext(ctx)
+	}
+	return nil
+}
+
+// Close closes the connection.
+func (s *natsSink) Close() error {
+	s.conn.Close()
+	return nil
+}
@@ -0,0 +1,192 @@
+package mqti
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	openTSDBDefaultBatchSize     int = 50
+	openTSDBDefaultFlushInterval     = time.Second
+	openTSDBDefaultTimeout           = 30 * time.Second
+)
+
+type openTSDBConfiguration struct {
+	URL    string
+	Prefix string
+	// Tags maps OpenTSDB tag names to the point tags they take their
+	// values from, only those being sent.  All tags are sent when empty.
+	Tags          map[string]string
+	Username      string
+	Password      string
+	BatchSize     int           `mapstructure:"batch_size"`
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+	Timeout       time.Duration
+}
+
+type openTSDBDataPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     float64           `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// openTSDBSink puts every numeric or boolean field of a point as a data
+// point of <prefix><measurement>.<field> through the HTTP API.  Data
+// points are queued and put in chunks of batch_size, at least every
+// flush_interval.  OpenTSDB needs at least one tag, so points that end up
+// without any are tagged with their topic.
+type openTSDBSink struct {
+	config openTSDBConfiguration
+	client *http.Client
+}
+
+func newOpenTSDBSink(settings map[string]interface{}) (Sink, error) {
+	v := viper.New()
+	if err := v.MergeConfigMap(settings); err != nil {
+		return nil, err
+	}
+
+	var c openTSDBConfiguration
+	if err := v.Unmarshal(&c); err != nil {
+		return nil, err
+	}
+	if c.URL == "" {
+		return nil, fmt.Errorf("url must be set")
+	}
+	c.URL = strings.TrimSuffix(c.URL, "/")
+	if c.BatchSize <= 0 {
+		c.BatchSize = openTSDBDefaultBatchSize
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = openTSDBDefaultFlushInterval
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = openTSDBDefaultTimeout
+	}
+
+	s := &openTSDBSink{config: c, client: &http.Client{Timeout: c.Timeout}}
+
+	return newBatchedSink(s, c.BatchSize, c.FlushInterval), nil
+}
+
+// openTSDBName replaces characters OpenTSDB doesn't allow in metric names
+// and tags by underscores.
+func openTSDBName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '-', r == '_', r == '.', r == '/':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+func (s *openTSDBSink) tags(p *Point) map[string]string {
+	tags := make(map[string]string, len(p.Tags))
+
+	if len(s.config.Tags) == 0 {
+		for k, v := range p.Tags {
+			tags[openTSDBName(k)] = openTSDBName(v)
+		}
+	} else {
+		for name, key := range s.config.Tags {
+			if v, ok := p.Tags[key]; ok {
+				tags[openTSDBName(name)] = openTSDBName(v)
+			}
+		}
+	}
+
+	if len(tags) == 0 && p.Message != nil {
+		tags["topic"] = openTSDBName(p.Message.Topic())
+	}
+
+	return tags
+}
+
+// encode translates p into one data point per field, skipping fields that
+// aren't numbers.
+func (s *openTSDBSink) encode(p *Point) (interface{}, error) {
+	t := p.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	ms := t.UnixNano() / int64(time.Millisecond)
+
+	tags := s.tags(p)
+
+	var dps []openTSDBDataPoint
+	for k, v := range p.Fields {
+		value, ok := numericValue(v)
+		if !ok {
+			continue
+		}
+		metric := openTSDBName(s.config.Prefix + p.Measurement + "." + k)
+		dps = append(dps, openTSDBDataPoint{metric, ms, value, tags})
+	}
+
+	return dps, nil
+}
+
+// writeBatch puts the data points of a batch of points, batch_size at a
+// time.
+func (s *openTSDBSink) writeBatch(ctx context.Context, batch []interface{}) error {
+	var dps []openTSDBDataPoint
+	for _, d := range batch {
+		dps = append(dps, d.([]openTSDBDataPoint)...)
+	}
+
+	for len(dps) > 0 {
+		n := s.config.BatchSize
+		if n > len(dps) {
+			n = len(dps)
+		}
+		if err := s.put(ctx, dps[:n]); err != nil {
+			return err
+		}
+		dps = dps[n:]
+	}
+
+	return nil
+}
+
+func (s *openTSDBSink) put(ctx context.Context, dps []openTSDBDataPoint) error {
+	body, err := json.Marshal(dps)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.config.URL+"/api/put?details", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mqti/"+Version)
+	if s.config.Username != "" {
+		req.SetBasicAuth(s.config.Username, s.config.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("put to %s failed: %s: %s", s.config.URL, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
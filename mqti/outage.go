@@ -0,0 +1,102 @@
+package mqti
+
+import (
+	"sync"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// outage tells a brief connection blip apart from a prolonged outage: once
+// the broker has been unreachable for longer than outage_alert_after, an
+// alert is raised, and cleared again on reconnect.
+type outage struct {
+	mu      sync.Mutex
+	lostAt  time.Time
+	timer   *time.Timer
+	alerted bool
+
+	onAlert   func(since time.Time)
+	onRecover func(lasted time.Duration)
+}
+
+func (b broker) outageAlertAfter() time.Duration {
+	return b.GetDuration("outage_alert_after")
+}
+
+// OnOutage registers f to be called when the broker has been unreachable
+// for longer than outage_alert_after.
+func (s *Subscriber) OnOutage(f func(since time.Time)) {
+	s.outage.mu.Lock()
+	s.outage.onAlert = f
+	s.outage.mu.Unlock()
+}
+
+// OnOutageRecovered registers f to be called when the connection is
+// re-established after an outage was alerted.
+func (s *Subscriber) OnOutageRecovered(f func(lasted time.Duration)) {
+	s.outage.mu.Lock()
+	s.outage.onRecover = f
+	s.outage.mu.Unlock()
+}
+
+func (s *Subscriber) onConnectionLost(c MQTT.Client, err error) {
+	Log.Error(err)
+	s.goroutine(func() { s.connectWithBackoff(c) })
+
+	d := s.broker.outageAlertAfter()
+	if d <= 0 {
+		return
+	}
+
+	o := &s.outage
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.lostAt = time.Now()
+	if o.timer != nil {
+		o.timer.Stop()
+	}
+	o.timer = time.AfterFunc(d, o.alert)
+}
+
+func (o *outage) alert() {
+	o.mu.Lock()
+	o.alerted = true
+	since, f := o.lostAt, o.onAlert
+	o.mu.Unlock()
+
+	Log.Errorf("MQTT broker unreachable since %s", since.Format(time.RFC3339))
+	if f != nil {
+		f(since)
+	}
+}
+
+func (o *outage) stop() {
+	o.mu.Lock()
+	if o.timer != nil {
+		o.timer.Stop()
+	}
+	o.mu.Unlock()
+}
+
+// reset stops any pending alert, and reports recovery if one was raised.
+func (o *outage) reset() {
+	o.mu.Lock()
+	if o.timer != nil {
+		o.timer.Stop()
+		o.timer = nil
+	}
+	alerted, lasted, f := o.alerted, time.Since(o.lostAt), o.onRecover
+	o.alerted = false
+	o.mu.Unlock()
+
+	if !alerted {
+		return
+	}
+
+	Log.Warnf("MQTT broker reachable again after %s", lasted)
+	if f != nil {
+		f(lasted)
+	}
+}
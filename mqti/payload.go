@@ -0,0 +1,393 @@
+package mqti
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor"
+	"github.com/tidwall/gjson"
+	"github.com/vmihailenco/msgpack"
+)
+
+const (
+	payloadFormatBinary    string = "binary"
+	payloadFormatCBOR      string = "cbor"
+	payloadFormatCSV       string = "csv"
+	payloadFormatJSON      string = "json"
+	payloadFormatMsgpack   string = "msgpack"
+	payloadFormatProtobuf  string = "protobuf"
+	payloadFormatScalar    string = "scalar"
+	payloadFormatSparkplug string = "sparkplug"
+	payloadFormatXML       string = "xml"
+)
+
+// Steps of mqtt.decode, undoing encodings of the payload before its
+// format is parsed.
+const (
+	decodeBase64 string = "base64"
+	decodeGzip   string = "gzip"
+	decodeZlib   string = "zlib"
+
+	decodeDefaultMaxSize int = 16 << 20
+)
+
+const scalarDefaultField string = "value"
+
+const flattenDefaultSeparator string = "_"
+
+// ScalarPayloadConfiguration describes a payload that is a single bare value,
+// e.g. 23.5, rather than a JSON document.  With no Type the value is parsed
+// as a float or boolean when possible and kept as a string otherwise.
+type ScalarPayloadConfiguration struct {
+	Type  string
+	Field string
+}
+
+func (c ScalarPayloadConfiguration) field() string {
+	if len(c.Field) > 0 {
+		return c.Field
+	}
+	return scalarDefaultField
+}
+
+func validPayloadFormat(f string) bool {
+	switch f {
+	case "", payloadFormatBinary, payloadFormatCBOR, payloadFormatCSV, payloadFormatJSON, payloadFormatMsgpack, payloadFormatProtobuf, payloadFormatScalar, payloadFormatSparkplug, payloadFormatXML:
+		return true
+	}
+	return false
+}
+
+// Fields decodes the payload into fields according to the mapping's
+// payload_format, which defaults to JSON.  JSON payloads are decoded into
+// their top-level values, or with mqtt.fields into the values found at
+// those paths.
+func (m MQTTMessage) Fields() (map[string]interface{}, error) {
+	switch {
+	case m.MQTT.PayloadFormat == payloadFormatScalar:
+		return m.payloadAsScalar()
+	case len(m.MQTT.Fields) > 0:
+		return m.payloadAtPaths()
+	case m.MQTT.Flatten:
+		fields, err := m.PayloadAsJSON()
+		if err != nil {
+			return nil, err
+		}
+		return m.MQTT.flatten(fields), nil
+	case m.decoded != nil:
+		fields := make(map[string]interface{}, len(m.decoded))
+		for k, v := range m.decoded {
+			fields[k] = v
+		}
+		return fields, nil
+	}
+	return m.PayloadAsJSON()
+}
+
+func validDecodeStep(step string) bool {
+	switch step {
+	case decodeBase64, decodeGzip, decodeZlib:
+		return true
+	}
+	return false
+}
+
+// predecode applies the steps of mqtt.decode to payload, in order, e.g.
+// base64 then gzip for gzipped JSON sent as base64 text.  Payloads that
+// decompress to more than maxSize bytes fail, rather than exhausting
+// memory.
+func predecode(steps []string, maxSize int, payload []byte) ([]byte, error) {
+	if maxSize <= 0 {
+		maxSize = decodeDefaultMaxSize
+	}
+
+	for _, step := range steps {
+		var r io.ReadCloser
+		var err error
+
+		switch step {
+		case decodeBase64:
+			b := make([]byte, base64.StdEncoding.DecodedLen(len(payload)))
+			n, err := base64.StdEncoding.Decode(b, bytes.TrimSpace(payload))
+			if err != nil {
+				return nil, fmt.Errorf("base64: %s", err)
+			}
+			payload = b[:n]
+			continue
+		case decodeGzip:
+			r, err = gzip.NewReader(bytes.NewReader(payload))
+		case decodeZlib:
+			r, err = zlib.NewReader(bytes.NewReader(payload))
+		default:
+			return nil, fmt.Errorf("unknown decode step '%s'", step)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", step, err)
+		}
+
+		payload, err = ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", step, err)
+		}
+		if len(payload) > maxSize {
+			return nil, fmt.Errorf("%s: decompressed payload over %d bytes", step, maxSize)
+		}
+	}
+
+	return payload, nil
+}
+
+// decode re-encodes a MessagePack, CBOR, protobuf, binary or XML payload
+// as JSON, so the message is filtered, transformed and decoded into
+// fields as a JSON one would be.  pb decodes protobuf payloads.  CSV
+// payloads become an array of their lines and Sparkplug B ones of their
+// metrics, each then split into a point.  Binary fields are also kept as
+// typed, for Fields.  The steps of mqtt.decode are applied first.  Messages of other formats are returned as they are.
+func (m *MQTTMessage) decode(pb *protobufDecoder) (*MQTTMessage, error) {
+	if len(m.MQTT.Decode) > 0 {
+		payload, err := predecode(m.MQTT.Decode, m.MQTT.DecodeMaxSize, m.Payload())
+		if err != nil {
+			return nil, fmt.Errorf("decoding payload on %s: %s", m.Topic(), err)
+		}
+		d := *m
+		d.Message = transformedMessage{m.Message, payload}
+		m = &d
+	}
+
+	var v interface{}
+	switch m.MQTT.PayloadFormat {
+	case payloadFormatProtobuf:
+		fields, err := pb.decode(m.Payload())
+		if err != nil {
+			return nil, fmt.Errorf("invalid protobuf payload on %s: %s", m.Topic(), err)
+		}
+		v = fields
+	case payloadFormatXML:
+		fields, err := decodeXML(m.Payload())
+		if err != nil {
+			return nil, fmt.Errorf("invalid XML payload on %s: %s", m.Topic(), err)
+		}
+		v = fields
+	case payloadFormatBinary:
+		fields, err := m.MQTT.Binary.decode(m.Payload())
+		if err != nil {
+			return nil, fmt.Errorf("invalid binary payload on %s: %s", m.Topic(), err)
+		}
+		v = fields
+	case payloadFormatCSV:
+		rows, err := m.MQTT.CSV.decode(m.Payload())
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV payload on %s: %s", m.Topic(), err)
+		}
+		v = rows
+	case payloadFormatSparkplug:
+		metrics, err := m.sparkplugMetrics()
+		if err != nil {
+			return nil, fmt.Errorf("invalid Sparkplug B payload on %s: %s", m.Topic(), err)
+		}
+		v = metrics
+	case payloadFormatMsgpack:
+		if err := msgpack.Unmarshal(m.Payload(), &v); err != nil {
+			return nil, fmt.Errorf("invalid MessagePack payload on %s: %s", m.Topic(), err)
+		}
+	case payloadFormatCBOR:
+		if err := cbor.Unmarshal(m.Payload(), &v); err != nil {
+			return nil, fmt.Errorf("invalid CBOR payload on %s: %s", m.Topic(), err)
+		}
+	default:
+		return m, nil
+	}
+
+	payload, err := json.Marshal(decodedToJSON(v))
+	if err != nil {
+		return nil, fmt.Errorf("%s payload on %s: %s", m.MQTT.PayloadFormat, m.Topic(), err)
+	}
+
+	d := *m
+	d.Message = transformedMessage{m.Message, payload}
+	if m.MQTT.PayloadFormat == payloadFormatBinary {
+		d.decoded = v.(map[string]interface{})
+	}
+
+	return &d, nil
+}
+
+// decodedToJSON makes a decoded MessagePack or CBOR value encodable as
+// JSON: maps may have keys of any type, which are turned into strings,
+// and binary values are kept as strings rather than base64.
+func decodedToJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = decodedToJSON(e)
+		}
+		return m
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = decodedToJSON(e)
+		}
+		return v
+	case []interface{}:
+		for i, e := range v {
+			v[i] = decodedToJSON(e)
+		}
+		return v
+	case []byte:
+		return string(v)
+	}
+	return v
+}
+
+// split returns a message per element when the JSON payload is an array,
+// or has one at mqtt.array_path, e.g. a batch of readings, and m alone
+// otherwise.  Elements are then filtered, transformed and written as
+// messages of their own.
+func (m *MQTTMessage) split() []*MQTTMessage {
+	if m.MQTT.PayloadFormat == payloadFormatScalar {
+		return []*MQTTMessage{m}
+	}
+
+	var r gjson.Result
+	if len(m.MQTT.ArrayPath) > 0 {
+		r = gjson.GetBytes(m.Payload(), m.MQTT.ArrayPath)
+	} else if payload := bytes.TrimSpace(m.Payload()); len(payload) > 0 && payload[0] == '[' {
+		r = gjson.ParseBytes(payload)
+	}
+	if !r.IsArray() {
+		return []*MQTTMessage{m}
+	}
+
+	elements := r.Array()
+	messages := make([]*MQTTMessage, len(elements))
+	for i, e := range elements {
+		em := *m
+		em.Message = transformedMessage{m.Message, []byte(e.Raw)}
+		em.decoded = nil
+		timings := *m.timings
+		em.timings = &timings
+		messages[i] = &em
+	}
+
+	return messages
+}
+
+func (c mQTTMappingConfiguration) flattenSeparator() string {
+	if len(c.FlattenSeparator) > 0 {
+		return c.FlattenSeparator
+	}
+	return flattenDefaultSeparator
+}
+
+// flatten turns nested objects and arrays into fields named by their
+// path, e.g. {"a": {"b": [1]}} into a_b_0.  Values nested deeper than
+// flatten_max_depth, if set, are kept as JSON strings.
+func (c mQTTMappingConfiguration) flatten(fields map[string]interface{}) map[string]interface{} {
+	flat := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		// Sparkplug B metadata becomes tags and the time, not fields.
+		if c.PayloadFormat == payloadFormatSparkplug && k == sparkplugMetadata {
+			flat[k] = v
+			continue
+		}
+		c.flattenValue(flat, k, v, 1)
+	}
+	return flat
+}
+
+func (c mQTTMappingConfiguration) flattenValue(flat map[string]interface{}, name string, v interface{}, depth int) {
+	if c.FlattenMaxDepth > 0 && depth >= c.FlattenMaxDepth {
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			b, _ := json.Marshal(v)
+			flat[name] = string(b)
+			return
+		}
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			c.flattenValue(flat, name+c.flattenSeparator()+k, e, depth+1)
+		}
+	case []interface{}:
+		for i, e := range v {
+			c.flattenValue(flat, name+c.flattenSeparator()+strconv.Itoa(i), e, depth+1)
+		}
+	default:
+		flat[name] = v
+	}
+}
+
+// payloadAtPaths extracts a field from the JSON payload for every path of
+// mqtt.fields, gjson paths such as data.sensors.0.temperature.  Paths
+// that aren't in the payload give no field, objects and arrays are kept
+// as JSON strings.
+func (m MQTTMessage) payloadAtPaths() (map[string]interface{}, error) {
+	payload := m.Payload()
+	if !gjson.ValidBytes(payload) {
+		return nil, fmt.Errorf("invalid JSON payload on %s", m.Topic())
+	}
+
+	fields := make(map[string]interface{}, len(m.MQTT.Fields))
+	for name, path := range m.MQTT.Fields {
+		r := gjson.GetBytes(payload, path)
+		switch r.Type {
+		case gjson.Null:
+			continue
+		case gjson.Number:
+			fields[name] = r.Num
+		case gjson.String:
+			fields[name] = r.Str
+		case gjson.True, gjson.False:
+			fields[name] = r.Bool()
+		default:
+			fields[name] = r.Raw
+		}
+	}
+
+	return fields, nil
+}
+
+func (m MQTTMessage) payloadAsScalar() (map[string]interface{}, error) {
+	c := m.MQTT.Scalar
+	raw := strings.TrimSpace(m.PayloadAsString())
+
+	v, err := parseScalar(raw, c.Type)
+	if err != nil {
+		return nil, fmt.Errorf("scalar payload '%s' on %s: %s", raw, m.Topic(), err)
+	}
+
+	return map[string]interface{}{c.field(): v}, nil
+}
+
+func parseScalar(raw, t string) (interface{}, error) {
+	switch t {
+	case fieldTypeFloat:
+		return strconv.ParseFloat(raw, 64)
+	case fieldTypeInteger:
+		return strconv.ParseInt(raw, 10, 64)
+	case fieldTypeBoolean:
+		return strconv.ParseBool(raw)
+	case fieldTypeString:
+		return raw, nil
+	case "":
+		if f, err := strconv.ParseFloat(raw, 64); err == nil {
+			return f, nil
+		}
+		if b, err := strconv.ParseBool(raw); err == nil {
+			return b, nil
+		}
+		return raw, nil
+	}
+	return nil, fmt.Errorf("unknown scalar type '%s'", t)
+}
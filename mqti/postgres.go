@@ -0,0 +1,189 @@
+package mqti
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/spf13/viper"
+)
+
+const (
+	postgresDefaultTable         string = "mqti"
+	postgresDefaultBatchSize     int    = 100
+	postgresDefaultFlushInterval        = time.Second
+
+	// postgresMaxParameters is the most placeholders one statement can
+	// have, larger batches are sent with COPY instead.
+	postgresMaxParameters int = 65535
+)
+
+type postgresConfiguration struct {
+	DSN   string
+	Table string
+	// Columns maps column names to what they hold, see pointColumns.
+	Columns       map[string]string
+	BatchSize     int           `mapstructure:"batch_size"`
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+}
+
+// postgresSink writes points into a PostgreSQL table, typically a
+// TimescaleDB hypertable, which must already exist.  Points are batched
+// into multi-row INSERTs of batch_size rows, flushed at least every
+// flush_interval.
+type postgresSink struct {
+	pointColumns
+	db     *sql.DB
+	schema string
+	table  string
+	config postgresConfiguration
+}
+
+func newPostgresSink(settings map[string]interface{}) (Sink, error) {
+	v := viper.New()
+	if err := v.MergeConfigMap(settings); err != nil {
+		return nil, err
+	}
+
+	var c postgresConfiguration
+	if err := v.Unmarshal(&c); err != nil {
+		return nil, err
+	}
+	if c.DSN == "" {
+		return nil, fmt.Errorf("dsn must be set")
+	}
+	if c.Table == "" {
+		c.Table = postgresDefaultTable
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = postgresDefaultBatchSize
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = postgresDefaultFlushInterval
+	}
+
+	columns, err := newPointColumns(c.Columns)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &postgresSink{pointColumns: columns, config: c}
+
+	s.table = c.Table
+	if i := strings.Index(c.Table, "."); i >= 0 {
+		s.schema, s.table = c.Table[:i], c.Table[i+1:]
+	}
+
+	db, err := sql.Open("postgres", c.DSN)
+	if err != nil {
+		return nil, err
+	}
+	s.db = db
+
+	return newBatchedSink(s, c.BatchSize, c.FlushInterval), nil
+}
+
+func (s *postgresSink) encode(p *Point) (interface{}, error) {
+	return s.row(p)
+}
+
+// writeBatch writes a batch of rows with one statement.
+func (s *postgresSink) writeBatch(ctx context.Context, batch []interface{}) error {
+	rows := make([][]interface{}, len(batch))
+	for i, row := range batch {
+		rows[i] = row.([]interface{})
+	}
+
+	if len(rows)*len(s.columns) > postgresMaxParameters {
+		return s.copy(ctx, rows)
+	}
+	return s.insert(ctx, rows)
+}
+
+func (s *postgresSink) quotedTable() string {
+	if s.schema != "" {
+		return pq.QuoteIdentifier(s.schema) + "." + pq.QuoteIdentifier(s.table)
+	}
+	return pq.QuoteIdentifier(s.table)
+}
+
+// insert writes rows with a single multi-row INSERT.
+func (s *postgresSink) insert(ctx context.Context, rows [][]interface{}) error {
+	columns := make([]string, len(s.columns))
+	for i, c := range s.columns {
+		columns[i] = pq.QuoteIdentifier(c)
+	}
+
+	var query strings.Builder
+	fmt.Fprintf(&query, "INSERT INTO %s (%s) VALUES ", s.quotedTable(), strings.Join(columns, ", "))
+
+	args := make([]interface{}, 0, len(rows)*len(s.columns))
+	for i, row := range rows {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		query.WriteString("(")
+		for j := range row {
+			if j > 0 {
+				query.WriteString(", ")
+			}
+			fmt.Fprintf(&query, "$%d", len(args)+j+1)
+		}
+		query.WriteString(")")
+		args = append(args, row...)
+	}
+
+	_, err := s.db.ExecContext(ctx, query.String(), args...)
+	return err
+}
+
+// copy writes rows with COPY, for batches with more values than an INSERT
+// can take.
+func (s *postgresSink) copy(ctx context.Context, rows [][]interface{}) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	query := pq.CopyIn(s.table, s.columns...)
+	if s.schema != "" {
+		query = pq.CopyInSchema(s.schema, s.table, s.columns...)
+	}
+
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, row := range rows {
+		if _, err = stmt.Exec(row...); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if _, err = stmt.Exec(); err != nil {
+		stmt.Close()
+		tx.Rollback()
+		return err
+	}
+	if err = stmt.Close(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *postgresSink) ready(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *postgresSink) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,226 @@
+package mqti
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/spf13/viper"
+)
+
+const prometheusDefaultTimeout = 30 * time.Second
+
+type prometheusConfiguration struct {
+	URL         string
+	Username    string
+	Password    string
+	BearerToken string `mapstructure:"bearer_token"`
+	Headers     map[string]string
+	Timeout     time.Duration
+}
+
+// prometheusSink writes points with the Prometheus remote-write protocol,
+// for Mimir, Thanos, VictoriaMetrics and the like.  Every numeric or
+// boolean field becomes a sample of <measurement>_<field>, labelled with
+// the point's tags; string fields are dropped.
+type prometheusSink struct {
+	config prometheusConfiguration
+	client *http.Client
+}
+
+func newPrometheusSink(settings map[string]interface{}) (Sink, error) {
+	v := viper.New()
+	if err := v.MergeConfigMap(settings); err != nil {
+		return nil, err
+	}
+
+	var c prometheusConfiguration
+	if err := v.Unmarshal(&c); err != nil {
+		return nil, err
+	}
+	if c.URL == "" {
+		return nil, fmt.Errorf("url must be set")
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = prometheusDefaultTimeout
+	}
+
+	return &prometheusSink{config: c, client: &http.Client{Timeout: c.Timeout}}, nil
+}
+
+type prometheusLabel struct {
+	name  string
+	value string
+}
+
+type prometheusSeries struct {
+	labels    []prometheusLabel
+	value     float64
+	timestamp int64
+}
+
+// prometheusSeriesOf translates p into one series per field, skipping
+// fields that aren't numbers.
+func prometheusSeriesOf(p *Point) []prometheusSeries {
+	t := p.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	ms := t.UnixNano() / int64(time.Millisecond)
+
+	tags := make([]prometheusLabel, 0, len(p.Tags)+1)
+	for k, v := range p.Tags {
+		tags = append(tags, prometheusLabel{prometheusName(k, false), v})
+	}
+
+	var series []prometheusSeries
+	for k, v := range p.Fields {
+		value, ok := numericValue(v)
+		if !ok {
+			continue
+		}
+
+		labels := append([]prometheusLabel{{"__name__", prometheusName(p.Measurement+"_"+k, true)}}, tags...)
+		sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+
+		series = append(series, prometheusSeries{labels, value, ms})
+	}
+
+	return series
+}
+
+// numericValue returns field values as numbers, booleans as 1 and 0, and
+// false for anything else.
+func numericValue(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// prometheusName replaces characters Prometheus doesn't allow in metric
+// names, or with metric false in label names, by underscores.
+func prometheusName(s string, metric bool) string {
+	if len(s) > 0 && s[0] >= '0' && s[0] <= '9' {
+		s = "_" + s
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+			return r
+		case r >= '0' && r <= '9':
+			return r
+		case r == ':' && metric:
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// Write sends points as a single remote-write request.
+func (s *prometheusSink) Write(ctx context.Context, points []*Point) error {
+	var series []prometheusSeries
+	for _, p := range points {
+		series = append(series, prometheusSeriesOf(p)...)
+	}
+	if len(series) == 0 {
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.config.URL, bytes.NewReader(snappy.Encode(nil, encodeWriteRequest(series))))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "mqti/"+Version)
+	for k, v := range s.config.Headers {
+		req.Header.Set(k, v)
+	}
+	if s.config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.config.BearerToken)
+	} else if s.config.Username != "" {
+		req.SetBasicAuth(s.config.Username, s.config.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("remote write to %s failed: %s: %s", s.config.URL, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// encodeWriteRequest encodes series as a prometheus.WriteRequest protobuf
+// message.  It is small enough to not be worth the generated code.
+func encodeWriteRequest(series []prometheusSeries) []byte {
+	var b []byte
+	for _, s := range series {
+		var ts []byte
+		for _, l := range s.labels {
+			var label []byte
+			label = protoBytes(label, 1, []byte(l.name))
+			label = protoBytes(label, 2, []byte(l.value))
+			ts = protoBytes(ts, 1, label)
+		}
+
+		var sample []byte
+		sample = protoDouble(sample, 1, s.value)
+		sample = protoVarint(sample, 2, uint64(s.timestamp))
+		ts = protoBytes(ts, 2, sample)
+
+		b = protoBytes(b, 1, ts)
+	}
+	return b
+}
+
+func protoBytes(b []byte, field int, v []byte) []byte {
+	b = appendUvarint(b, uint64(field<<3|2))
+	b = appendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func protoDouble(b []byte, field int, v float64) []byte {
+	b = appendUvarint(b, uint64(field<<3|1))
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+	return append(b, buf[:]...)
+}
+
+func protoVarint(b []byte, field int, v uint64) []byte {
+	b = appendUvarint(b, uint64(field<<3))
+	return appendUvarint(b, v)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
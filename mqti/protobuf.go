@@ -0,0 +1,123 @@
+package mqti
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// ProtobufPayloadConfiguration describes protobuf payloads: Descriptor is
+// a FileDescriptorSet as written by protoc --descriptor_set_out
+// --include_imports, and Message the full name of the payload's type in
+// it, e.g. telemetry.v1.Reading.
+type ProtobufPayloadConfiguration struct {
+	Descriptor string
+	Message    string
+}
+
+// protobufDecoder decodes payloads of one message type, loaded from a
+// descriptor file, so new schemas need no rebuild of mqti.
+type protobufDecoder struct {
+	message protoreflect.MessageDescriptor
+}
+
+func newProtobufDecoder(c ProtobufPayloadConfiguration) (*protobufDecoder, error) {
+	if c.Descriptor == "" || c.Message == "" {
+		return nil, fmt.Errorf("protobuf descriptor and message must be set")
+	}
+
+	b, err := ioutil.ReadFile(c.Descriptor)
+	if err != nil {
+		return nil, err
+	}
+
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("%s: %s", c.Descriptor, err)
+	}
+
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", c.Descriptor, err)
+	}
+
+	d, err := files.FindDescriptorByName(protoreflect.FullName(c.Message))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %s", c.Descriptor, c.Message, err)
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s: %s is not a message", c.Descriptor, c.Message)
+	}
+
+	return &protobufDecoder{md}, nil
+}
+
+// decode unmarshals payload into fields named as in the .proto file.
+func (d *protobufDecoder) decode(payload []byte) (map[string]interface{}, error) {
+	m := dynamicpb.NewMessage(d.message)
+	if err := proto.Unmarshal(payload, m); err != nil {
+		return nil, err
+	}
+	return protobufMessage(m), nil
+}
+
+// protobufMessage returns the fields of m.  Fields without presence, as
+// proto3 scalars are, are kept when zero, since a reading of 0 is still a
+// reading; unset optional, oneof and message fields and empty repeated
+// ones are left out.
+func protobufMessage(m protoreflect.Message) map[string]interface{} {
+	fds := m.Descriptor().Fields()
+	fields := make(map[string]interface{}, fds.Len())
+
+	for i := 0; i < fds.Len(); i++ {
+		fd := fds.Get(i)
+		if (fd.HasPresence() || fd.IsList() || fd.IsMap()) && !m.Has(fd) {
+			continue
+		}
+
+		v := m.Get(fd)
+		switch {
+		case fd.IsList():
+			l := v.List()
+			values := make([]interface{}, l.Len())
+			for j := range values {
+				values[j] = protobufValue(fd, l.Get(j))
+			}
+			fields[string(fd.Name())] = values
+		case fd.IsMap():
+			values := make(map[string]interface{}, v.Map().Len())
+			v.Map().Range(func(k protoreflect.MapKey, e protoreflect.Value) bool {
+				values[k.String()] = protobufValue(fd.MapValue(), e)
+				return true
+			})
+			fields[string(fd.Name())] = values
+		default:
+			fields[string(fd.Name())] = protobufValue(fd, v)
+		}
+	}
+
+	return fields
+}
+
+// protobufValue returns a single value of fd: nested messages as maps,
+// enums by name and bytes as strings.
+func protobufValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return protobufMessage(v.Message())
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+		return int64(v.Enum())
+	case protoreflect.BytesKind:
+		return string(v.Bytes())
+	}
+	return v.Interface()
+}
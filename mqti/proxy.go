@@ -0,0 +1,174 @@
+package mqti
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"golang.org/x/net/proxy"
+)
+
+// proxyURL is mqtt.proxy_url, an http:// (CONNECT) or socks5:// proxy for
+// networks without direct egress.  When unset, HTTPS_PROXY and NO_PROXY
+// are honoured.
+func (b broker) proxyURL() (*url.URL, error) {
+	p := b.GetString("proxy_url")
+	if len(p) == 0 {
+		return nil, nil
+	}
+
+	u, err := url.Parse(p)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy_url: %s", err)
+	}
+	switch u.Scheme {
+	case "http", "socks5":
+		return u, nil
+	}
+	return nil, fmt.Errorf("invalid proxy_url '%s', must be an http:// or socks5:// URL", p)
+}
+
+// proxyFor returns the proxy to reach host through, or nil to connect
+// directly.
+func (b broker) proxyFor(host string) (*url.URL, error) {
+	if u, err := b.proxyURL(); u != nil || err != nil {
+		return u, err
+	}
+	return http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: "https", Host: host}})
+}
+
+// setProxy routes connections through the configured proxy.  WebSocket
+// connections already honour HTTPS_PROXY, so only proxy_url is applied to
+// them; tcp and ssl connections are dialed by openConnection.
+func (b broker) setProxy(opts *MQTT.ClientOptions) error {
+	u, err := b.proxyURL()
+	if err != nil {
+		return err
+	}
+
+	if b.webSocket() {
+		if u != nil {
+			opts.SetWebsocketOptions(&MQTT.WebsocketOptions{Proxy: http.ProxyURL(u)})
+		}
+		return nil
+	}
+
+	if u != nil {
+		opts.SetCustomOpenConnectionFn(b.openConnection)
+		return nil
+	}
+
+	// Only dial through HTTPS_PROXY for hosts NO_PROXY doesn't exempt.
+	for _, raw := range b.brokerURIs() {
+		uri, err := url.Parse(raw)
+		if err != nil {
+			return err
+		}
+		p, err := b.proxyFor(uri.Host)
+		if err != nil {
+			return err
+		}
+		if p != nil {
+			opts.SetCustomOpenConnectionFn(b.openConnection)
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// openConnection dials the broker through its proxy, if any, then starts
+// TLS for the ssl and tls protocols.
+func (b broker) openConnection(uri *url.URL, opts MQTT.ClientOptions) (net.Conn, error) {
+	p, err := b.proxyFor(uri.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: opts.ConnectTimeout}
+
+	var conn net.Conn
+	switch {
+	case p == nil:
+		conn, err = dialer.Dial("tcp", uri.Host)
+	case p.Scheme == "socks5":
+		var d proxy.Dialer
+		if d, err = proxy.FromURL(p, dialer); err == nil {
+			conn, err = d.Dial("tcp", uri.Host)
+		}
+	default:
+		conn, err = httpConnect(dialer, p, uri.Host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch uri.Scheme {
+	case "ssl", "tls":
+		config := opts.TLSConfig
+		if config == nil || config.ServerName == "" {
+			// Without a ServerName, tls.Client can verify neither the
+			// certificate's name nor send SNI.
+			if config == nil {
+				config = &tls.Config{}
+			} else {
+				config = config.Clone()
+			}
+			config.ServerName = uri.Hostname()
+		}
+		tlsConn := tls.Client(conn, config)
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+
+	return conn, nil
+}
+
+// httpConnect opens a tunnel to addr through an HTTP proxy.
+func httpConnect(dialer *net.Dialer, p *url.URL, addr string) (net.Conn, error) {
+	conn, err := dialer.Dial("tcp", p.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if p.User != nil {
+		password, _ := p.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(p.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// The broker doesn't speak until the client does, so nothing past the
+	// response is buffered.
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", p.Host, addr, resp.Status)
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,194 @@
+package mqti
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	InfluxDBClient "github.com/influxdata/influxdb/client"
+	"github.com/spf13/viper"
+)
+
+const questDBDefaultTimeout = 10 * time.Second
+
+type questDBConfiguration struct {
+	// URL is tcp://host:9009 to stream lines over TCP, or
+	// http://host:9000 to post them to /write.
+	URL      string
+	Username string
+	Password string
+	Token    string
+	// Precision of timestamps sent over HTTP.  QuestDB only takes
+	// nanoseconds over TCP.
+	Precision string
+	Timeout   time.Duration
+}
+
+// questDBSink writes points with the InfluxDB line protocol to QuestDB,
+// which creates a table per measurement.  Points without a time get
+// QuestDB's, and the database of a point is ignored.
+type questDBSink struct {
+	config    questDBConfiguration
+	url       *url.URL
+	precision string
+	client    *http.Client
+
+	mu   sync.Mutex
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+func newQuestDBSink(settings map[string]interface{}) (Sink, error) {
+	v := viper.New()
+	if err := v.MergeConfigMap(settings); err != nil {
+		return nil, err
+	}
+
+	var c questDBConfiguration
+	if err := v.Unmarshal(&c); err != nil {
+		return nil, err
+	}
+	if c.URL == "" {
+		return nil, fmt.Errorf("url must be set")
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = questDBDefaultTimeout
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &questDBSink{config: c, url: u, precision: c.Precision}
+	if s.precision == "" {
+		s.precision = influxDBDefaultPrecision
+	}
+	if !validInfluxDBPrecision(s.precision) {
+		return nil, fmt.Errorf("invalid precision '%s', must be one of ns, us, ms or s", c.Precision)
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		if s.precision != influxDBDefaultPrecision {
+			return nil, fmt.Errorf("precision must be ns over tcp")
+		}
+	case "http", "https":
+		s.client = &http.Client{Timeout: c.Timeout}
+	default:
+		return nil, fmt.Errorf("invalid url '%s', must be tcp://, http:// or https://", c.URL)
+	}
+
+	return s, nil
+}
+
+// Write sends points as one batch of lines.
+func (s *questDBSink) Write(ctx context.Context, points []*Point) error {
+	var lines strings.Builder
+	for _, p := range points {
+		line, err := lineProtocol(InfluxDBClient.Point{
+			Measurement: p.Measurement,
+			Tags:        p.Tags,
+			Fields:      p.Fields,
+			Time:        p.Time,
+		}, s.precision)
+		if err != nil {
+			return err
+		}
+		lines.WriteString(line)
+		lines.WriteByte('\n')
+	}
+
+	if s.client != nil {
+		return s.post(ctx, lines.String())
+	}
+	return s.send(lines.String())
+}
+
+// send writes lines over the TCP connection, dialling it first when there
+// is none.  QuestDB doesn't acknowledge lines over TCP, it closes the
+// connection on the first bad one, so a failed write drops the connection
+// for the next Write to dial again.
+func (s *questDBSink) send(lines string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.url.Host, s.config.Timeout)
+		if err != nil {
+			return err
+		}
+		s.conn, s.w = conn, bufio.NewWriter(conn)
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(s.config.Timeout))
+	_, err := s.w.WriteString(lines)
+	if err == nil {
+		err = s.w.Flush()
+	}
+	if err != nil {
+		s.conn.Close()
+		s.conn, s.w = nil, nil
+	}
+
+	return err
+}
+
+// post writes lines to the /write endpoint, which, unlike TCP, reports
+// lines it rejects.
+func (s *questDBSink) post(ctx context.Context, lines string) error {
+	u := *s.url
+	u.Path = strings.TrimRight(u.Path, "/") + "/write"
+	// QuestDB says u for microseconds, like the models package.
+	precision := s.precision
+	if precision == "us" {
+		precision = "u"
+	}
+	u.RawQuery = url.Values{"precision": {precision}}.Encode()
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), strings.NewReader(lines))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", "mqti/"+Version)
+	if s.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.config.Token)
+	} else if s.config.Username != "" {
+		req.SetBasicAuth(s.config.Username, s.config.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("writing to %s failed: %s: %s", s.config.URL, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// Close closes the TCP connection, if there is one.
+func (s *questDBSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn, s.w = nil, nil
+	return err
+}
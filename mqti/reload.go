@@ -0,0 +1,86 @@
+package mqti
+
+import (
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// configMu serializes reloads, from SIGHUP, the watchers and the secrets
+// refresh, as Resubscribe mustn't run concurrently.
+var configMu sync.Mutex
+
+// reloadConfig re-reads the config and applies its outputs, routes and
+// mappings to every subscriber.  A config that fails validation is not
+// applied.  Broker settings other than credentials, the list of brokers
+// and the influxdb section only change on restart.
+func reloadConfig(subscribers []*Subscriber) {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	if err := ReadConfig(); err != nil {
+		Log.Errorf("Reloading config failed: %s", err)
+		return
+	}
+
+	applyConfig(subscribers)
+}
+
+func applyConfig(subscribers []*Subscriber) {
+	for _, p := range Validate() {
+		if p.Severity == SeverityError {
+			Log.Errorf("Not reloading config, %s", p)
+			return
+		}
+	}
+
+	config, err := GetConfig()
+	if err != nil {
+		Log.Errorf("Reloading config failed: %s", err)
+		return
+	}
+
+	if err = reloadSinks(config); err != nil {
+		Log.Errorf("Not reloading config, %s", err)
+		return
+	}
+
+	for _, s := range subscribers {
+		if err = s.Resubscribe(config); err != nil {
+			Log.Errorf("Reloading config on MQTT broker %s failed: %s", s.broker, err)
+		}
+	}
+
+	Log.Info("Config reloaded")
+}
+
+// watchConfig reloads the config whenever the file changes, when
+// mqti.watch_config is set.  A remote config is always watched.
+func watchConfig(subscribers []*Subscriber) {
+	if remote != nil {
+		go watchRemoteConfig(subscribers)
+		return
+	}
+
+	if !viper.GetBool("mqti.watch_config") {
+		return
+	}
+
+	if configDir != "" {
+		go watchConfigDir(subscribers)
+		return
+	}
+
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		Log.Infof("Config %s changed, reloading", e.Name)
+		configMu.Lock()
+		defer configMu.Unlock()
+		if err := expandConfig(); err != nil {
+			Log.Errorf("Reloading config failed: %s", err)
+			return
+		}
+		applyConfig(subscribers)
+	})
+	viper.WatchConfig()
+}
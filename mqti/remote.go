@@ -0,0 +1,95 @@
+package mqti
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+	// Registers the etcd and Consul providers with viper.
+	_ "github.com/spf13/viper/remote"
+)
+
+// remoteProvider is a config kept in etcd or Consul KV, for fleets of
+// gateways managed centrally.
+type remoteProvider struct {
+	provider string
+	endpoint string
+	path     string
+}
+
+func (r *remoteProvider) Provider() string      { return r.provider }
+func (r *remoteProvider) Endpoint() string      { return r.endpoint }
+func (r *remoteProvider) Path() string          { return r.path }
+func (r *remoteProvider) SecretKeyring() string { return "" }
+
+func (r *remoteProvider) String() string {
+	return fmt.Sprintf("%s %s%s", r.provider, r.endpoint, r.path)
+}
+
+var remote *remoteProvider
+
+// SetRemoteConfig makes ReadConfig load the config from the key path of an
+// etcd or Consul endpoint rather than from a file.  The value is YAML
+// unless the key ends in another extension viper knows, e.g. .json.
+func SetRemoteConfig(provider, endpoint, path string) error {
+	supported := false
+	for _, p := range viper.SupportedRemoteProviders {
+		if p == provider {
+			supported = true
+		}
+	}
+	if !supported {
+		return fmt.Errorf("unsupported remote config provider '%s', must be one of %s", provider, strings.Join(viper.SupportedRemoteProviders, ", "))
+	}
+
+	configType := strings.TrimPrefix(filepath.Ext(path), ".")
+	if configType == "" {
+		configType = "yaml"
+	}
+	viper.SetConfigType(configType)
+
+	remote = &remoteProvider{provider: provider, endpoint: endpoint, path: path}
+	return nil
+}
+
+func readRemoteConfig() error {
+	r, err := viper.RemoteConfig.Get(remote)
+	if err != nil {
+		return fmt.Errorf("reading config from %s: %s", remote, err)
+	}
+	return viper.ReadConfig(r)
+}
+
+// watchRemoteConfig applies the remote config to every subscriber whenever
+// its key changes.
+func watchRemoteConfig(subscribers []*Subscriber) {
+	responses, _ := viper.RemoteConfig.WatchChannel(remote)
+
+	for r := range responses {
+		if r.Error != nil {
+			Log.Errorf("Watching config at %s failed: %s", remote, r.Error)
+			continue
+		}
+
+		Log.Infof("Config at %s changed, reloading", remote)
+		reloadRemoteConfig(subscribers, r.Value)
+	}
+}
+
+// reloadRemoteConfig applies the remote config value to every subscriber.
+func reloadRemoteConfig(subscribers []*Subscriber, value []byte) {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	if err := viper.ReadConfig(bytes.NewReader(value)); err != nil {
+		Log.Errorf("Reloading config failed: %s", err)
+		return
+	}
+	if err := expandConfig(); err != nil {
+		Log.Errorf("Reloading config failed: %s", err)
+		return
+	}
+	applyConfig(subscribers)
+}
@@ -0,0 +1,154 @@
+package mqti
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+)
+
+// republishKeys are the settings of an mqtt output that aren't broker ones.
+var republishKeys = map[string]bool{"topic": true, "qos": true, "retain": true, "format": true, "canonical": true}
+
+type republishConfiguration struct {
+	// Topic is a template rendered per message, e.g.
+	// bridged/{{.Topic}}, see messageTemplateData.
+	Topic  string
+	QoS    byte `mapstructure:"qos"`
+	Retain bool
+	// Format is payload, to republish the message as transformed by the
+	// mapping, or point for the point as JSON.
+	Format string
+	// Canonical re-encodes JSON with sorted keys, see Serialize.
+	Canonical bool
+}
+
+// republishSink publishes messages back to MQTT on a rewritten topic,
+// usually on another broker, bridging the topics mappings match.  The
+// broker is set up by the same settings as those of the mqtt section.
+type republishSink struct {
+	config   republishConfiguration
+	topic    *messageTemplate
+	client   MQTT.Client
+	endpoint string
+}
+
+func newRepublishSink(settings map[string]interface{}) (Sink, error) {
+	brokerSettings := make(map[string]interface{}, len(settings))
+	sinkSettings := make(map[string]interface{}, len(republishKeys))
+	for k, v := range settings {
+		if republishKeys[strings.ToLower(k)] {
+			sinkSettings[k] = v
+		} else {
+			brokerSettings[k] = v
+		}
+	}
+
+	v := viper.New()
+	if err := v.MergeConfigMap(sinkSettings); err != nil {
+		return nil, err
+	}
+
+	var c republishConfiguration
+	if err := v.Unmarshal(&c); err != nil {
+		return nil, err
+	}
+	if c.Topic == "" {
+		return nil, fmt.Errorf("topic must be set")
+	}
+	if c.QoS > mQTTMaxQoS {
+		return nil, fmt.Errorf("invalid qos %d, must be one of 0, 1 or 2", c.QoS)
+	}
+	if c.Format == "" {
+		c.Format = pointFormatPayload
+	}
+	if !validPointFormat(c.Format) {
+		return nil, fmt.Errorf("invalid format '%s', must be one of payload or point", c.Format)
+	}
+
+	topic, err := newMessageTemplate("topic", c.Topic)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = checkBrokerKeys(brokerSettings); err != nil {
+		return nil, err
+	}
+	bv := viper.New()
+	if err = bv.MergeConfigMap(brokerSettings); err != nil {
+		return nil, err
+	}
+	b := broker{Viper: bv, Name: bv.GetString("name")}
+
+	opts, err := b.publisherOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	client := MQTT.NewClient(opts)
+	if t := client.Connect(); t.Wait() && t.Error() != nil {
+		return nil, t.Error()
+	}
+
+	return &republishSink{config: c, topic: topic, client: client, endpoint: b.endpoint()}, nil
+}
+
+// publisherOptions are the client options of a broker only published to,
+// which paho reconnects on its own as there are no subscriptions to
+// restore.
+func (b broker) publisherOptions() (*MQTT.ClientOptions, error) {
+	opts, err := b.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	opts.Username = b.username()
+	opts.Password = b.password()
+	opts.AutoReconnect = true
+
+	return opts, nil
+}
+
+// Write publishes points, waiting for the broker to acknowledge those
+// published with QoS 1 or 2.
+func (s *republishSink) Write(ctx context.Context, points []*Point) error {
+	for _, p := range points {
+		if p.Message == nil {
+			return fmt.Errorf("mqtt output needs the message a point was built from")
+		}
+
+		topic, err := s.topic.render(p.Message)
+		if err != nil {
+			return err
+		}
+		// Republishing to what the mapping subscribes to, on its own broker,
+		// would receive the message again, and again.
+		if p.Message.broker == s.endpoint && topicMatches(p.Message.MQTT.Topic, topic) {
+			return fmt.Errorf("not republishing to %s, which mapping %s subscribes to on the same broker", topic, p.Message.label())
+		}
+
+		payload, err := p.encode(s.config.Format, s.config.Canonical)
+		if err != nil {
+			return err
+		}
+
+		t := s.client.Publish(topic, s.config.QoS, s.config.Retain, payload)
+		select {
+		case <-t.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err = t.Error(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close disconnects from the broker, letting what is in flight finish.
+func (s *republishSink) Close() error {
+	s.client.Disconnect(250)
+	return nil
+}
@@ -0,0 +1,97 @@
+package mqti
+
+import (
+	"strings"
+)
+
+// RouteConfiguration sends the points of mappings that don't pick their
+// outputs to Outputs, when they match When.  Routes are evaluated in order
+// and the first that matches wins; a route with an empty When always
+// matches, so it can act as an "else".  Points matching no route go to the
+// influxdb section.
+type RouteConfiguration struct {
+	When struct {
+		// Topic is a topic filter, wildcards included, the message's
+		// topic must match.
+		Topic string
+		// Tags must all have the given value on the point.
+		Tags map[string]string
+		JSON FilterJSONMungerConfiguration
+	}
+	Outputs []string
+}
+
+// topicMatches is true when topic matches the topic filter, as a broker
+// would match a subscription.
+func topicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, f := range filterLevels {
+		if f == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if f != "+" && f != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
+
+// tagValue looks a tag up ignoring case, as keys of the config are
+// lowercased when decoded.
+func tagValue(tags map[string]string, key string) (string, bool) {
+	if v, ok := tags[key]; ok {
+		return v, true
+	}
+	for k, v := range tags {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// always is true for routes without conditions, matching every message.
+func (r RouteConfiguration) always() bool {
+	w := r.When
+	return w.Topic == "" && len(w.Tags) == 0 && len(w.JSON.And) == 0 && len(w.JSON.Or) == 0
+}
+
+func (r RouteConfiguration) matches(m *MQTTMessage, p *Point) bool {
+	if r.When.Topic != "" && !topicMatches(r.When.Topic, m.Topic()) {
+		return false
+	}
+
+	for k, v := range r.When.Tags {
+		if tv, ok := tagValue(p.Tags, k); !ok || tv != v {
+			return false
+		}
+	}
+
+	f := r.When.JSON
+	if len(f.And) > 0 || len(f.Or) > 0 {
+		payload, err := m.Fields()
+		if err != nil || m.jSONFilterShouldSkip(payload, f.And, false) || m.jSONFilterShouldSkip(payload, f.Or, true) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// route returns the outputs of the first route p of m matches, or the
+// influxdb section when none does.
+func route(routes []RouteConfiguration, m *MQTTMessage, p *Point) []string {
+	for i, r := range routes {
+		if r.matches(m, p) {
+			Log.Debugf("Route %d matched on %s", i, m.Topic())
+			return r.Outputs
+		}
+	}
+	return []string{""}
+}
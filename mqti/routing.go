@@ -0,0 +1,121 @@
+package mqti
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// RoutingKeyConfiguration picks the key downstream sinks partition on.  The
+// first of Template, Field and TopicSegment that is set is used, otherwise
+// the key is the message topic.
+type RoutingKeyConfiguration struct {
+	Template     string
+	Field        string
+	TopicSegment *int `mapstructure:"topic_segment"`
+}
+
+// messageTemplate is a per-message template, rendered with
+// messageTemplateData, e.g. {{.TopicSegment 1}}-{{.Field "id"}}
+type messageTemplate struct {
+	*template.Template
+}
+
+// messageTemplateData is what per-message templates are rendered with.
+type messageTemplateData struct {
+	m *MQTTMessage
+}
+
+// Topic ...
+func (d messageTemplateData) Topic() string {
+	return d.m.Topic()
+}
+
+// TopicSegment returns the i'th level of the topic, counting from 0, or an
+// empty string when the topic has fewer levels.
+func (d messageTemplateData) TopicSegment(i int) string {
+	return topicSegment(d.m.Topic(), i)
+}
+
+// Field returns a top-level field of the decoded payload, or nil.
+func (d messageTemplateData) Field(name string) interface{} {
+	fields, err := d.m.Fields()
+	if err != nil {
+		return nil
+	}
+	return fields[name]
+}
+
+func topicSegment(topic string, i int) string {
+	segments := strings.Split(topic, "/")
+	if i < 0 || i >= len(segments) {
+		return ""
+	}
+	return segments[i]
+}
+
+func newMessageTemplate(name, text string) (*messageTemplate, error) {
+	t, err := template.New(name).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %s", name, err)
+	}
+	return &messageTemplate{t}, nil
+}
+
+func (t *messageTemplate) render(m *MQTTMessage) (string, error) {
+	var out bytes.Buffer
+	if err := t.Execute(&out, messageTemplateData{m}); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// routingKeyer computes the routing key of messages of one mapping.
+type routingKeyer struct {
+	config   RoutingKeyConfiguration
+	template *messageTemplate
+}
+
+func newRoutingKeyer(c RoutingKeyConfiguration) (*routingKeyer, error) {
+	r := &routingKeyer{config: c}
+
+	if len(c.Template) > 0 {
+		t, err := newMessageTemplate("routing_key", c.Template)
+		if err != nil {
+			return nil, err
+		}
+		r.template = t
+	}
+
+	return r, nil
+}
+
+func (r *routingKeyer) key(m *MQTTMessage) string {
+	switch {
+	case r.template != nil:
+		k, err := r.template.render(m)
+		if err != nil {
+			Log.Warnf("routing_key template on %s failed, using topic: %s", m.Topic(), err)
+			break
+		}
+		return k
+	case len(r.config.Field) > 0:
+		if v := (messageTemplateData{m}).Field(r.config.Field); v != nil {
+			return fmt.Sprint(v)
+		}
+	case r.config.TopicSegment != nil:
+		return topicSegment(m.Topic(), *r.config.TopicSegment)
+	}
+
+	return m.Topic()
+}
+
+// RoutingKey returns the key downstream sinks should partition the message
+// by, as configured by the mapping's routing_key.  It defaults to the topic.
+func (m MQTTMessage) RoutingKey() string {
+	if len(m.routingKey) > 0 {
+		return m.routingKey
+	}
+	return m.Topic()
+}
@@ -0,0 +1,104 @@
+package mqti
+
+// RuleConfiguration picks the transform and outputs of a message by the
+// filter it matches.  Rules are evaluated in order and the first whose When
+// matches wins; a rule with an empty When always matches, so it can act as
+// an "else".  Messages matching no rule use the mapping's own influxdb
+// section and outputs.  Every setting of Then's influxdb section left unset
+// is the mapping's, and so are its outputs when Then sets none.
+type RuleConfiguration struct {
+	When FilterMungerConfiguration
+	Then struct {
+		InfluxDB influxDBMappingConfiguration
+		Output   string
+		Outputs  []string
+	}
+}
+
+// inherit fills every setting the rule leaves unset from d, the mapping's.
+func (c influxDBMappingConfiguration) inherit(d influxDBMappingConfiguration) influxDBMappingConfiguration {
+	if len(c.database()) == 0 {
+		c.Database, c.Bucket = d.Database, d.Bucket
+	}
+	if len(c.RetentionPolicy) == 0 {
+		c.RetentionPolicy = d.RetentionPolicy
+	}
+	if len(c.Organization) == 0 {
+		c.Organization = d.Organization
+	}
+	if len(c.Measurement) == 0 {
+		c.Measurement = d.Measurement
+	}
+	if c.Tags == nil {
+		c.Tags = d.Tags
+	}
+	if !c.Schema.defined() {
+		c.Schema = d.Schema
+	}
+	if c.Rename == nil {
+		c.Rename = d.Rename
+	}
+	if c.Coerce == nil {
+		c.Coerce = d.Coerce
+	}
+	if c.Convert == nil {
+		c.Convert = d.Convert
+	}
+	if c.Bounds == nil {
+		c.Bounds = d.Bounds
+	}
+	if c.FieldsInclude == nil {
+		c.FieldsInclude = d.FieldsInclude
+	}
+	if c.FieldsExclude == nil {
+		c.FieldsExclude = d.FieldsExclude
+	}
+	if c.TagsInclude == nil {
+		c.TagsInclude = d.TagsInclude
+	}
+	if c.TagsExclude == nil {
+		c.TagsExclude = d.TagsExclude
+	}
+	if c.Mungers.Tags.From == nil {
+		c.Mungers.Tags = d.Mungers.Tags
+	}
+	if !c.Mungers.Geohash.defined() {
+		c.Mungers.Geohash = d.Mungers.Geohash
+	}
+	return c
+}
+
+// database is where the mapping writes to, its bucket when set.
+func (c influxDBMappingConfiguration) database() string {
+	if len(c.Bucket) > 0 {
+		return c.Bucket
+	}
+	return c.Database
+}
+
+// applyRules switches the message to the transform and outputs of the
+// first rule it matches.
+func (m *MQTTMessage) applyRules() {
+	if len(m.Rules) == 0 {
+		return
+	}
+
+	payload, err := m.Fields()
+	if err != nil {
+		payload = nil
+	}
+
+	for i, r := range m.Rules {
+		f := r.When.JSON
+		if (len(f.And) > 0 || len(f.Or) > 0) && (payload == nil || m.jSONFilterShouldSkip(payload, f.And, false) || m.jSONFilterShouldSkip(payload, f.Or, true)) {
+			continue
+		}
+
+		Log.Debugf("Rule %d matched on %s", i, m.Topic())
+		m.InfluxDB = r.Then.InfluxDB.inherit(m.InfluxDB)
+		if r.Then.Output != "" || len(r.Then.Outputs) > 0 {
+			m.Output, m.Outputs = r.Then.Output, r.Then.Outputs
+		}
+		return
+	}
+}
@@ -0,0 +1,51 @@
+package mqti
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyRules(t *testing.T) {
+	var mapping MappingConfiguration
+	mapping.Output = "influxdb"
+	mapping.InfluxDB = influxDBMappingConfiguration{
+		Database:    "iot",
+		Measurement: "readings",
+		Tags:        map[string]string{"site": "eu"},
+		Coerce:      map[string]string{"value": fieldTypeFloat},
+	}
+
+	alarm := RuleConfiguration{}
+	alarm.When.JSON.And = []map[string]string{{"type": "alarm"}}
+	alarm.Then.InfluxDB.Measurement = "alarms"
+	alarm.Then.Outputs = []string{"webhook"}
+
+	other := RuleConfiguration{}
+	other.Then.InfluxDB.Database = "other"
+	mapping.Rules = []RuleConfiguration{alarm, other}
+
+	tests := []struct {
+		payload     string
+		measurement string
+		database    string
+		outputs     []string
+	}{
+		{`{"type": "alarm", "value": 1}`, "alarms", "iot", []string{"webhook"}},
+		{`{"type": "reading", "value": 1}`, "readings", "other", []string{"influxdb"}},
+	}
+
+	for _, tt := range tests {
+		m := newMQTTMessage(testMessage{topic: "sensors/a", payload: []byte(tt.payload)}, mapping, "")
+		m.applyRules()
+
+		if m.InfluxDB.Measurement != tt.measurement || m.InfluxDB.Database != tt.database {
+			t.Errorf("%s: got %s in %s, want %s in %s", tt.payload, m.InfluxDB.Measurement, m.InfluxDB.Database, tt.measurement, tt.database)
+		}
+		if !reflect.DeepEqual(m.outputs(), tt.outputs) {
+			t.Errorf("%s: got outputs %v, want %v", tt.payload, m.outputs(), tt.outputs)
+		}
+		if !reflect.DeepEqual(m.InfluxDB.Tags, mapping.InfluxDB.Tags) || !reflect.DeepEqual(m.InfluxDB.Coerce, mapping.InfluxDB.Coerce) {
+			t.Errorf("%s: lost the mapping's tags or coerce", tt.payload)
+		}
+	}
+}
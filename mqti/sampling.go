@@ -0,0 +1,202 @@
+package mqti
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sampler keeps a uniformly random subset of up to Samples messages per
+// topic for each Window (reservoir sampling), and releases them when the
+// window closes.  Unlike forwarding every Nth message, every message in a
+// window has the same chance of being kept, so bursts and quiet periods
+// are represented fairly.
+type sampler struct {
+	config SampleMungerConfiguration
+	stop   chan struct{}
+
+	mu         sync.Mutex
+	reservoirs map[string]*reservoir
+}
+
+type reservoir struct {
+	seen    int
+	entries []sampled
+}
+
+type sampled struct {
+	seq int
+	m   *MQTTMessage
+}
+
+func (c SampleMungerConfiguration) defined() bool {
+	return c.Window > 0 && c.Samples > 0
+}
+
+func newSampler(c SampleMungerConfiguration) *sampler {
+	return &sampler{config: c, stop: make(chan struct{}), reservoirs: make(map[string]*reservoir)}
+}
+
+func (s *sampler) add(m *MQTTMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.reservoirs[m.Topic()]
+	if r == nil {
+		r = &reservoir{entries: make([]sampled, 0, s.config.Samples)}
+		s.reservoirs[m.Topic()] = r
+	}
+
+	e := sampled{r.seen, m}
+	r.seen++
+
+	if len(r.entries) < s.config.Samples {
+		r.entries = append(r.entries, e)
+		return
+	}
+
+	if j := rand.Intn(r.seen); j < s.config.Samples {
+		r.entries[j] = e
+	}
+}
+
+// flush ends the current window and returns the sampled messages of every
+// topic in the order they were received.
+func (s *sampler) flush() []*MQTTMessage {
+	s.mu.Lock()
+	reservoirs := s.reservoirs
+	s.reservoirs = make(map[string]*reservoir)
+	s.mu.Unlock()
+
+	var out []*MQTTMessage
+
+	for topic, r := range reservoirs {
+		sort.Slice(r.entries, func(i, j int) bool { return r.entries[i].seq < r.entries[j].seq })
+		for _, e := range r.entries {
+			out = append(out, e.m)
+		}
+		Log.Debugf("Sampled %d of %d message(s) on %s", len(r.entries), r.seen, topic)
+	}
+
+	return out
+}
+
+// handOver moves what s sampled so far in its window to to.
+func (s *sampler) handOver(to *sampler) {
+	s.mu.Lock()
+	reservoirs := s.reservoirs
+	s.reservoirs = make(map[string]*reservoir)
+	s.mu.Unlock()
+
+	to.mu.Lock()
+	defer to.mu.Unlock()
+
+	for topic, r := range reservoirs {
+		if _, ok := to.reservoirs[topic]; !ok {
+			to.reservoirs[topic] = r
+			continue
+		}
+		// Messages to already arrived on the new subscription; the old
+		// ones are sent rather than mixed into its reservoir.
+		s.reservoirs[topic] = r
+	}
+}
+
+// samplerKey identifies the sampler of a mapping.
+type samplerKey struct {
+	name  string
+	topic string
+}
+
+// sampler returns the sampler for mapping m, starting it on first use.
+// Samplers outlive reconnects so a window isn't lost when the connection
+// drops, and are replaced when the mappings are reloaded.
+func (s *Subscriber) sampler(m MappingConfiguration) *sampler {
+	key := samplerKey{m.Name, m.MQTT.Topic}
+
+	s.samplersMu.Lock()
+	defer s.samplersMu.Unlock()
+
+	if sm, ok := s.samplers[key]; ok {
+		return sm
+	}
+
+	sm := newSampler(m.MQTT.Mungers.Sample)
+	s.samplers[key] = sm
+	s.goroutine(func() { s.runSampler(sm) })
+
+	return sm
+}
+
+func (s *Subscriber) runSampler(sm *sampler) {
+	t := time.NewTicker(sm.config.Window)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			for _, m := range sm.flush() {
+				s.send(m)
+			}
+		case <-sm.stop:
+			for _, m := range sm.flush() {
+				s.send(m)
+			}
+			return
+		case <-s.ctx.Done():
+			// The workers may be gone by now, so what was sampled is
+			// forwarded here, before Close returns and the outputs close.
+			for _, m := range sm.flush() {
+				forwardJob(m)
+			}
+			return
+		}
+	}
+}
+
+// swapSamplers replaces the samplers with samplers, returning the ones
+// replaced, so reloaded mappings start new ones with their settings.
+func (s *Subscriber) swapSamplers(samplers map[samplerKey]*sampler) map[samplerKey]*sampler {
+	s.samplersMu.Lock()
+	defer s.samplersMu.Unlock()
+
+	old := s.samplers
+	s.samplers = samplers
+	return old
+}
+
+// stopSamplers stops samplers, sending what they sampled so far.
+func stopSamplers(samplers map[samplerKey]*sampler) {
+	for _, sm := range samplers {
+		close(sm.stop)
+	}
+}
+
+// handOverSamplers stops the samplers of the mappings before a reload.
+// What one sampled so far in its window carries over to the sampler of the
+// same mapping after it, found by topic or, for a named mapping whose topic
+// changed, by name, when its settings are unchanged; otherwise it is sent.
+func (s *Subscriber) handOverSamplers(old map[samplerKey]*sampler) {
+	s.samplersMu.Lock()
+	current := make(map[samplerKey]*sampler, len(s.samplers))
+	byName := make(map[string]*sampler)
+	for k, sm := range s.samplers {
+		current[k] = sm
+		if k.name != "" {
+			byName[k.name] = sm
+		}
+	}
+	s.samplersMu.Unlock()
+
+	for k, sm := range old {
+		to, ok := current[k]
+		if !ok && k.name != "" {
+			to, ok = byName[k.name]
+		}
+		if ok && to.config == sm.config {
+			sm.handOver(to)
+		}
+		close(sm.stop)
+	}
+}
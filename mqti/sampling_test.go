@@ -0,0 +1,33 @@
+package mqti
+
+import (
+	"testing"
+	"time"
+)
+
+// TestSampledPointsKeepReceiptTime checks that points are timed by when
+// their message arrived, not by when the sampler releases it.
+func TestSampledPointsKeepReceiptTime(t *testing.T) {
+	var mapping MappingConfiguration
+	mapping.InfluxDB.Measurement = "readings"
+	mapping.MQTT.Mungers.Sample = SampleMungerConfiguration{Window: time.Minute, Samples: 2}
+
+	sm := newSampler(mapping.MQTT.Mungers.Sample)
+	var received []time.Time
+	for i := 0; i < 2; i++ {
+		m := newMQTTMessage(testMessage{topic: "sensors/a", payload: []byte(`{"value": 1}`)}, mapping, "")
+		m.received = time.Now().Add(-time.Duration(2-i) * time.Minute)
+		received = append(received, m.received)
+		sm.add(m)
+	}
+
+	for i, m := range sm.flush() {
+		p, err := newPoint(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !p.Time.Equal(received[i]) {
+			t.Errorf("point %d at %s, want %s", i, p.Time, received[i])
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package mqti
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	fieldTypeFloat   string = "float"
+	fieldTypeInteger string = "integer"
+	fieldTypeBoolean string = "boolean"
+	fieldTypeString  string = "string"
+)
+
+// InfluxDBSchemaConfiguration classifies payload keys as tags or typed
+// fields.  When defined, keys that are neither are dropped, and a point
+// whose tags would exceed MaxTagValues distinct values is rejected.
+type InfluxDBSchemaConfiguration struct {
+	Tags         []string
+	Fields       map[string]string
+	MaxTagValues int `mapstructure:"max_tag_values"`
+}
+
+func (s InfluxDBSchemaConfiguration) defined() bool {
+	return len(s.Tags) > 0 || len(s.Fields) > 0
+}
+
+func validFieldType(t string) bool {
+	switch t {
+	case fieldTypeFloat, fieldTypeInteger, fieldTypeBoolean, fieldTypeString:
+		return true
+	}
+	return false
+}
+
+// apply moves classified keys from fields into tags, checks every value has
+// its declared type and drops everything else.  Keys match ignoring case,
+// see fieldKey, and fields keep the payload's key.
+func (s InfluxDBSchemaConfiguration) apply(fields map[string]interface{}, tags map[string]string) (map[string]interface{}, error) {
+	for _, name := range s.Tags {
+		k, ok := fieldKey(fields, name)
+		if !ok {
+			continue
+		}
+		v := fields[k]
+		str, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("tag '%s' must be a string, got %T", k, v)
+		}
+		tags[name] = str
+	}
+
+	out := make(map[string]interface{}, len(s.Fields))
+
+	for name, t := range s.Fields {
+		k, ok := fieldKey(fields, name)
+		if !ok {
+			continue
+		}
+
+		typed, err := typedField(fields[k], t)
+		if err != nil {
+			return nil, fmt.Errorf("field '%s': %s", k, err)
+		}
+		out[k] = typed
+	}
+
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no classified fields in payload")
+	}
+
+	return out, nil
+}
+
+func typedField(v interface{}, t string) (interface{}, error) {
+	switch t {
+	case fieldTypeFloat:
+		if f, ok := v.(float64); ok {
+			return f, nil
+		}
+	case fieldTypeInteger:
+		if i, ok := v.(int64); ok {
+			return i, nil
+		}
+		if f, ok := v.(float64); ok && f == math.Trunc(f) {
+			return int64(f), nil
+		}
+	case fieldTypeBoolean:
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case fieldTypeString:
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("expected %s, got %T", t, v)
+}
+
+// renameFields renames fields by rename, old name to new, so payloads
+// of firmwares that disagree on keys converge on one schema.  Old names
+// match ignoring case, as keys of the config are lowercased when decoded.
+func renameFields(rename map[string]string, fields map[string]interface{}) {
+	if len(rename) == 0 {
+		return
+	}
+
+	renamed := make(map[string]interface{})
+	for k, v := range fields {
+		to, ok := rename[k]
+		if !ok {
+			to, ok = tagValue(rename, k)
+		}
+		if ok && to != k {
+			delete(fields, k)
+			renamed[to] = v
+		}
+	}
+	for k, v := range renamed {
+		fields[k] = v
+	}
+}
+
+// fieldKey returns the key of fields that key names, matching ignoring
+// case like renameFields, as keys of the config are lowercased when
+// decoded but payload keys aren't.
+func fieldKey(fields map[string]interface{}, key string) (string, bool) {
+	if _, ok := fields[key]; ok {
+		return key, true
+	}
+	for k := range fields {
+		if strings.EqualFold(k, key) {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// matchesAny is true when key matches one of patterns, globs such as
+// debug_*.
+func matchesAny(patterns []string, key string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// keepKey is true when key is included, every key being when include is
+// empty, and not excluded.
+func keepKey(include, exclude []string, key string) bool {
+	return (len(include) == 0 || matchesAny(include, key)) && !matchesAny(exclude, key)
+}
+
+// filterKeys drops the fields and tags the mapping's include and exclude
+// lists leave out, so noisy keys never reach the outputs.
+func (c influxDBMappingConfiguration) filterKeys(fields map[string]interface{}, tags map[string]string) error {
+	for k := range fields {
+		if !keepKey(c.FieldsInclude, c.FieldsExclude, k) {
+			delete(fields, k)
+		}
+	}
+	for k := range tags {
+		if !keepKey(c.TagsInclude, c.TagsExclude, k) {
+			delete(tags, k)
+		}
+	}
+
+	if len(fields) == 0 {
+		return fmt.Errorf("no fields left after fields_include and fields_exclude")
+	}
+	return nil
+}
+
+// coerceFields converts the fields named in coerce to their type, so
+// payloads whose firmware sends "23.5" one day and 23.5 the next don't
+// conflict in InfluxDB.  Fields not in the payload are ignored.
+func coerceFields(coerce map[string]string, fields map[string]interface{}) error {
+	for name, t := range coerce {
+		k, ok := fieldKey(fields, name)
+		if !ok {
+			continue
+		}
+
+		coerced, err := coerceField(fields[k], t)
+		if err != nil {
+			return fmt.Errorf("field '%s': %s", k, err)
+		}
+		fields[k] = coerced
+	}
+	return nil
+}
+
+// coerceField converts v to type t, failing rather than losing anything,
+// e.g. on coercing 23.5 to an integer.
+func coerceField(v interface{}, t string) (interface{}, error) {
+	switch t {
+	case fieldTypeFloat:
+		switch v := v.(type) {
+		case float64:
+			return v, nil
+		case int64:
+			return float64(v), nil
+		case uint64:
+			return float64(v), nil
+		case string:
+			return strconv.ParseFloat(v, 64)
+		}
+	case fieldTypeInteger:
+		switch v := v.(type) {
+		case int64:
+			return v, nil
+		case uint64:
+			if v <= math.MaxInt64 {
+				return int64(v), nil
+			}
+		case float64:
+			if v == math.Trunc(v) {
+				return int64(v), nil
+			}
+		case string:
+			if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return i, nil
+			}
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, err
+			}
+			if f == math.Trunc(f) {
+				return int64(f), nil
+			}
+		}
+	case fieldTypeBoolean:
+		switch v := v.(type) {
+		case bool:
+			return v, nil
+		case float64:
+			return v != 0, nil
+		case int64:
+			return v != 0, nil
+		case string:
+			return strconv.ParseBool(v)
+		}
+	case fieldTypeString:
+		switch v := v.(type) {
+		case string:
+			return v, nil
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		case int64:
+			return strconv.FormatInt(v, 10), nil
+		case uint64:
+			return strconv.FormatUint(v, 10), nil
+		case bool:
+			return strconv.FormatBool(v), nil
+		}
+	}
+	return nil, fmt.Errorf("can't coerce %T %v to %s", v, v, t)
+}
+
+// tagCardinality remembers the distinct values seen for each tag key of each
+// measurement, so points that would blow up series cardinality can be
+// rejected before they reach InfluxDB.
+var tagCardinality = struct {
+	sync.Mutex
+	values map[string]map[string]struct{}
+}{values: make(map[string]map[string]struct{})}
+
+// checkTagCardinality rejects tags introducing a value beyond limit for any
+// tag key of measurement.  Values are only remembered once the whole point
+// is accepted.
+func checkTagCardinality(measurement string, tags map[string]string, limit int) error {
+	if limit <= 0 {
+		return nil
+	}
+
+	tagCardinality.Lock()
+	defer tagCardinality.Unlock()
+
+	for k, v := range tags {
+		seen := tagCardinality.values[measurement+"\x00"+k]
+		if _, ok := seen[v]; !ok && len(seen) >= limit {
+			return fmt.Errorf("tag '%s' on %s would exceed %d distinct values with '%s'", k, measurement, limit, v)
+		}
+	}
+
+	for k, v := range tags {
+		key := measurement + "\x00" + k
+		if tagCardinality.values[key] == nil {
+			tagCardinality.values[key] = make(map[string]struct{})
+		}
+		tagCardinality.values[key][v] = struct{}{}
+	}
+
+	return nil
+}
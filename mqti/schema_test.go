@@ -0,0 +1,66 @@
+package mqti
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInfluxDBSchemaApply(t *testing.T) {
+	schema := InfluxDBSchemaConfiguration{
+		Tags:   []string{"device"},
+		Fields: map[string]string{"temperature": fieldTypeFloat, "count": fieldTypeInteger},
+	}
+
+	tests := []struct {
+		name       string
+		fields     map[string]interface{}
+		wantFields map[string]interface{}
+		wantTags   map[string]string
+		wantErr    bool
+	}{
+		{
+			name:       "lowercase",
+			fields:     map[string]interface{}{"device": "a", "temperature": 21.5, "count": 3.0, "other": 1.0},
+			wantFields: map[string]interface{}{"temperature": 21.5, "count": int64(3)},
+			wantTags:   map[string]string{"device": "a"},
+		},
+		{
+			name:       "mixed case keeps the payload's keys",
+			fields:     map[string]interface{}{"Device": "a", "Temperature": 21.5, "COUNT": 3.0},
+			wantFields: map[string]interface{}{"Temperature": 21.5, "COUNT": int64(3)},
+			wantTags:   map[string]string{"device": "a"},
+		},
+		{
+			name:    "no classified fields",
+			fields:  map[string]interface{}{"other": 1.0},
+			wantErr: true,
+		},
+		{
+			name:    "wrong type",
+			fields:  map[string]interface{}{"Count": 3.5},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tags := make(map[string]string)
+			fields, err := schema.apply(tt.fields, tags)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", fields)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(fields, tt.wantFields) {
+				t.Errorf("fields = %v, want %v", fields, tt.wantFields)
+			}
+			if !reflect.DeepEqual(tags, tt.wantTags) {
+				t.Errorf("tags = %v, want %v", tags, tt.wantTags)
+			}
+		})
+	}
+}
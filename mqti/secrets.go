@@ -0,0 +1,264 @@
+package mqti
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// SecretResolver fetches the secret a config value refers to, e.g.
+// secret/mqtt#password for vault:secret/mqtt#password.
+type SecretResolver func(ref string) (string, error)
+
+var secretResolvers = map[string]SecretResolver{
+	"vault":  resolveVaultSecret,
+	"aws-sm": resolveAWSSecret,
+}
+
+// RegisterSecretResolver makes config values starting with scheme: be
+// replaced by what r returns for the rest of the value.  It must be called
+// before the config is read.
+func RegisterSecretResolver(scheme string, r SecretResolver) {
+	secretResolvers[scheme] = r
+}
+
+// resolveSecret returns the secret s refers to, or s itself when it isn't
+// a reference.
+func resolveSecret(s string) (string, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return s, nil
+	}
+	r, ok := secretResolvers[s[:i]]
+	if !ok {
+		return s, nil
+	}
+
+	secret, err := r(s[i+1:])
+	if err != nil {
+		return "", fmt.Errorf("resolving %s failed: %s", s, err)
+	}
+	return secret, nil
+}
+
+// secretKey splits path#key.
+func secretKey(ref string) (string, string) {
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, ""
+}
+
+// secretField picks key out of a secret holding several values, or the
+// only value when no key is given.
+func secretField(data map[string]interface{}, key string) (string, error) {
+	if key == "" {
+		if len(data) != 1 {
+			return "", fmt.Errorf("secret holds %d values, pick one with #key", len(data))
+		}
+		for _, v := range data {
+			return fmt.Sprint(v), nil
+		}
+	}
+
+	v, ok := data[key]
+	if !ok {
+		return "", fmt.Errorf("secret has no key '%s'", key)
+	}
+	return fmt.Sprint(v), nil
+}
+
+var vaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// resolveVaultSecret reads path#key from the Vault at VAULT_ADDR with
+// VAULT_TOKEN.  path is the API path, e.g. secret/data/mqtt for a KV
+// version 2 engine mounted at secret.
+func resolveVaultSecret(ref string) (string, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", fmt.Errorf("VAULT_ADDR is not set")
+	}
+
+	path, key := secretKey(ref)
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned %s", resp.Status)
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", err
+	}
+
+	data := secret.Data
+	// KV version 2 nests the values, next to their metadata.
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok = data["metadata"]; ok {
+			data = inner
+		}
+	}
+
+	return secretField(data, key)
+}
+
+// resolveAWSSecret reads name#key from AWS Secrets Manager through the aws
+// CLI, so its usual credential chain applies.  Without a key the whole
+// secret string is used.
+func resolveAWSSecret(ref string) (string, error) {
+	name, key := secretKey(ref)
+
+	out, err := exec.Command("aws", "secretsmanager", "get-secret-value",
+		"--secret-id", name, "--query", "SecretString", "--output", "text").Output()
+	if err != nil {
+		if e, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("%s: %s", err, strings.TrimSpace(string(e.Stderr)))
+		}
+		return "", err
+	}
+	secret := strings.TrimRight(string(out), "\r\n")
+
+	if key == "" {
+		return secret, nil
+	}
+
+	var data map[string]interface{}
+	if err = json.Unmarshal([]byte(secret), &data); err != nil {
+		return "", fmt.Errorf("secret isn't JSON, so has no key '%s'", key)
+	}
+	return secretField(data, key)
+}
+
+// secretRef is a secret reference in the config, at path, and the value
+// it resolved to.
+type secretRef struct {
+	path       []interface{}
+	ref, value string
+}
+
+// secretRefs are the secret references of the config last read.
+var secretRefs []secretRef
+
+// refreshSecrets re-resolves the secret references of the config every
+// interval, until done is closed, so secrets rotated in Vault or a secret
+// manager are used on the next connect.
+func refreshSecrets(subscribers []*Subscriber, interval time.Duration, done <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			rotateSecrets(subscribers)
+		}
+	}
+}
+
+// rotateSecrets resolves the secret references again and, when a secret
+// changed, applies it to the brokers' credentials and rebuilds the outputs
+// using it.  Nothing else of the config is re-read.
+func rotateSecrets(subscribers []*Subscriber) {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	settings := viper.AllSettings()
+	changed := false
+	for i, r := range secretRefs {
+		secret, err := resolveSecret(r.ref)
+		if err != nil {
+			Log.Errorf("Refreshing secrets failed: %s", err)
+			continue
+		}
+		if secret == r.value {
+			continue
+		}
+		if !setSetting(settings, r.path, secret) {
+			continue
+		}
+		secretRefs[i].value = secret
+		changed = true
+	}
+	if !changed {
+		return
+	}
+
+	if err := viper.MergeConfigMap(settings); err != nil {
+		Log.Errorf("Refreshing secrets failed: %s", err)
+		return
+	}
+
+	config, err := GetConfig()
+	if err != nil {
+		Log.Errorf("Refreshing secrets failed: %s", err)
+		return
+	}
+
+	if err = reloadSinks(config); err != nil {
+		Log.Errorf("Refreshing secrets failed: %s", err)
+	}
+	for _, s := range subscribers {
+		s.refreshCredentials(config)
+	}
+
+	Log.Info("Secrets refreshed")
+}
+
+// setSetting sets the value at path in settings, returning false when the
+// path is no longer there.
+func setSetting(settings interface{}, path []interface{}, value string) bool {
+	if len(path) == 0 {
+		return false
+	}
+	k, rest := path[0], path[1:]
+
+	switch s := settings.(type) {
+	case map[string]interface{}:
+		key, ok := k.(string)
+		if !ok {
+			return false
+		}
+		if len(rest) == 0 {
+			s[key] = value
+			return true
+		}
+		return setSetting(s[key], rest, value)
+	case map[interface{}]interface{}:
+		if len(rest) == 0 {
+			s[k] = value
+			return true
+		}
+		return setSetting(s[k], rest, value)
+	case []interface{}:
+		i, ok := k.(int)
+		if !ok || i >= len(s) {
+			return false
+		}
+		if len(rest) == 0 {
+			s[i] = value
+			return true
+		}
+		return setSetting(s[i], rest, value)
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package mqti
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSecretRefs(t *testing.T) {
+	secrets := map[string]string{"mqtt": "s3cret", "influx": "hunter2"}
+	RegisterSecretResolver("test", func(ref string) (string, error) {
+		return secrets[ref], nil
+	})
+	defer delete(secretResolvers, "test")
+
+	config := map[string]interface{}{
+		"brokers": []interface{}{
+			map[interface{}]interface{}{"name": "plant", "password": "test:mqtt"},
+		},
+		"outputs": map[string]interface{}{
+			"archive": map[string]interface{}{"type": "influxdb", "password": "test:influx"},
+		},
+	}
+
+	var refs []secretRef
+	expanded, err := expandEnv(config, nil, &refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 2 {
+		t.Fatalf("got %d secret references, want 2", len(refs))
+	}
+
+	secrets["mqtt"] = "rotated"
+	for _, r := range refs {
+		secret, err := resolveSecret(r.ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !setSetting(expanded, r.path, secret) {
+			t.Fatalf("%v: not set", r.path)
+		}
+	}
+
+	want := map[string]interface{}{
+		"brokers": []interface{}{
+			map[interface{}]interface{}{"name": "plant", "password": "rotated"},
+		},
+		"outputs": map[string]interface{}{
+			"archive": map[string]interface{}{"type": "influxdb", "password": "hunter2"},
+		},
+	}
+	if !reflect.DeepEqual(expanded, want) {
+		t.Errorf("got %v, want %v", expanded, want)
+	}
+
+	if setSetting(expanded, []interface{}{"brokers", 1, "password"}, "x") {
+		t.Error("set a broker that isn't there")
+	}
+}
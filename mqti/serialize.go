@@ -0,0 +1,49 @@
+package mqti
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Serialize returns the message payload as it should be written to a sink.
+// When canonical is true a JSON payload is re-encoded compactly with its
+// object keys sorted, so equal documents always produce identical bytes
+// regardless of key order on the wire.  Payloads that aren't JSON are
+// returned untouched.
+func (m MQTTMessage) Serialize(canonical bool) ([]byte, error) {
+	if !canonical {
+		return m.Payload(), nil
+	}
+
+	var v interface{}
+
+	d := json.NewDecoder(bytes.NewReader(m.Payload()))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return m.Payload(), nil
+	}
+
+	return CanonicalJSON(v)
+}
+
+// marshalJSON is json.Marshal, or CanonicalJSON for outputs set canonical.
+func marshalJSON(v interface{}, canonical bool) ([]byte, error) {
+	if canonical {
+		return CanonicalJSON(v)
+	}
+	return json.Marshal(v)
+}
+
+// CanonicalJSON encodes v with sorted object keys, no insignificant
+// whitespace and no HTML escaping.
+func CanonicalJSON(v interface{}) ([]byte, error) {
+	var out bytes.Buffer
+
+	e := json.NewEncoder(&out)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimRight(out.Bytes(), "\n"), nil
+}
@@ -0,0 +1,72 @@
+package mqti
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCanonicalOutputsIgnoreKeyOrder(t *testing.T) {
+	payloads := []string{
+		`{"temperature": 21.5, "device": {"id": "a", "site": "eu"}, "note": "<ok>"}`,
+		`{"device": {"site": "eu", "id": "a"}, "note": "<ok>", "temperature": 21.5}`,
+	}
+
+	encoders := map[string]func(p *Point) ([]byte, error){
+		"payload": func(p *Point) ([]byte, error) { return p.encode(pointFormatPayload, true) },
+		"point":   func(p *Point) ([]byte, error) { return p.encode(pointFormatPoint, true) },
+		"archive payload": func(p *Point) ([]byte, error) {
+			return (&archiveSink{config: archiveConfiguration{Canonical: true}}).line(p)
+		},
+	}
+
+	for name, encode := range encoders {
+		t.Run(name, func(t *testing.T) {
+			var outputs []string
+			for _, payload := range payloads {
+				m := newMQTTMessage(testMessage{topic: "sensors/a", payload: []byte(payload)}, MappingConfiguration{}, "")
+				fields, err := m.PayloadAsJSON()
+				if err != nil {
+					t.Fatal(err)
+				}
+				p := &Point{
+					Measurement: "sensors",
+					Tags:        map[string]string{"site": "eu", "device": "a"},
+					Fields:      fields,
+					Time:        time.Unix(1600000000, 0),
+					Message:     m,
+				}
+
+				out, err := encode(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				outputs = append(outputs, string(out))
+			}
+
+			if outputs[0] != outputs[1] {
+				t.Errorf("outputs differ:\n%s\n%s", outputs[0], outputs[1])
+			}
+		})
+	}
+}
+
+func TestSerializeNotCanonical(t *testing.T) {
+	payload := `{"b": 1, "a": 2}`
+	m := newMQTTMessage(testMessage{topic: "sensors/a", payload: []byte(payload)}, MappingConfiguration{}, "")
+
+	out, err := m.Serialize(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != payload {
+		t.Errorf("got %s, want the payload untouched", out)
+	}
+
+	out, err = m.Serialize(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"a":2,"b":1}`; string(out) != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+}
@@ -0,0 +1,582 @@
+package mqti
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Point is a measurement built from a message, as written to a Sink.
+type Point struct {
+	Database string
+	// RetentionPolicy and Organization are only used by InfluxDB outputs,
+	// with version 1 and 2 respectively.
+	RetentionPolicy string
+	Organization    string
+	Measurement     string
+	Tags            map[string]string
+	Fields          map[string]interface{}
+	// Time is zero when the sink should assign it.
+	Time time.Time
+	// Message is the message the point was built from, for sinks that
+	// name or key what they write after it.
+	Message *MQTTMessage
+}
+
+// MarshalJSON encodes the point for sinks that carry JSON, with the topic
+// of its message and the current time when it has none.
+func (p *Point) MarshalJSON() ([]byte, error) {
+	t := p.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	var topic string
+	if p.Message != nil {
+		topic = p.Message.Topic()
+	}
+
+	return json.Marshal(struct {
+		Topic       string                 `json:"topic,omitempty"`
+		Measurement string                 `json:"measurement"`
+		Tags        map[string]string      `json:"tags,omitempty"`
+		Fields      map[string]interface{} `json:"fields"`
+		Time        time.Time              `json:"time"`
+	}{topic, p.Measurement, p.Tags, p.Fields, t})
+}
+
+const (
+	pointFormatPayload string = "payload"
+	pointFormatPoint   string = "point"
+)
+
+// encode returns what sinks that republish messages send for p: with
+// format payload the message's payload as transformed by the mapping, with
+// point the point as JSON.  canonical re-encodes either canonically, see
+// Serialize.
+func (p *Point) encode(format string, canonical bool) ([]byte, error) {
+	if format == pointFormatPoint {
+		return marshalJSON(p, canonical)
+	}
+	return p.Message.Serialize(canonical)
+}
+
+func validPointFormat(f string) bool {
+	return f == pointFormatPayload || f == pointFormatPoint
+}
+
+// Sink is an output that messages are forwarded to.
+type Sink interface {
+	Write(ctx context.Context, points []*Point) error
+}
+
+// batchSink is implemented by outputs that write in batches, which
+// newBatchedSink queues points for.  encode turns a point into what is
+// written, failing that point alone, and writeBatch writes what a batch of
+// points encoded to at once.
+type batchSink interface {
+	encode(p *Point) (interface{}, error)
+	writeBatch(ctx context.Context, batch []interface{}) error
+}
+
+// queuedPoint is a point encoded by a batchSink, waiting for its batch to
+// be written, and what is told how that went.
+type queuedPoint struct {
+	encoded interface{}
+	done    func(error)
+}
+
+// batchedSink queues points for a batchSink, writing them once they make a
+// batch of size, weighed by weigh when set, and at least every interval.
+// Every point's outcome is only reported when its batch is written, so
+// failures are charged to all the points of the batch and those queued
+// aren't counted as forwarded.
+type batchedSink struct {
+	sink  batchSink
+	size  int
+	weigh func(encoded interface{}) int
+
+	mu      sync.Mutex
+	pending []queuedPoint
+	weight  int
+	closed  bool
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func newBatchedSink(sink batchSink, size int, interval time.Duration) *batchedSink {
+	b := &batchedSink{sink: sink, size: size, stop: make(chan struct{}), stopped: make(chan struct{})}
+	go b.flushEvery(interval)
+	return b
+}
+
+// Write writes points as one batch, bypassing the queue.
+func (b *batchedSink) Write(ctx context.Context, points []*Point) error {
+	batch := make([]interface{}, len(points))
+	for i, p := range points {
+		encoded, err := b.sink.encode(p)
+		if err != nil {
+			return err
+		}
+		batch[i] = encoded
+	}
+	return b.sink.writeBatch(ctx, batch)
+}
+
+// queue adds p to the next batch, calling done once it is written or
+// failed to be, and writes the batch if p fills it.
+func (b *batchedSink) queue(ctx context.Context, p *Point, done func(error)) {
+	encoded, err := b.sink.encode(p)
+	if err != nil {
+		done(err)
+		return
+	}
+
+	w := 1
+	if b.weigh != nil {
+		w = b.weigh(encoded)
+	}
+
+	b.mu.Lock()
+	b.pending = append(b.pending, queuedPoint{encoded, done})
+	b.weight += w
+	// Points queued once closed, such as dead letters of its last batches,
+	// are written at once.
+	full := b.weight >= b.size || b.closed
+	b.mu.Unlock()
+
+	if full {
+		b.Flush(ctx)
+	}
+}
+
+func (b *batchedSink) flushEvery(interval time.Duration) {
+	defer close(b.stopped)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			b.Flush(context.Background())
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// Flush writes every queued point now, telling each of them the outcome.
+func (b *batchedSink) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	pending := b.pending
+	b.pending, b.weight = nil, 0
+	b.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	batch := make([]interface{}, len(pending))
+	for i, q := range pending {
+		batch[i] = q.encoded
+	}
+
+	err := b.sink.writeBatch(ctx, batch)
+	for _, q := range pending {
+		q.done(err)
+	}
+	return err
+}
+
+// ready returns why the wrapped sink isn't ready, when it can tell.
+func (b *batchedSink) ready(ctx context.Context) error {
+	if r, ok := b.sink.(readier); ok {
+		return r.ready(ctx)
+	}
+	return nil
+}
+
+// Close stops the periodic flushes, writes what is still queued, and
+// closes the sink if it holds connections.
+func (b *batchedSink) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+
+	close(b.stop)
+	<-b.stopped
+
+	err := b.Flush(context.Background())
+	if c, ok := b.sink.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// writePoint writes p to sink, calling done with the outcome once it is
+// known, which for batched sinks is when p's batch is written.
+func writePoint(sink Sink, p *Point, done func(error)) {
+	if b, ok := sink.(*batchedSink); ok {
+		b.queue(context.Background(), p, done)
+		return
+	}
+	done(sink.Write(context.Background(), []*Point{p}))
+}
+
+// SinkFactory builds a Sink from the settings of an outputs entry, e.g.
+// host and port for an influxdb one.
+type SinkFactory func(settings map[string]interface{}) (Sink, error)
+
+var sinkFactories = map[string]SinkFactory{
+	"clickhouse":      newClickHouseSink,
+	"elasticsearch":   newElasticsearchSink,
+	"file":            newFileSink,
+	"graphite":        newGraphiteSink,
+	"http":            newWebhookSink,
+	"influxdb":        newInfluxDBSink,
+	"kafka":           newKafkaSink,
+	"mqtt":            newRepublishSink,
+	"nats":            newNATSSink,
+	"opensearch":      newElasticsearchSink,
+	"opentsdb":        newOpenTSDBSink,
+	"postgres":        newPostgresSink,
+	"prometheus":      newPrometheusSink,
+	"questdb":         newQuestDBSink,
+	"timestream":      newTimestreamSink,
+	"victoriametrics": newVictoriaMetricsSink,
+}
+
+// RegisterSink makes outputs of the given type be built by f, so new
+// outputs can be added without touching the pipeline.  It must be called
+// before the workers are created.
+func RegisterSink(kind string, f SinkFactory) {
+	sinkFactories[kind] = f
+}
+
+func sinkKinds() string {
+	kinds := make([]string, 0, len(sinkFactories))
+	for k := range sinkFactories {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	return strings.Join(kinds, ", ")
+}
+
+// newInfluxDBSink builds an InfluxDB output from settings shaped like the
+// influxdb section.
+func newInfluxDBSink(settings map[string]interface{}) (Sink, error) {
+	v := viper.New()
+	if err := v.MergeConfigMap(settings); err != nil {
+		return nil, err
+	}
+
+	var c Config
+	if err := v.Unmarshal(&c.InfluxDB); err != nil {
+		return nil, err
+	}
+
+	return NewWriter(&c)
+}
+
+// newOutput builds an output from its settings, with the factory of its
+// type.
+func newOutput(settings map[string]interface{}) (Sink, error) {
+	kind, _ := settings["type"].(string)
+	f, ok := sinkFactories[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown type '%s', must be one of %s", kind, sinkKinds())
+	}
+
+	rest := make(map[string]interface{}, len(settings))
+	for k, v := range settings {
+		if k != "type" {
+			rest[k] = v
+		}
+	}
+
+	return f(rest)
+}
+
+// sinks are the outputs mappings select by name, the influxdb section
+// being used by mappings without an output that no route matches.
+type sinks struct {
+	influxDB   Sink
+	named      map[string]Sink
+	routes     []RouteConfiguration
+	outputs    map[string]map[string]interface{}
+	deadLetter string
+
+	// inherited are the outputs taken over from the previous sinks, as
+	// their settings didn't change.
+	inherited map[string]bool
+}
+
+// newSinks builds the outputs of config, taking over those of previous,
+// when given, whose settings are unchanged.
+func newSinks(config *Config, influxDB Sink, previous *sinks) (*sinks, error) {
+	s := &sinks{
+		influxDB:   influxDB,
+		named:      make(map[string]Sink, len(config.Outputs)),
+		routes:     config.Routes,
+		outputs:    config.Outputs,
+		deadLetter: config.MQti.DeadLetter,
+		inherited:  make(map[string]bool),
+	}
+
+	for name, settings := range config.Outputs {
+		if previous != nil {
+			if sink, ok := previous.named[name]; ok && reflect.DeepEqual(previous.outputs[name], settings) {
+				s.named[name] = sink
+				s.inherited[name] = true
+				continue
+			}
+		}
+
+		sink, err := newOutput(settings)
+		if err != nil {
+			s.closeOutputs(s.inherited)
+			return nil, fmt.Errorf("outputs.%s: %s", name, err)
+		}
+		s.named[name] = sink
+	}
+
+	var deadLetterSink Sink
+	if name := config.MQti.DeadLetter; name != "" {
+		sink, ok := s.named[strings.ToLower(name)]
+		if !ok {
+			s.closeOutputs(s.inherited)
+			return nil, fmt.Errorf("mqti.dead_letter: no output named '%s'", name)
+		}
+		deadLetterSink = sink
+	}
+	setDeadLetter(config.MQti.DeadLetter, deadLetterSink)
+
+	return s, nil
+}
+
+// changed returns whether config has other outputs, routes or dead letter
+// output than s was built from.
+func (s *sinks) changed(config *Config) bool {
+	return !reflect.DeepEqual(s.outputs, config.Outputs) || !reflect.DeepEqual(s.routes, config.Routes) ||
+		s.deadLetter != config.MQti.DeadLetter
+}
+
+// activeSinks are the outputs the workers write to, replaced when the
+// config is reloaded and closed on exit.
+var activeSinks struct {
+	sync.RWMutex
+	sinks *sinks
+}
+
+// forwardActive forwards m to the active outputs, which a reload doesn't
+// close until it is written or queued.
+func forwardActive(m *MQTTMessage) error {
+	activeSinks.RLock()
+	defer activeSinks.RUnlock()
+	return activeSinks.sinks.forward(m)
+}
+
+// reloadSinks builds the outputs of config, when they changed, and
+// switches the workers to them, closing the previous ones.  Outputs whose
+// settings didn't change are kept open.  The influxdb section only changes
+// on restart.
+func reloadSinks(config *Config) error {
+	activeSinks.RLock()
+	previous := activeSinks.sinks
+	activeSinks.RUnlock()
+	if previous == nil || !previous.changed(config) {
+		return nil
+	}
+
+	s, err := newSinks(config, previous.influxDB, previous)
+	if err != nil {
+		return err
+	}
+
+	activeSinks.Lock()
+	activeSinks.sinks = s
+	activeSinks.Unlock()
+
+	previous.closeOutputs(s.inherited)
+	return nil
+}
+
+func setActiveSinks(s *sinks) {
+	activeSinks.Lock()
+	activeSinks.sinks = s
+	activeSinks.Unlock()
+}
+
+// flushActiveSinks writes what the outputs have queued.
+func flushActiveSinks() {
+	activeSinks.Lock()
+	defer activeSinks.Unlock()
+	if activeSinks.sinks != nil {
+		activeSinks.sinks.Flush()
+	}
+}
+
+// closeActiveSinks writes what the outputs have queued before exiting.
+func closeActiveSinks() {
+	activeSinks.Lock()
+	defer activeSinks.Unlock()
+	if activeSinks.sinks != nil {
+		activeSinks.sinks.Close()
+	}
+}
+
+// defaultOutput names the influxdb section in a mapping's outputs, unless
+// an output is named that.
+const defaultOutput string = "influxdb"
+
+// delivery is a message being written to the outputs of its mapping,
+// counted as forwarded or failed once all of them are done with it, which
+// for batched outputs is after forward returns.
+type delivery struct {
+	m         *MQTTMessage
+	start     time.Time
+	remaining int32
+
+	mu     sync.Mutex
+	failed []string
+}
+
+func (d *delivery) add() {
+	atomic.AddInt32(&d.remaining, 1)
+}
+
+func (d *delivery) fail(err string) {
+	d.mu.Lock()
+	d.failed = append(d.failed, err)
+	d.mu.Unlock()
+}
+
+// output records how writing to the named output went.
+func (d *delivery) output(name string, err error) {
+	if err != nil {
+		countOutput(name, statFailed)
+		sendDeadLetter(d.m, deadLetterStageOutput, name, err)
+		d.fail(err.Error())
+	} else {
+		countOutput(name, statForwarded)
+	}
+	d.done()
+}
+
+func (d *delivery) done() {
+	if atomic.AddInt32(&d.remaining, -1) > 0 {
+		return
+	}
+
+	d.m.timings.since(StageSink, d.start)
+	d.m.timings.record(d.m.Topic())
+
+	if len(d.failed) > 0 {
+		count(d.m.Name, statFailed)
+		Log.Errorf("%s: %s", d.m.Topic(), strings.Join(d.failed, "; "))
+		return
+	}
+	count(d.m.Name, statForwarded)
+}
+
+// forward writes the point of m to every output of its mapping, or of the
+// route it matches, the message failing when any of them does.  Each
+// output's writes are counted on their own.  Only a point that can't be
+// built is returned, the outcome of the writes being counted and logged
+// once they are done.
+func (s *sinks) forward(m *MQTTMessage) error {
+	p, err := newPoint(m)
+	if err != nil {
+		stage := deadLetterStagePoint
+		if isRejected(err) {
+			stage = deadLetterStageBounds
+		}
+		sendDeadLetter(m, stage, "", err)
+		return err
+	}
+
+	d := &delivery{m: m, start: time.Now(), remaining: 1}
+	defer d.done()
+
+	names := m.outputs()
+	if m.Output == "" && len(m.Outputs) == 0 && len(s.routes) > 0 {
+		names = route(s.routes, m, p)
+	}
+
+	for _, name := range names {
+		// Output names are lowercased when decoded, as all keys are.
+		sink, ok := s.named[strings.ToLower(name)]
+		if !ok && (name == "" || strings.ToLower(name) == defaultOutput) {
+			sink, ok = s.influxDB, true
+		}
+		if !ok {
+			d.fail(fmt.Sprintf("no output named '%s'", name))
+			continue
+		}
+
+		name := name
+		d.add()
+		writePoint(sink, p, func(err error) { d.output(name, err) })
+	}
+
+	return nil
+}
+
+// Flush writes what the batched outputs have queued.
+func (s *sinks) Flush() {
+	for name, sink := range s.named {
+		if b, ok := sink.(*batchedSink); ok {
+			if err := b.Flush(context.Background()); err != nil {
+				Log.Errorf("Flushing %s failed: %s", name, err)
+			}
+		}
+	}
+}
+
+// Close flushes the batched outputs, and closes the outputs that hold
+// connections, so nothing queued is lost on exit.
+func (s *sinks) Close() {
+	s.closeOutputs(nil)
+}
+
+// closeOutputs closes the outputs not in keep.
+func (s *sinks) closeOutputs(keep map[string]bool) {
+	for name, sink := range s.named {
+		if keep[name] {
+			continue
+		}
+		if c, ok := sink.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				Log.Errorf("Closing %s failed: %s", name, err)
+			}
+		}
+	}
+}
+
+// forward builds the point of m and writes it to sink.
+func forward(sink Sink, m *MQTTMessage) error {
+	p, err := newPoint(m)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	err = sink.Write(context.Background(), []*Point{p})
+	m.timings.since(StageSink, start)
+	m.timings.record(m.Topic())
+
+	return err
+}
@@ -0,0 +1,323 @@
+package mqti
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const sparkplugNamespace string = "spBv1.0"
+
+// Sparkplug B message types, the third level of their topics.
+const (
+	sparkplugNBirth string = "NBIRTH"
+	sparkplugDBirth string = "DBIRTH"
+	sparkplugNData  string = "NDATA"
+	sparkplugDData  string = "DDATA"
+	sparkplugNDeath string = "NDEATH"
+)
+
+// Sparkplug B metric datatypes, as in sparkplug_b.proto.
+const (
+	sparkplugInt8     uint32 = 1
+	sparkplugInt16    uint32 = 2
+	sparkplugInt32    uint32 = 3
+	sparkplugInt64    uint32 = 4
+	sparkplugUInt8    uint32 = 5
+	sparkplugUInt16   uint32 = 6
+	sparkplugUInt32   uint32 = 7
+	sparkplugUInt64   uint32 = 8
+	sparkplugFloat    uint32 = 9
+	sparkplugDouble   uint32 = 10
+	sparkplugBoolean  uint32 = 11
+	sparkplugString   uint32 = 12
+	sparkplugDateTime uint32 = 13
+	sparkplugText     uint32 = 14
+	sparkplugUUID     uint32 = 15
+	sparkplugBytes    uint32 = 17
+	sparkplugFile     uint32 = 18
+)
+
+// sparkplugAliases holds the metric names of each edge node by alias, as
+// announced by its NBIRTH and DBIRTH messages, which NDATA and DDATA ones
+// may then use alone.  Aliases are unique to an edge node, its devices
+// included.
+var sparkplugAliases struct {
+	sync.Mutex
+	nodes map[string]map[uint64]string
+}
+
+// sparkplugTopic is spBv1.0/<group>/<message type>/<edge node>[/<device>].
+type sparkplugTopic struct {
+	group       string
+	messageType string
+	node        string
+	device      string
+}
+
+func parseSparkplugTopic(topic string) (sparkplugTopic, error) {
+	levels := strings.Split(topic, "/")
+	if len(levels) < 4 || len(levels) > 5 || levels[0] != sparkplugNamespace {
+		return sparkplugTopic{}, fmt.Errorf("%s is not a Sparkplug B topic", topic)
+	}
+
+	t := sparkplugTopic{group: levels[1], messageType: levels[2], node: levels[3]}
+	if len(levels) == 5 {
+		t.device = levels[4]
+	}
+	return t, nil
+}
+
+// sparkplugMetric is a metric of a Sparkplug B payload, with the value of
+// its datatype.
+type sparkplugMetric struct {
+	name      string
+	alias     uint64
+	hasAlias  bool
+	timestamp uint64
+	datatype  uint32
+	isNull    bool
+	value     interface{}
+}
+
+// decodeSparkplugPayload decodes the timestamp and metrics of a Sparkplug
+// B payload, skipping what mqti has no use for.
+func decodeSparkplugPayload(b []byte) (uint64, []sparkplugMetric, error) {
+	var timestamp uint64
+	var metrics []sparkplugMetric
+
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return 0, nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			timestamp, n = protowire.ConsumeVarint(b)
+		case num == 2 && typ == protowire.BytesType:
+			var v []byte
+			if v, n = protowire.ConsumeBytes(b); n >= 0 {
+				m, err := decodeSparkplugMetric(v)
+				if err != nil {
+					return 0, nil, err
+				}
+				metrics = append(metrics, m)
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return 0, nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+
+	return timestamp, metrics, nil
+}
+
+func decodeSparkplugMetric(b []byte) (sparkplugMetric, error) {
+	var m sparkplugMetric
+	var intValue, longValue uint64
+	var floatValue float32
+	var doubleValue float64
+	var boolValue bool
+	var bytesValue []byte
+
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return m, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var v uint64
+		var s []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var f uint32
+			f, n = protowire.ConsumeFixed32(b)
+			v = uint64(f)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			s, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return m, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch num {
+		case 1:
+			m.name = string(s)
+		case 2:
+			m.alias, m.hasAlias = v, true
+		case 3:
+			m.timestamp = v
+		case 4:
+			m.datatype = uint32(v)
+		case 7:
+			m.isNull = v != 0
+		case 10:
+			intValue = v
+		case 11:
+			longValue = v
+		case 12:
+			floatValue = math.Float32frombits(uint32(v))
+		case 13:
+			doubleValue = math.Float64frombits(v)
+		case 14:
+			boolValue = v != 0
+		case 15, 16:
+			bytesValue = s
+		}
+	}
+
+	// Signed integers are sent as their two's complement in int_value and
+	// long_value.
+	switch m.datatype {
+	case sparkplugInt8, sparkplugInt16, sparkplugInt32:
+		m.value = int64(int32(uint32(intValue)))
+	case sparkplugUInt8, sparkplugUInt16, sparkplugUInt32:
+		m.value = uint64(uint32(intValue))
+	case sparkplugInt64:
+		m.value = int64(longValue)
+	case sparkplugUInt64, sparkplugDateTime:
+		m.value = longValue
+	case sparkplugFloat:
+		m.value = floatValue
+	case sparkplugDouble:
+		m.value = doubleValue
+	case sparkplugBoolean:
+		m.value = boolValue
+	case sparkplugString, sparkplugText, sparkplugUUID:
+		m.value = string(bytesValue)
+	case sparkplugBytes, sparkplugFile:
+		m.value = base64.StdEncoding.EncodeToString(bytesValue)
+	}
+
+	return m, nil
+}
+
+// sparkplugMetrics expands a Sparkplug B message into an object per
+// metric, with its value keyed by its name and, under sparkplugMetadata,
+// its name, timestamp, the message type, and the group, edge node and
+// device of the topic.  Births record the aliases of their metrics, which
+// data messages' are resolved from; metrics that are null, of a type
+// without a single value, such as datasets, or of an alias never born are
+// left out.  Deaths forget the node's aliases, other messages give no
+// metric.
+func (m *MQTTMessage) sparkplugMetrics() ([]interface{}, error) {
+	t, err := parseSparkplugTopic(m.Topic())
+	if err != nil {
+		return nil, err
+	}
+
+	node := m.MQTT.Broker + "\x00" + t.group + "/" + t.node
+
+	switch t.messageType {
+	case sparkplugNBirth, sparkplugDBirth, sparkplugNData, sparkplugDData:
+	case sparkplugNDeath:
+		sparkplugAliases.Lock()
+		delete(sparkplugAliases.nodes, node)
+		sparkplugAliases.Unlock()
+		return []interface{}{}, nil
+	default:
+		return []interface{}{}, nil
+	}
+
+	timestamp, metrics, err := decodeSparkplugPayload(m.Payload())
+	if err != nil {
+		return nil, err
+	}
+
+	sparkplugAliases.Lock()
+	defer sparkplugAliases.Unlock()
+
+	if sparkplugAliases.nodes == nil {
+		sparkplugAliases.nodes = make(map[string]map[uint64]string)
+	}
+	aliases := sparkplugAliases.nodes[node]
+	if t.messageType == sparkplugNBirth || aliases == nil {
+		aliases = make(map[uint64]string)
+		sparkplugAliases.nodes[node] = aliases
+	}
+
+	birth := t.messageType == sparkplugNBirth || t.messageType == sparkplugDBirth
+	objects := make([]interface{}, 0, len(metrics))
+	for _, metric := range metrics {
+		if metric.hasAlias {
+			if birth && metric.name != "" {
+				aliases[metric.alias] = metric.name
+			} else if metric.name == "" {
+				metric.name = aliases[metric.alias]
+			}
+		}
+		if metric.name == "" {
+			Log.Warnf("Unknown Sparkplug B metric alias %d on %s, was the birth missed?", metric.alias, m.Topic())
+			continue
+		}
+		if metric.isNull || metric.value == nil {
+			continue
+		}
+
+		metadata := map[string]interface{}{
+			"group":        t.group,
+			"edge_node":    t.node,
+			"message_type": t.messageType,
+			"metric":       metric.name,
+			"timestamp":    timestamp,
+		}
+		if t.device != "" {
+			metadata["device"] = t.device
+		}
+		if metric.timestamp != 0 {
+			metadata["timestamp"] = metric.timestamp
+		}
+		// Metrics have a field each, as their types differ.
+		objects = append(objects, map[string]interface{}{
+			metric.name:       metric.value,
+			sparkplugMetadata: metadata,
+		})
+	}
+
+	return objects, nil
+}
+
+// sparkplugMetadata is the key of the metadata in sparkplugMetrics'
+// objects.  Metrics without a name are left out, so no metric can have it.
+const sparkplugMetadata = ""
+
+// sparkplugTags are the metadata keys that become tags.
+var sparkplugTags = []string{"group", "edge_node", "device", "metric", "message_type"}
+
+// applySparkplugMetadata moves the topic's group, edge node and device, the
+// metric's name and the message type from fields to tags, returning the
+// metric's timestamp, or the payload's, when it has one.
+func applySparkplugMetadata(fields map[string]interface{}, tags map[string]string) (time.Time, bool) {
+	metadata, _ := fields[sparkplugMetadata].(map[string]interface{})
+	delete(fields, sparkplugMetadata)
+
+	for _, k := range sparkplugTags {
+		if v, ok := metadata[k].(string); ok {
+			tags[k] = v
+		}
+	}
+
+	// Sparkplug B timestamps are milliseconds since the epoch.
+	if ms, ok := metadata["timestamp"].(float64); ok && ms > 0 {
+		return unixTime(int64(ms), int64(time.Millisecond)), true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,83 @@
+package mqti
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// testSparkplugMetric encodes a double metric, with a timestamp unless ms is 0.
+func testSparkplugMetric(name string, value float64, ms uint64) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, name)
+	if ms != 0 {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, ms)
+	}
+	b = protowire.AppendTag(b, 4, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(sparkplugDouble))
+	b = protowire.AppendTag(b, 13, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(value))
+}
+
+func TestSparkplugPoints(t *testing.T) {
+	var payload []byte
+	payload = protowire.AppendTag(payload, 1, protowire.VarintType)
+	payload = protowire.AppendVarint(payload, 1600000000000)
+	for _, metric := range [][]byte{
+		testSparkplugMetric("timestamp", 21.5, 1600000001500),
+		testSparkplugMetric("group", 3, 0),
+	} {
+		payload = protowire.AppendTag(payload, 2, protowire.BytesType)
+		payload = protowire.AppendBytes(payload, metric)
+	}
+
+	var mapping MappingConfiguration
+	mapping.MQTT.PayloadFormat = payloadFormatSparkplug
+	msg := testMessage{topic: "spBv1.0/plant/DDATA/edge1/pump", payload: payload}
+	m := newMQTTMessage(msg, mapping, "")
+
+	objects, err := m.sparkplugMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		metric string
+		value  float64
+		time   time.Time
+	}{
+		{"timestamp", 21.5, time.Unix(1600000001, 500000000)},
+		{"group", 3, time.Unix(1600000000, 0)},
+	}
+	if len(objects) != len(tests) {
+		t.Fatalf("got %d metrics, want %d", len(objects), len(tests))
+	}
+
+	for i, tt := range tests {
+		b, err := json.Marshal(objects[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		em := *m
+		em.Message = transformedMessage{msg, b}
+
+		p, err := newPoint(&em)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !p.Time.Equal(tt.time) {
+			t.Errorf("%s: got time %s, want %s", tt.metric, p.Time, tt.time)
+		}
+		if len(p.Fields) != 1 || p.Fields[tt.metric] != tt.value {
+			t.Errorf("%s: got fields %v", tt.metric, p.Fields)
+		}
+		if p.Tags["metric"] != tt.metric || p.Tags["group"] != "plant" || p.Tags["device"] != "pump" {
+			t.Errorf("%s: got tags %v", tt.metric, p.Tags)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package mqti
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const startupBufferDefaultSize int = 1000
+
+const sinkReadyRetryInterval = 2 * time.Second
+
+const (
+	startupBufferDropOldest string = "drop_oldest"
+	startupBufferDropNewest string = "drop_newest"
+)
+
+func (c startupBufferConfiguration) size() int {
+	if c.Size > 0 {
+		return c.Size
+	}
+	return startupBufferDefaultSize
+}
+
+func (c startupBufferConfiguration) overflow() (string, error) {
+	switch c.Overflow {
+	case "":
+		return startupBufferDropOldest, nil
+	case startupBufferDropOldest, startupBufferDropNewest:
+		return c.Overflow, nil
+	}
+	return "", fmt.Errorf("invalid startup_buffer overflow '%s', must be one of drop_oldest or drop_newest", c.Overflow)
+}
+
+// readier is implemented by sinks that can tell whether they accept
+// writes, e.g. by pinging their server.  Others are ready once built.
+type readier interface {
+	ready(ctx context.Context) error
+}
+
+func (i InfluxDBConnection) ready(ctx context.Context) error {
+	_, _, err := i.Ping()
+	return err
+}
+
+// ready returns why one of the outputs, InfluxDB included, isn't ready.
+func (s *sinks) ready(ctx context.Context) error {
+	if r, ok := s.influxDB.(readier); ok {
+		if err := r.ready(ctx); err != nil {
+			return fmt.Errorf("influxdb: %s", err)
+		}
+	}
+
+	names := make([]string, 0, len(s.named))
+	for name := range s.named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if r, ok := s.named[name].(readier); ok {
+			if err := r.ready(ctx); err != nil {
+				return fmt.Errorf("outputs.%s: %s", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// SinksReady blocks until every configured output is ready, then closes
+// ready.
+func SinksReady(ready chan<- struct{}) {
+	for {
+		activeSinks.RLock()
+		s := activeSinks.sinks
+		activeSinks.RUnlock()
+
+		err := fmt.Errorf("outputs not created yet")
+		if s != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), sinkReadyRetryInterval)
+			err = s.ready(ctx)
+			cancel()
+		}
+		if err != nil {
+			Log.Warnf("Outputs not ready, retrying in %s: %s", sinkReadyRetryInterval, err)
+			time.Sleep(sinkReadyRetryInterval)
+			continue
+		}
+
+		close(ready)
+		return
+	}
+}
+
+// BufferUntilReady holds messages arriving on incoming until ready is closed,
+// then releases them to outgoing in the order they were received.  Once the
+// buffer is full, messages are dropped according to the startup_buffer
+// overflow setting.
+func BufferUntilReady(incoming <-chan *MQTTMessage, outgoing chan<- *MQTTMessage, ready <-chan struct{}) {
+	var err error
+	var config *Config
+	var overflow string
+
+	config, err = GetConfig()
+	if err != nil {
+		Log.Fatal(err)
+	}
+
+	size := config.MQti.StartupBuffer.size()
+	if overflow, err = config.MQti.StartupBuffer.overflow(); err != nil {
+		Log.Fatal(err)
+	}
+
+	buffer := make([]*MQTTMessage, 0, size)
+	dropped := 0
+
+	for {
+		select {
+		case <-ready:
+			if dropped > 0 {
+				Log.Warnf("Startup buffer overflowed, %d message(s) dropped", dropped)
+			}
+			Log.Infof("Sinks ready, releasing %d buffered message(s)", len(buffer))
+			for _, m := range buffer {
+				outgoing <- m
+			}
+			return
+		case m := <-incoming:
+			if len(buffer) < size {
+				buffer = append(buffer, m)
+				continue
+			}
+
+			dropped++
+			if overflow == startupBufferDropOldest {
+				copy(buffer, buffer[1:])
+				buffer[len(buffer)-1] = m
+			}
+		}
+	}
+}
@@ -0,0 +1,866 @@
+package mqti
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Subscriber subscribes to the topic of every mapping on its broker and
+// sends matching messages to its outgoing channel.  Every goroutine it
+// starts is tied to the Subscriber and stopped by Close.
+type Subscriber struct {
+	config   *Config
+	broker   broker
+	client   MQTT.Client
+	outgoing chan<- *MQTTMessage
+
+	dynamic   map[string]MappingConfiguration
+	dynamicMu sync.Mutex
+
+	samplers   map[samplerKey]*sampler
+	samplersMu sync.Mutex
+
+	// unsubscribed counts the topics not yet confirmed subscribed since the
+	// last connect; ready is closed the first time it reaches zero.
+	unsubscribed int32
+	ready        chan struct{}
+	readyOnce    sync.Once
+
+	outage outage
+
+	// credentials is asked for the username and password on every connect,
+	// by default those of brokerCredentials.
+	credentials       CredentialsProvider
+	brokerCredentials *brokerCredentials
+
+	// certs is set when the client certificate is reloaded periodically.
+	certs *certReloader
+
+	// subscriptions and discovery are made on every connect.
+	subscriptions   []subscription
+	discovery       *DiscoveryConfiguration
+	subscriptionsMu sync.Mutex
+
+	// stale is set when Resubscribe added topics while disconnected, which a
+	// resumed session doesn't have.
+	stale int32
+
+	// unsubscribes are the topics Resubscribe removed but couldn't
+	// unsubscribe from, which onConnect does.
+	unsubscribes   map[string]bool
+	unsubscribesMu sync.Mutex
+
+	// reconnecting is set while connectWithBackoff is running.
+	reconnecting int32
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// lifecycleMu orders goroutine's wg.Add before Close's wg.Wait.
+	lifecycleMu sync.Mutex
+}
+
+// NewSubscriber subscribes the mappings of config on its default broker.
+func NewSubscriber(config *Config, outgoing chan<- *MQTTMessage) (*Subscriber, error) {
+	bs, err := config.brokers()
+	if err != nil {
+		return nil, err
+	}
+	return newSubscriber(config, bs[0], outgoing)
+}
+
+// NewSubscribers returns a Subscriber for every broker of config, all
+// sending to outgoing.
+func NewSubscribers(config *Config, outgoing chan<- *MQTTMessage) ([]*Subscriber, error) {
+	bs, err := config.brokers()
+	if err != nil {
+		return nil, err
+	}
+
+	subscribers := make([]*Subscriber, len(bs))
+	for i, b := range bs {
+		if subscribers[i], err = newSubscriber(config, b, outgoing); err != nil {
+			return nil, fmt.Errorf("mqtt broker %s: %s", b, err)
+		}
+	}
+
+	return subscribers, nil
+}
+
+func newSubscriber(config *Config, b broker, outgoing chan<- *MQTTMessage) (*Subscriber, error) {
+	if p := b.onSubscribeFailure(); !validSubscribeFailurePolicy(p) {
+		return nil, fmt.Errorf("invalid on_subscribe_failure '%s', must be one of log, reconnect or fatal", p)
+	}
+
+	opts, err := b.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	if !b.IsSet("client_id") {
+		Log.Warnf("client_id not set for MQTT broker %s, using %s, sessions won't survive a restart", b, opts.ClientID)
+	}
+
+	s := &Subscriber{
+		config:       config,
+		broker:       b,
+		outgoing:     outgoing,
+		dynamic:      make(map[string]MappingConfiguration),
+		samplers:     make(map[samplerKey]*sampler),
+		ready:        make(chan struct{}),
+		unsubscribes: make(map[string]bool),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	s.brokerCredentials = newBrokerCredentials(b)
+	s.credentials = s.brokerCredentials.get
+	opts.SetCredentialsProvider(func() (string, string) { return s.credentials() })
+
+	if b.tlsDefined() && b.tlsReloadInterval() > 0 {
+		if s.certs, err = newCertReloader(b.GetString("tls_cert"), b.GetString("tls_private_key")); err != nil {
+			return nil, err
+		}
+		opts.TLSConfig.Certificates = nil
+		opts.TLSConfig.GetClientCertificate = s.certs.getClientCertificate
+	}
+
+	opts.OnConnectionLost = s.onConnectionLost
+
+	// Connects and reconnects are driven by connect, see onConnectionLost,
+	// so that the session present flag is known when subscribing.
+	opts.AutoReconnect = false
+
+	s.client = MQTT.NewClient(opts)
+
+	return s, nil
+}
+
+// Start connects to the broker and blocks until every mapping is
+// subscribed, or ready_timeout passes.
+func (s *Subscriber) Start() error {
+	if err := s.prepare(); err != nil {
+		return err
+	}
+
+	if err := s.connect(s.client); err != nil {
+		return err
+	}
+
+	if s.certs != nil {
+		interval := s.broker.tlsReloadInterval()
+		s.goroutine(func() { s.reloadCertificates(interval) })
+	}
+
+	if topic := s.broker.metricsTopic(); len(topic) > 0 {
+		s.goroutine(func() { s.publishMetrics(topic) })
+	}
+
+	t := time.NewTimer(s.broker.readyTimeout())
+	defer t.Stop()
+
+	select {
+	case <-s.ready:
+		return nil
+	case <-t.C:
+		return fmt.Errorf("not all mappings subscribed after %s", s.broker.readyTimeout())
+	}
+}
+
+// Ready is closed once every mapping has been subscribed for the first time.
+func (s *Subscriber) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// subscribed marks one more topic as confirmed subscribed.
+func (s *Subscriber) subscribed() {
+	if atomic.AddInt32(&s.unsubscribed, -1) <= 0 {
+		s.readyOnce.Do(func() { close(s.ready) })
+	}
+}
+
+// Close disconnects from the broker and waits for every goroutine started
+// by the Subscriber to return.
+func (s *Subscriber) Close() {
+	s.lifecycleMu.Lock()
+	s.cancel()
+	s.lifecycleMu.Unlock()
+
+	s.client.Disconnect(250)
+	s.outage.stop()
+	s.wg.Wait()
+}
+
+// Client returns the underlying paho client, e.g. to publish ad-hoc
+// messages.  It is only usable while connected, and anything done with it
+// directly, such as subscribing or disconnecting, bypasses the Subscriber's
+// lifecycle management.
+func (s *Subscriber) Client() MQTT.Client {
+	return s.client
+}
+
+// goroutine runs f in a goroutine that Close waits for, or returns false
+// without running it once the Subscriber is closed.
+func (s *Subscriber) goroutine(f func()) bool {
+	s.lifecycleMu.Lock()
+	defer s.lifecycleMu.Unlock()
+
+	if s.ctx.Err() != nil {
+		return false
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		f()
+	}()
+	return true
+}
+
+// sleep waits for d and returns false if the Subscriber was closed first.
+func (s *Subscriber) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+// subscription is a topic filter subscribed on every connect.
+type subscription struct {
+	topic   string
+	qos     byte
+	handler MQTT.MessageHandler
+
+	// name and filter are the mapping's name and topic, for telling that
+	// a reload moved it to another topic.
+	name   string
+	filter string
+}
+
+// prepare builds the handler of every mapping on the broker and routes
+// messages to them before connecting, so that messages queued in a
+// persistent session, which arrive as soon as the connection is up, aren't
+// dropped before onConnect has subscribed.
+func (s *Subscriber) prepare() error {
+	s.subscriptionsMu.Lock()
+	config := s.config
+	s.subscriptionsMu.Unlock()
+
+	subscriptions, discovery, err := s.subscriptionsFor(config)
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range subscriptions {
+		addRoute(s.client, sub.topic, sub.handler)
+	}
+	if discovery != nil {
+		s.client.AddRoute(discovery.Topic, s.discoveryHandler(*discovery))
+	}
+
+	s.subscriptionsMu.Lock()
+	s.subscriptions, s.discovery = subscriptions, discovery
+	s.subscriptionsMu.Unlock()
+
+	return nil
+}
+
+// subscriptionsFor builds a subscription for every mapping of config on
+// the broker, and returns its discovery config if discovery is on it.
+func (s *Subscriber) subscriptionsFor(config *Config) ([]subscription, *DiscoveryConfiguration, error) {
+	var subscriptions []subscription
+
+	for _, m := range config.Mappings {
+		if !s.broker.serves(m) {
+			continue
+		}
+		if !m.enabled() {
+			Log.Infof("Mapping %s is disabled", m.label())
+			continue
+		}
+
+		f, err := s.messageHandler(m)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		subscriptions = append(subscriptions, subscription{m.MQTT.subscription(s.broker), m.MQTT.QoS, f, m.Name, m.MQTT.Topic})
+	}
+
+	if config.Discovery.enabled() && s.broker.serves(config.Discovery.Template) {
+		d := config.Discovery
+		return subscriptions, &d, nil
+	}
+
+	return subscriptions, nil, nil
+}
+
+// refreshCredentials takes the broker's username and password from config,
+// so credentials re-resolved on reload are used on the next connect.  Its
+// other settings only change on restart.
+func (s *Subscriber) refreshCredentials(config *Config) {
+	bs, err := config.brokers()
+	if err != nil {
+		return
+	}
+	for _, b := range bs {
+		if b.Name == s.broker.Name {
+			s.brokerCredentials.set(b)
+		}
+	}
+}
+
+// Resubscribe switches to the mappings of config on the live connection:
+// topics no longer mapped stop being handled and are unsubscribed, on the
+// next connect when disconnected, new ones subscribed, and the handlers of
+// the rest replaced, with new samplers.  Dynamic subscriptions are kept,
+// and the broker's credentials are updated for the next connect.
+//
+// A named mapping whose topic changed is migrated rather than removed and
+// added: its new topic is subscribed before the old one is unsubscribed, so
+// messages both cover aren't missed, and only the new handler sees them
+// from then on, so they aren't handled twice.  Retained messages on topics
+// the old topic covered were already handled and are skipped, and what its
+// sampler sampled so far carries over, see handOverSamplers.
+func (s *Subscriber) Resubscribe(config *Config) error {
+	oldSamplers := s.swapSamplers(make(map[samplerKey]*sampler))
+
+	subscriptions, discovery, err := s.subscriptionsFor(config)
+	if err != nil {
+		stopSamplers(s.swapSamplers(oldSamplers))
+		return err
+	}
+
+	s.refreshCredentials(config)
+
+	s.subscriptionsMu.Lock()
+	old, oldDiscovery := s.subscriptions, s.discovery
+	s.config, s.subscriptions, s.discovery = config, subscriptions, discovery
+	s.subscriptionsMu.Unlock()
+
+	s.handOverSamplers(oldSamplers)
+
+	c := s.client
+	previous := make(map[string]subscription, len(old))
+	for _, sub := range old {
+		previous[sub.topic] = sub
+	}
+	migrations := migrations(old, subscriptions)
+
+	for _, sub := range subscriptions {
+		p, ok := previous[sub.topic]
+		delete(previous, sub.topic)
+		s.dequeueUnsubscribe(sub.topic)
+
+		handler := sub.handler
+		if from, migrated := migrations[sub.topic]; migrated {
+			Log.Infof("Mapping %s moved from %s to %s", sub.name, from.topic, sub.topic)
+			// Until the next connect subscribes with the handler itself.
+			handler = skipRetained(from.filter, sub.handler)
+			addRoute(c, sub.topic, handler)
+			removeRoute(c, from.topic)
+		} else {
+			addRoute(c, sub.topic, handler)
+		}
+
+		if ok && p.qos == sub.qos {
+			continue
+		}
+		if !c.IsConnected() {
+			atomic.StoreInt32(&s.stale, 1)
+			continue
+		}
+
+		if err := mQTTSubscribeTopic(c, sub.topic, sub.qos, handler); err != nil {
+			Log.Errorf("Subscribe to %s failed: %s", sub.topic, err)
+			continue
+		}
+		Log.Infof("Subscribed to %s", sub.topic)
+	}
+
+	var removed []string
+	for topic := range previous {
+		removed = append(removed, topic)
+	}
+	if oldDiscovery != nil && (discovery == nil || discovery.Topic != oldDiscovery.Topic) {
+		removed = append(removed, oldDiscovery.Topic)
+	}
+
+	for _, topic := range removed {
+		removeRoute(c, topic)
+		if !c.IsConnected() {
+			s.queueUnsubscribe(topic)
+			continue
+		}
+		s.unsubscribe(c, topic)
+	}
+
+	if discovery != nil {
+		s.dequeueUnsubscribe(discovery.Topic)
+	}
+	if discovery != nil && (oldDiscovery == nil || discovery.Topic != oldDiscovery.Topic) && c.IsConnected() {
+		f := s.discoveryHandler(*discovery)
+		if err := mQTTSubscribeTopic(c, discovery.Topic, mQTTDefaultQoS, f); err != nil {
+			Log.Errorf("Subscribe to %s failed: %s", discovery.Topic, err)
+		}
+	} else if discovery != nil {
+		c.AddRoute(discovery.Topic, s.discoveryHandler(*discovery))
+	}
+
+	return nil
+}
+
+// migrations maps the topics of subscriptions that named mappings moved to
+// by a reload to the subscriptions they moved from.  Topics still
+// subscribed by another mapping aren't moved from.
+func migrations(old, subscriptions []subscription) map[string]subscription {
+	topics := make(map[string]bool, len(subscriptions))
+	for _, sub := range subscriptions {
+		topics[sub.topic] = true
+	}
+	byName := make(map[string]subscription)
+	for _, sub := range old {
+		if sub.name != "" && !topics[sub.topic] {
+			byName[sub.name] = sub
+		}
+	}
+
+	out := make(map[string]subscription)
+	for _, sub := range subscriptions {
+		if from, ok := byName[sub.name]; ok && sub.name != "" {
+			out[sub.topic] = from
+		}
+	}
+	return out
+}
+
+// skipRetained wraps f to drop retained messages on topics filter matches,
+// those a migrated mapping handled before on its old topic.
+func skipRetained(filter string, f MQTT.MessageHandler) MQTT.MessageHandler {
+	return func(c MQTT.Client, msg MQTT.Message) {
+		if msg.Retained() && topicMatches(filter, msg.Topic()) {
+			Log.Debugf("Ignoring retained message on %s, already handled on %s", msg.Topic(), filter)
+			return
+		}
+		f(c, msg)
+	}
+}
+
+// unsubscribe unsubscribes from topic, queueing it for the next connect
+// when that fails.
+func (s *Subscriber) unsubscribe(c MQTT.Client, topic string) {
+	if token := c.Unsubscribe(topic); token.Wait() && token.Error() != nil {
+		Log.Errorf("Unsubscribe from %s failed, retrying on reconnect: %s", topic, token.Error())
+		s.queueUnsubscribe(topic)
+		return
+	}
+	Log.Infof("Unsubscribed from %s", topic)
+}
+
+func (s *Subscriber) queueUnsubscribe(topic string) {
+	s.unsubscribesMu.Lock()
+	s.unsubscribes[topic] = true
+	s.unsubscribesMu.Unlock()
+}
+
+// dequeueUnsubscribe keeps topic subscribed, when it is mapped again
+// before the unsubscribe was made.
+func (s *Subscriber) dequeueUnsubscribe(topic string) {
+	s.unsubscribesMu.Lock()
+	delete(s.unsubscribes, topic)
+	s.unsubscribesMu.Unlock()
+}
+
+// unsubscribeQueued unsubscribes from the topics removed while
+// disconnected, which a resumed session still holds.
+func (s *Subscriber) unsubscribeQueued(c MQTT.Client) {
+	s.unsubscribesMu.Lock()
+	topics := s.unsubscribes
+	s.unsubscribes = make(map[string]bool)
+	s.unsubscribesMu.Unlock()
+
+	for topic := range topics {
+		s.unsubscribe(c, topic)
+	}
+}
+
+// connect connects to the broker once and, when connected, subscribes in
+// the background.
+func (s *Subscriber) connect(c MQTT.Client) error {
+	token := c.Connect()
+	if token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	sessionPresent := false
+	if t, ok := token.(*MQTT.ConnectToken); ok {
+		sessionPresent = t.SessionPresent()
+	}
+	Log.Infof("Connected to MQTT broker %s, session present: %t", s.broker, sessionPresent)
+
+	s.goroutine(func() { s.onConnect(c, sessionPresent) })
+	return nil
+}
+
+// onConnect subscribes every mapping.  When a persistent session was
+// resumed after every mapping had been subscribed, the broker still holds
+// the subscriptions, so they aren't made again.  The first connect always
+// subscribes, as the config may have changed since the session was made.
+func (s *Subscriber) onConnect(c MQTT.Client, sessionPresent bool) {
+	s.outage.reset()
+	s.unsubscribeQueued(c)
+
+	select {
+	case <-s.ready:
+		stale := atomic.SwapInt32(&s.stale, 0) == 1
+		if sessionPresent && !s.broker.cleanSession() && !stale {
+			Log.Infof("Session resumed on MQTT broker %s, keeping its subscriptions", s.broker)
+			return
+		}
+	default:
+	}
+
+	s.subscriptionsMu.Lock()
+	subscriptions, discovery := s.subscriptions, s.discovery
+	s.subscriptionsMu.Unlock()
+
+	topics := len(subscriptions)
+	if discovery != nil {
+		topics++
+	}
+	atomic.StoreInt32(&s.unsubscribed, int32(topics)+1)
+	defer s.subscribed()
+
+	for _, sub := range subscriptions {
+		if err := mQTTSubscribeTopic(c, sub.topic, sub.qos, sub.handler); err != nil {
+			if s.handleSubscribeFailure(c, sub.topic, sub.qos, sub.handler, err) {
+				return
+			}
+			continue
+		}
+
+		s.subscribed()
+	}
+
+	if discovery != nil {
+		s.subscribeDiscovery(c, *discovery)
+	}
+}
+
+func (s *Subscriber) messageHandler(m MappingConfiguration) (MQTT.MessageHandler, error) {
+	var err error
+	var e *execMunger
+
+	if m.MQTT.QoS > mQTTMaxQoS {
+		return nil, fmt.Errorf("invalid qos %d on %s, must be one of 0, 1 or 2", m.MQTT.QoS, m.MQTT.Topic)
+	}
+
+	if m.MQTT.Mungers.Exec.defined() {
+		if e, err = newExecMunger(m.MQTT.Mungers.Exec); err != nil {
+			return nil, err
+		}
+	}
+
+	var pb *protobufDecoder
+	if m.MQTT.PayloadFormat == payloadFormatProtobuf {
+		if pb, err = newProtobufDecoder(m.MQTT.Protobuf); err != nil {
+			return nil, err
+		}
+	}
+
+	var topicRegex *regexp.Regexp
+	if m.MQTT.TopicRegex != "" {
+		if topicRegex, err = regexp.Compile(m.MQTT.TopicRegex); err != nil {
+			return nil, fmt.Errorf("invalid topic_regex on %s: %s", m.MQTT.Topic, err)
+		}
+	}
+
+	r, err := newRoutingKeyer(m.RoutingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var sm *sampler
+	if m.MQTT.Mungers.Sample.defined() {
+		sm = s.sampler(m)
+	}
+
+	// forward applies the rules to one message and sends it.
+	forward := func(mQTTMessage *MQTTMessage) {
+		mQTTMessage.applyRules()
+		mQTTMessage.routingKey = r.key(mQTTMessage)
+
+		Log.Debugf("Match! %v", mQTTMessage.PayloadAsString())
+
+		if sm != nil {
+			sm.add(mQTTMessage)
+			return
+		}
+
+		s.send(mQTTMessage)
+	}
+
+	// handle filters, transforms and sends one message, or one element of
+	// an array payload.
+	handle := func(mQTTMessage *MQTTMessage) {
+		start := time.Now()
+		skip := mQTTMessage.shouldSkip()
+		mQTTMessage.timings.since(StageFilter, start)
+
+		if skip {
+			count(m.Name, statSkipped)
+			Log.Debugf("No match! %v", mQTTMessage.PayloadAsString())
+			return
+		}
+
+		if e == nil {
+			forward(mQTTMessage)
+			return
+		}
+
+		// The command runs in a goroutine of its own, so that it doesn't
+		// hold up paho's handler, and with it every other subscription,
+		// but only once one of exec's concurrency slots is free.
+		if !e.acquire(s.ctx) {
+			return
+		}
+		started := s.goroutine(func() {
+			defer e.release()
+
+			start := time.Now()
+			transformed := e.apply(mQTTMessage)
+			if transformed == nil {
+				count(m.Name, statSkipped)
+				Log.Debugf("Dropped by exec %s", e.config.Mode)
+				return
+			}
+			transformed.timings.since(StageTransform, start)
+
+			forward(transformed)
+		})
+		if !started {
+			e.release()
+		}
+	}
+
+	endpoint := s.broker.endpoint()
+
+	return func(client MQTT.Client, msg MQTT.Message) {
+		mQTTMessage := newMQTTMessage(msg, m, endpoint)
+		count(m.Name, statReceived)
+
+		if msg.Retained() && m.MQTT.IgnoreRetained {
+			count(m.Name, statSkipped)
+			Log.Debugf("Ignoring retained message on %s", msg.Topic())
+			return
+		}
+
+		if topicRegex != nil && !topicRegex.MatchString(msg.Topic()) {
+			count(m.Name, statSkipped)
+			Log.Debugf("Ignoring %s, not matching topic_regex", msg.Topic())
+			return
+		}
+
+		dm, err := mQTTMessage.decode(pb)
+		if err != nil {
+			count(m.Name, statFailed)
+			Log.Errorf("Decoding payload failed: %s", err)
+			sendDeadLetter(mQTTMessage, deadLetterStagePoint, "", err)
+			return
+		}
+
+		for _, em := range dm.split() {
+			handle(em)
+		}
+	}, nil
+}
+
+// send passes m on to the outgoing channel unless the Subscriber is closed.
+func (s *Subscriber) send(m *MQTTMessage) {
+	select {
+	case s.outgoing <- m:
+	case <-s.ctx.Done():
+	}
+}
+
+func mQTTSubscribeTopic(c MQTT.Client, topic string, qos byte, f MQTT.MessageHandler) error {
+	token := c.Subscribe(topic, qos, f)
+	token.Wait()
+	if token.Error() != nil {
+		return token.Error()
+	}
+
+	// A subscription the broker refused is only reported in the SUBACK's
+	// return code, not as an error.
+	if st, ok := token.(*MQTT.SubscribeToken); ok && st.Result()[topic] == mQTTSubackFailure {
+		return fmt.Errorf("broker rejected the subscription to %s", topic)
+	}
+
+	if strings.HasPrefix(topic, "$queue/") {
+		addRoute(c, topic, f)
+	}
+
+	return nil
+}
+
+// addRoute routes messages matching the subscription topic to f.  paho only
+// knows to route $share subscriptions by the underlying topic, messages of
+// $queue ones would otherwise go unhandled.
+func addRoute(c MQTT.Client, topic string, f MQTT.MessageHandler) {
+	c.AddRoute(strings.TrimPrefix(topic, "$queue/"), f)
+}
+
+// removeRoute stops handling messages on topic.  paho can't remove a
+// route, so it is replaced by one that drops them.
+func removeRoute(c MQTT.Client, topic string) {
+	addRoute(c, topic, func(MQTT.Client, MQTT.Message) {})
+}
+
+// retrySubscribe keeps trying to subscribe to topic for as long as the
+// client stays connected.  A lost connection ends the loop, as onConnect
+// will subscribe again once reconnected.
+func (s *Subscriber) retrySubscribe(c MQTT.Client, topic string, qos byte, f MQTT.MessageHandler) {
+	for c.IsConnected() {
+		if !s.sleep(mQTTSubscribeRetryInterval) {
+			return
+		}
+
+		if err := mQTTSubscribeTopic(c, topic, qos, f); err != nil {
+			Log.Errorf("Subscribe to %s failed, retrying in %s: %s", topic, mQTTSubscribeRetryInterval, err)
+			continue
+		}
+
+		Log.Infof("Subscribed to %s", topic)
+		s.subscribed()
+		return
+	}
+}
+
+// reconnect tears down the connection and connects again from scratch,
+// which causes onConnect to resubscribe every mapping.
+func (s *Subscriber) reconnect(c MQTT.Client) {
+	c.Disconnect(250)
+	s.connectWithBackoff(c)
+}
+
+// connectWithBackoff connects, retrying with exponential backoff until it
+// succeeds, the Subscriber is closed or reconnect_max_retries is exhausted,
+// which is fatal.  Only one reconnect loop runs at a time.
+func (s *Subscriber) connectWithBackoff(c MQTT.Client) {
+	if !atomic.CompareAndSwapInt32(&s.reconnecting, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&s.reconnecting, 0)
+
+	b := newBackoff(s.broker.reconnectInitialInterval(), s.broker.reconnectMaxInterval())
+	max := s.broker.reconnectMaxRetries()
+
+	for retries := 0; s.ctx.Err() == nil; retries++ {
+		err := s.connect(c)
+		if err == nil {
+			return
+		}
+
+		if max > 0 && retries+1 >= max {
+			Log.Fatalf("Reconnect failed %d times, giving up: %s", max, err)
+		}
+
+		d := b.duration()
+		Log.Errorf("Reconnect failed, retrying in %s: %s", d, err)
+		if !s.sleep(d) {
+			return
+		}
+	}
+}
+
+// handleSubscribeFailure applies the configured on_subscribe_failure policy
+// and returns true when the remaining subscriptions should be abandoned.
+func (s *Subscriber) handleSubscribeFailure(c MQTT.Client, topic string, qos byte, f MQTT.MessageHandler, err error) bool {
+	switch s.broker.onSubscribeFailure() {
+	case subscribeFailureFatal:
+		Log.Fatalf("Subscribe to %s failed: %s", topic, err)
+	case subscribeFailureReconnect:
+		Log.Errorf("Subscribe to %s failed, reconnecting: %s", topic, err)
+		s.goroutine(func() { s.reconnect(c) })
+		return true
+	default:
+		Log.Errorf("Subscribe to %s failed, retrying in %s: %s", topic, mQTTSubscribeRetryInterval, err)
+		s.goroutine(func() { s.retrySubscribe(c, topic, qos, f) })
+	}
+
+	return false
+}
+
+// MQTTSubscribe subscribes every mapping, on every broker, sending matching
+// messages to incoming, and blocks until SIGINT or SIGTERM is received.
+// SIGHUP reloads the mappings from the config file, and SIGUSR1 flushes
+// the batching outputs with mqti.flush_signal.
+func MQTTSubscribe(incoming chan *MQTTMessage) {
+	config, err := GetConfig()
+	if err != nil {
+		Log.Fatal(err)
+	}
+
+	subscribers, err := NewSubscribers(config, incoming)
+	if err != nil {
+		Log.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for _, s := range subscribers {
+		wg.Add(1)
+		go func(s *Subscriber) {
+			defer wg.Done()
+			if err := s.Start(); err != nil {
+				Log.Fatalf("mqtt broker %s: %s", s.broker, err)
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	watchConfig(subscribers)
+
+	done := make(chan struct{})
+	if d := config.MQti.SecretsRefreshInterval; d > 0 {
+		go refreshSecrets(subscribers, d, done)
+	}
+
+	cs := make(chan os.Signal, 1)
+	signal.Notify(cs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	if config.MQti.FlushSignal {
+		signal.Notify(cs, syscall.SIGUSR1)
+	}
+	for sig := range cs {
+		if sig == syscall.SIGUSR1 {
+			Log.Info("SIGUSR1 received, flushing outputs")
+			flushActiveSinks()
+			continue
+		}
+		if sig != syscall.SIGHUP {
+			break
+		}
+		Log.Info("SIGHUP received, reloading config")
+		reloadConfig(subscribers)
+	}
+
+	Log.Error("signal received, exiting")
+	close(done)
+	for _, s := range subscribers {
+		s.Close()
+	}
+	closeActiveSinks()
+	os.Exit(0)
+}
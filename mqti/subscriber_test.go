@@ -0,0 +1,215 @@
+package mqti
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ashmckenzie/go-mqti/mqti/mqtitest"
+	"go.uber.org/goleak"
+)
+
+// testConfig maps every topic on broker b, with nothing else configured.
+func testConfig(b *mqtitest.Broker, topics ...string) *Config {
+	mappings := make([]MappingConfiguration, len(topics))
+	for i, topic := range topics {
+		mappings[i].MQTT.Topic = topic
+	}
+
+	return &Config{
+		MQTT:     map[string]interface{}{"host": b.Host, "port": b.Port, "client_id": "mqtitest"},
+		Mappings: mappings,
+	}
+}
+
+func newTestSubscriber(t *testing.T, config *Config, outgoing chan<- *MQTTMessage) *Subscriber {
+	t.Helper()
+
+	subscribers, err := NewSubscribers(config, outgoing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return subscribers[0]
+}
+
+func TestSubscriberCloseStopsGoroutines(t *testing.T) {
+	b := mqtitest.StartBroker(t)
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	config := testConfig(b, "sensors/+/temperature")
+	config.MQTT.(map[string]interface{})["metrics_topic"] = "mqti/metrics"
+
+	for i := 0; i < 5; i++ {
+		s := newTestSubscriber(t, config, make(chan *MQTTMessage))
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+	}
+}
+
+// TestSubscriberGoroutineAfterClose races goroutine against Close, which
+// must never start a goroutine it doesn't wait for.
+func TestSubscriberGoroutineAfterClose(t *testing.T) {
+	b := mqtitest.StartBroker(t)
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	for i := 0; i < 100; i++ {
+		s := newTestSubscriber(t, testConfig(b), make(chan *MQTTMessage))
+
+		started := make(chan struct{})
+		go func() {
+			defer close(started)
+			s.goroutine(func() { <-s.ctx.Done() })
+		}()
+		s.Close()
+		<-started
+	}
+}
+
+// receive waits for a message on outgoing, publishing topic again until one
+// arrives so messages sent while resubscribing aren't missed.
+func receive(t *testing.T, b *mqtitest.Broker, topic string, outgoing <-chan *MQTTMessage) *MQTTMessage {
+	t.Helper()
+
+	timeout := time.After(10 * time.Second)
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+
+	for {
+		if err := b.Publish(topic, []byte(`{"temperature": 21.5}`), false, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case m := <-outgoing:
+			return m
+		case <-tick.C:
+		case <-timeout:
+			t.Fatalf("no message on %s", topic)
+		}
+	}
+}
+
+// drain discards the messages waiting on outgoing.
+func drain(outgoing <-chan *MQTTMessage) {
+	for {
+		select {
+		case <-outgoing:
+		case <-time.After(200 * time.Millisecond):
+			return
+		}
+	}
+}
+
+func TestSubscriberForwardsMessages(t *testing.T) {
+	b := mqtitest.StartBroker(t)
+
+	outgoing := make(chan *MQTTMessage, 16)
+	s := newTestSubscriber(t, testConfig(b, "sensors/+/temperature"), outgoing)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	m := receive(t, b, "sensors/kitchen/temperature", outgoing)
+	if m.Topic() != "sensors/kitchen/temperature" {
+		t.Errorf("got a message on %s", m.Topic())
+	}
+	if m.MQTT.Topic != "sensors/+/temperature" {
+		t.Errorf("got a message of mapping %s", m.MQTT.Topic)
+	}
+}
+
+func TestSubscriberReconnects(t *testing.T) {
+	b := mqtitest.StartBroker(t)
+
+	config := testConfig(b, "sensors/+/temperature")
+	config.MQTT.(map[string]interface{})["reconnect_initial_interval"] = "100ms"
+
+	outgoing := make(chan *MQTTMessage, 16)
+	s := newTestSubscriber(t, config, outgoing)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	receive(t, b, "sensors/kitchen/temperature", outgoing)
+
+	cl, ok := b.Clients.Get("mqtitest")
+	if !ok {
+		t.Fatal("mqti isn't connected")
+	}
+	cl.Stop(errors.New("mqtitest: dropped"))
+
+	receive(t, b, "sensors/kitchen/temperature", outgoing)
+	if !s.Client().IsConnected() {
+		t.Error("not connected after receiving")
+	}
+}
+
+func TestSubscriberResubscribes(t *testing.T) {
+	b := mqtitest.StartBroker(t)
+
+	outgoing := make(chan *MQTTMessage, 16)
+	s := newTestSubscriber(t, testConfig(b, "sensors/+/temperature"), outgoing)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Resubscribe(testConfig(b, "sensors/+/humidity")); err != nil {
+		t.Fatal(err)
+	}
+
+	m := receive(t, b, "sensors/kitchen/humidity", outgoing)
+	if m.MQTT.Topic != "sensors/+/humidity" {
+		t.Errorf("got a message of mapping %s", m.MQTT.Topic)
+	}
+
+	// The removed mapping's messages are no longer handled.
+	if err := b.Publish("sensors/kitchen/temperature", []byte(`{"temperature": 21.5}`), false, 0); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-outgoing:
+		if m.MQTT.Topic == "sensors/+/temperature" {
+			t.Errorf("got a message of the removed mapping on %s", m.Topic())
+		}
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestSubscriberMigratesRenamedTopic(t *testing.T) {
+	b := mqtitest.StartBroker(t)
+
+	config := testConfig(b, "sensors/+/temperature")
+	config.Mappings[0].Name = "sensors"
+
+	outgoing := make(chan *MQTTMessage, 16)
+	s := newTestSubscriber(t, config, outgoing)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := b.Publish("sensors/kitchen/temperature", []byte(`{"temperature": 21.5}`), true, 0); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, b, "sensors/kitchen/temperature", outgoing)
+	drain(outgoing)
+
+	migrated := testConfig(b, "sensors/#")
+	migrated.Mappings[0].Name = "sensors"
+	if err := s.Resubscribe(migrated); err != nil {
+		t.Fatal(err)
+	}
+
+	m := receive(t, b, "sensors/kitchen/humidity", outgoing)
+	if m.Retained() {
+		t.Errorf("got the retained message on %s again", m.Topic())
+	}
+	if m.MQTT.Topic != "sensors/#" {
+		t.Errorf("got a message of mapping %s", m.MQTT.Topic)
+	}
+}
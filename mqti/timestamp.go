@@ -0,0 +1,167 @@
+package mqti
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// Layouts of payload timestamps besides Go time layouts.
+const (
+	timestampLayoutRFC3339 string = "rfc3339"
+	timestampLayoutUnix    string = "unix"
+	timestampLayoutUnixMs  string = "unix_ms"
+	timestampLayoutUnixUs  string = "unix_us"
+	timestampLayoutUnixNs  string = "unix_ns"
+)
+
+// TimestampConfiguration takes the time of points from the payload's
+// Field rather than their arrival, for devices that buffer readings
+// before sending them.  Layout is one of rfc3339, unix, unix_ms, unix_us
+// or unix_ns, or a Go time layout such as "2006-01-02 15:04:05".  Without
+// it numbers are read as unix seconds and strings as RFC 3339.
+type TimestampConfiguration struct {
+	Field  string
+	Layout string
+}
+
+func (c TimestampConfiguration) defined() bool {
+	return len(c.Field) > 0
+}
+
+// unixLayoutScale returns the nanoseconds of a unit of a unix layout.
+func unixLayoutScale(layout string) (int64, bool) {
+	switch layout {
+	case timestampLayoutUnix:
+		return int64(time.Second), true
+	case timestampLayoutUnixMs:
+		return int64(time.Millisecond), true
+	case timestampLayoutUnixUs:
+		return int64(time.Microsecond), true
+	case timestampLayoutUnixNs:
+		return 1, true
+	}
+	return 0, false
+}
+
+// unixTime returns the time n units of scale nanoseconds after the epoch,
+// in integers so unix_us and unix_ns timestamps keep every digit.
+func unixTime(n, scale int64) time.Time {
+	perSecond := int64(time.Second) / scale
+	return time.Unix(n/perSecond, n%perSecond*scale)
+}
+
+// parse returns the time of v, a value of the field.
+func (c TimestampConfiguration) parse(v interface{}) (time.Time, error) {
+	layout := c.Layout
+
+	if n, ok := v.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			v = i
+		} else if f, err := n.Float64(); err == nil {
+			v = f
+		} else {
+			return time.Time{}, err
+		}
+	}
+	if s, ok := v.(string); ok {
+		if _, unix := unixLayoutScale(layout); !unix {
+			if layout == "" || layout == timestampLayoutRFC3339 {
+				return time.Parse(time.RFC3339Nano, s)
+			}
+			return time.Parse(layout, s)
+		}
+	}
+
+	switch v.(type) {
+	case int64, uint64, float64, string:
+	default:
+		return time.Time{}, fmt.Errorf("unsupported timestamp %v", v)
+	}
+
+	if layout == "" {
+		layout = timestampLayoutUnix
+	}
+	scale, ok := unixLayoutScale(layout)
+	if !ok {
+		return time.Time{}, fmt.Errorf("number %v with layout '%s'", v, layout)
+	}
+
+	switch v := v.(type) {
+	case int64:
+		return unixTime(v, scale), nil
+	case uint64:
+		if v > math.MaxInt64 {
+			return time.Time{}, fmt.Errorf("timestamp %d out of range", v)
+		}
+		return unixTime(int64(v), scale), nil
+	case float64:
+		return unixTimeFloat(v, scale), nil
+	}
+
+	if n, err := strconv.ParseInt(v.(string), 10, 64); err == nil {
+		return unixTime(n, scale), nil
+	}
+	f, err := strconv.ParseFloat(v.(string), 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return unixTimeFloat(f, scale), nil
+}
+
+// unixTimeFloat is unixTime of a number with a fraction, e.g. seconds with
+// milliseconds, exact to what a float64 holds.
+func unixTimeFloat(n float64, scale int64) time.Time {
+	if n == math.Trunc(n) && math.Abs(n) < 1<<63 {
+		return unixTime(int64(n), scale)
+	}
+	sec, frac := math.Modf(n * float64(scale) / float64(time.Second))
+	return time.Unix(int64(sec), int64(frac*float64(time.Second)))
+}
+
+// apply returns the time in fields, removing its field, and false when
+// the field isn't there.  A number is read from m's payload, as fields
+// hold JSON numbers as float64, which rounds unix_us and unix_ns ones.
+func (c TimestampConfiguration) apply(m *MQTTMessage, fields map[string]interface{}) (time.Time, bool, error) {
+	v, ok := fields[c.Field]
+	if !ok || v == nil {
+		return time.Time{}, false, nil
+	}
+	if _, isFloat := v.(float64); isFloat {
+		if n, ok := m.jSONNumber(c.Field); ok {
+			v = n
+		}
+	}
+
+	t, err := c.parse(v)
+	if err != nil {
+		return t, false, fmt.Errorf("timestamp %s: %s", c.Field, err)
+	}
+
+	delete(fields, c.Field)
+	return t, true, nil
+}
+
+// jSONNumber returns the number named name in the payload as it was
+// written, at its mqtt.fields path or else at the top level of the
+// payload, and false when there is no number there.
+func (m MQTTMessage) jSONNumber(name string) (json.Number, bool) {
+	if path, ok := m.MQTT.Fields[name]; ok {
+		r := gjson.GetBytes(m.Payload(), path)
+		return json.Number(r.Raw), r.Type == gjson.Number
+	}
+
+	var top map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(m.Payload()))
+	d.UseNumber()
+	if err := d.Decode(&top); err != nil {
+		return "", false
+	}
+	n, ok := top[name].(json.Number)
+	return n, ok
+}
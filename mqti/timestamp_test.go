@@ -0,0 +1,118 @@
+package mqti
+
+import (
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// testMessage is a received MQTT message of topic and payload.
+type testMessage struct {
+	MQTT.Message
+	topic   string
+	payload []byte
+}
+
+func (m testMessage) Topic() string   { return m.topic }
+func (m testMessage) Payload() []byte { return m.payload }
+func (m testMessage) Retained() bool  { return false }
+
+func TestTimestampApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		layout  string
+		payload string
+		want    time.Time
+		wantErr bool
+	}{
+		{
+			name:    "unix_ns JSON number",
+			layout:  timestampLayoutUnixNs,
+			payload: `{"ts": 1600000000123456789, "value": 1}`,
+			want:    time.Unix(1600000000, 123456789),
+		},
+		{
+			name:    "unix_us JSON number",
+			layout:  timestampLayoutUnixUs,
+			payload: `{"ts": 1600000000123456, "value": 1}`,
+			want:    time.Unix(1600000000, 123456000),
+		},
+		{
+			name:    "unix_ns string",
+			layout:  timestampLayoutUnixNs,
+			payload: `{"ts": "1600000000123456789", "value": 1}`,
+			want:    time.Unix(1600000000, 123456789),
+		},
+		{
+			name:    "unix seconds with a fraction",
+			layout:  timestampLayoutUnix,
+			payload: `{"ts": 1600000000.5, "value": 1}`,
+			want:    time.Unix(1600000000, 500000000),
+		},
+		{
+			name:    "unix_ms negative",
+			layout:  timestampLayoutUnixMs,
+			payload: `{"ts": -1500, "value": 1}`,
+			want:    time.Unix(-1, -500000000),
+		},
+		{
+			name:    "number without a layout is unix seconds",
+			payload: `{"ts": 1600000000, "value": 1}`,
+			want:    time.Unix(1600000000, 0),
+		},
+		{
+			name:    "RFC 3339 without a layout",
+			payload: `{"ts": "2020-09-13T12:26:40.123456789Z", "value": 1}`,
+			want:    time.Date(2020, 9, 13, 12, 26, 40, 123456789, time.UTC),
+		},
+		{
+			name:    "Go layout",
+			layout:  "2006-01-02 15:04:05",
+			payload: `{"ts": "2020-09-13 12:26:40", "value": 1}`,
+			want:    time.Date(2020, 9, 13, 12, 26, 40, 0, time.UTC),
+		},
+		{
+			name:    "number with a Go layout",
+			layout:  "2006-01-02 15:04:05",
+			payload: `{"ts": 1600000000, "value": 1}`,
+			wantErr: true,
+		},
+		{
+			name:    "not a timestamp",
+			layout:  timestampLayoutUnixNs,
+			payload: `{"ts": true, "value": 1}`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mapping MappingConfiguration
+			mapping.MQTT.Timestamp = TimestampConfiguration{Field: "ts", Layout: tt.layout}
+			m := newMQTTMessage(testMessage{topic: "sensors/1", payload: []byte(tt.payload)}, mapping, "")
+
+			fields, err := m.PayloadAsJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, ok, err := mapping.MQTT.Timestamp.apply(m, fields)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %s, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok || !got.Equal(tt.want) {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if _, ok := fields["ts"]; ok {
+				t.Error("timestamp field not removed")
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package mqti
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/timestreamwrite"
+	"github.com/spf13/viper"
+)
+
+const (
+	// timestreamMaxRecords is the most records one WriteRecords call takes.
+	timestreamMaxRecords           int = 100
+	timestreamDefaultFlushInterval     = time.Second
+)
+
+type timestreamConfiguration struct {
+	Region  string
+	Profile string
+	// Database and Table default to the point's database and measurement.
+	Database string
+	Table    string
+	// Dimensions maps dimension names to the point tags they take their
+	// values from, only those being written.  All tags are written when
+	// empty.
+	Dimensions    map[string]string
+	BatchSize     int           `mapstructure:"batch_size"`
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+}
+
+// timestreamSink writes every point as one multi-measure record of its
+// measurement, the fields being its measures and the tags its dimensions.
+// Credentials come from the AWS SDK's default chain: the environment, the
+// shared files or the instance's role.
+type timestreamSink struct {
+	config timestreamConfiguration
+	client *timestreamwrite.TimestreamWrite
+}
+
+type timestreamRecord struct {
+	database string
+	table    string
+	record   *timestreamwrite.Record
+}
+
+func newTimestreamSink(settings map[string]interface{}) (Sink, error) {
+	v := viper.New()
+	if err := v.MergeConfigMap(settings); err != nil {
+		return nil, err
+	}
+
+	var c timestreamConfiguration
+	if err := v.Unmarshal(&c); err != nil {
+		return nil, err
+	}
+	if c.BatchSize <= 0 || c.BatchSize > timestreamMaxRecords {
+		c.BatchSize = timestreamMaxRecords
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = timestreamDefaultFlushInterval
+	}
+
+	opts := session.Options{Profile: c.Profile, SharedConfigState: session.SharedConfigEnable}
+	if c.Region != "" {
+		opts.Config.Region = aws.String(c.Region)
+	}
+	sess, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &timestreamSink{config: c, client: timestreamwrite.New(sess)}
+
+	return newBatchedSink(s, c.BatchSize, c.FlushInterval), nil
+}
+
+// measureValue returns a field's value as Timestream takes it, and its
+// type.
+func measureValue(v interface{}) (string, string) {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), timestreamwrite.MeasureValueTypeDouble
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32), timestreamwrite.MeasureValueTypeDouble
+	case int:
+		return strconv.Itoa(v), timestreamwrite.MeasureValueTypeBigint
+	case int64:
+		return strconv.FormatInt(v, 10), timestreamwrite.MeasureValueTypeBigint
+	case bool:
+		return strconv.FormatBool(v), timestreamwrite.MeasureValueTypeBoolean
+	}
+	return fmt.Sprint(v), timestreamwrite.MeasureValueTypeVarchar
+}
+
+func (s *timestreamSink) encode(p *Point) (interface{}, error) {
+	r := timestreamRecord{database: s.config.Database, table: s.config.Table}
+	if r.database == "" {
+		r.database = p.Database
+	}
+	if r.table == "" {
+		r.table = p.Measurement
+	}
+	if r.database == "" {
+		return nil, fmt.Errorf("%s: no database, set it on the output or the mapping", p.Measurement)
+	}
+
+	var dimensions []*timestreamwrite.Dimension
+	if len(s.config.Dimensions) == 0 {
+		for k, v := range p.Tags {
+			dimensions = append(dimensions, &timestreamwrite.Dimension{Name: aws.String(k), Value: aws.String(v)})
+		}
+	} else {
+		for name, key := range s.config.Dimensions {
+			if v, ok := p.Tags[key]; ok {
+				dimensions = append(dimensions, &timestreamwrite.Dimension{Name: aws.String(name), Value: aws.String(v)})
+			}
+		}
+	}
+
+	measures := make([]*timestreamwrite.MeasureValue, 0, len(p.Fields))
+	for k, v := range p.Fields {
+		value, kind := measureValue(v)
+		measures = append(measures, &timestreamwrite.MeasureValue{Name: aws.String(k), Value: aws.String(value), Type: aws.String(kind)})
+	}
+
+	t := p.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	r.record = &timestreamwrite.Record{
+		Dimensions:       dimensions,
+		MeasureName:      aws.String(p.Measurement),
+		MeasureValueType: aws.String(timestreamwrite.MeasureValueTypeMulti),
+		MeasureValues:    measures,
+		Time:             aws.String(strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)),
+		TimeUnit:         aws.String(timestreamwrite.TimeUnitMilliseconds),
+	}
+
+	return r, nil
+}
+
+// writeBatch writes a batch of records, a call per table and batch_size
+// records.  The SDK retries what may pass.
+func (s *timestreamSink) writeBatch(ctx context.Context, batch []interface{}) error {
+	type table struct{ database, table string }
+	tables := make(map[table][]*timestreamwrite.Record)
+	for _, r := range batch {
+		r := r.(timestreamRecord)
+		t := table{r.database, r.table}
+		tables[t] = append(tables[t], r.record)
+	}
+
+	for t, records := range tables {
+		for len(records) > 0 {
+			n := s.config.BatchSize
+			if n > len(records) {
+				n = len(records)
+			}
+			_, err := s.client.WriteRecordsWithContext(ctx, &timestreamwrite.WriteRecordsInput{
+				DatabaseName: aws.String(t.database),
+				TableName:    aws.String(t.table),
+				Records:      records[:n],
+			})
+			if err != nil {
+				return fmt.Errorf("%s.%s: %s", t.database, t.table, err)
+			}
+			records = records[n:]
+		}
+	}
+
+	return nil
+}
@@ -1,6 +1,11 @@
 package mqti
 
-import "crypto/tls"
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
 
 // NewTLSConfig ...
 func NewTLSConfig(certFile, keyFile string) *tls.Config {
@@ -17,3 +22,68 @@ func NewTLSConfig(certFile, keyFile string) *tls.Config {
 		Certificates:       []tls.Certificate{cert},
 	}
 }
+
+// NewCertPool returns a pool of the PEM encoded CA certificates in caFile,
+// to verify a server signed by a private CA.
+func NewCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM encoded certificates in %s", caFile)
+	}
+
+	return pool, nil
+}
+
+// TLSVersion maps a TLS version, e.g. 1.2, to its crypto/tls ID.
+func TLSVersion(v string) (uint16, error) {
+	switch v {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version '%s', must be one of 1.0, 1.1, 1.2 or 1.3", v)
+}
+
+// CipherSuites maps TLS 1.2 cipher suite names, as named in crypto/tls, to
+// their IDs.  Only suites Go considers secure are accepted.  TLS 1.3 suites
+// are rejected as Go does not allow them to be configured.
+func CipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]*tls.CipherSuite)
+	for _, s := range tls.CipherSuites() {
+		known[s.Name] = s
+	}
+
+	ids := make([]uint16, 0, len(names))
+
+	for _, name := range names {
+		s, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure TLS cipher suite '%s'", name)
+		}
+		if !supportsTLS12(s) {
+			return nil, fmt.Errorf("TLS cipher suite '%s' is TLS 1.3 only and can't be configured", name)
+		}
+		ids = append(ids, s.ID)
+	}
+
+	return ids, nil
+}
+
+func supportsTLS12(s *tls.CipherSuite) bool {
+	for _, v := range s.SupportedVersions {
+		if v == tls.VersionTLS12 {
+			return true
+		}
+	}
+	return false
+}
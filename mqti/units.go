@@ -0,0 +1,136 @@
+package mqti
+
+import (
+	"fmt"
+	"strings"
+)
+
+// unit is a unit of a dimension, converted to the dimension's base unit
+// as value*scale + offset.
+type unit struct {
+	dimension string
+	scale     float64
+	offset    float64
+}
+
+// units are the units conversions know, by lowercase name.
+var units = map[string]unit{
+	"celsius":    {"temperature", 1, 0},
+	"fahrenheit": {"temperature", 5.0 / 9, -32 * 5.0 / 9},
+	"kelvin":     {"temperature", 1, -273.15},
+
+	"pa":   {"pressure", 1, 0},
+	"hpa":  {"pressure", 100, 0},
+	"kpa":  {"pressure", 1000, 0},
+	"mbar": {"pressure", 100, 0},
+	"bar":  {"pressure", 100000, 0},
+	"psi":  {"pressure", 6894.757293168, 0},
+	"inhg": {"pressure", 3386.389, 0},
+	"mmhg": {"pressure", 133.322387415, 0},
+	"atm":  {"pressure", 101325, 0},
+
+	"mm": {"length", 0.001, 0},
+	"cm": {"length", 0.01, 0},
+	"m":  {"length", 1, 0},
+	"km": {"length", 1000, 0},
+	"in": {"length", 0.0254, 0},
+	"ft": {"length", 0.3048, 0},
+	"mi": {"length", 1609.344, 0},
+
+	"mps":   {"speed", 1, 0},
+	"kmh":   {"speed", 1000.0 / 3600, 0},
+	"mph":   {"speed", 1609.344 / 3600, 0},
+	"knots": {"speed", 1852.0 / 3600, 0},
+
+	"g":  {"mass", 0.001, 0},
+	"kg": {"mass", 1, 0},
+	"lb": {"mass", 0.45359237, 0},
+	"oz": {"mass", 0.028349523125, 0},
+
+	"ml":  {"volume", 0.001, 0},
+	"l":   {"volume", 1, 0},
+	"m3":  {"volume", 1000, 0},
+	"gal": {"volume", 3.785411784, 0},
+
+	"w":  {"power", 1, 0},
+	"kw": {"power", 1000, 0},
+
+	"j":   {"energy", 1, 0},
+	"wh":  {"energy", 3600, 0},
+	"kwh": {"energy", 3600000, 0},
+}
+
+// ConversionConfiguration converts a numeric field From a unit To another
+// of the same dimension, e.g. fahrenheit to celsius or psi to kpa, then
+// multiplies it by Multiply, when set, and adds Offset.
+type ConversionConfiguration struct {
+	From     string
+	To       string
+	Multiply float64
+	Offset   float64
+}
+
+// validate returns why c can't be applied, if it can't.
+func (c ConversionConfiguration) validate() error {
+	if (c.From == "") != (c.To == "") {
+		return fmt.Errorf("from and to must be set together")
+	}
+	if c.From == "" {
+		return nil
+	}
+
+	from, ok := units[strings.ToLower(c.From)]
+	if !ok {
+		return fmt.Errorf("unknown unit '%s'", c.From)
+	}
+	to, ok := units[strings.ToLower(c.To)]
+	if !ok {
+		return fmt.Errorf("unknown unit '%s'", c.To)
+	}
+	if from.dimension != to.dimension {
+		return fmt.Errorf("can't convert %s, a %s, to %s, a %s", c.From, from.dimension, c.To, to.dimension)
+	}
+	return nil
+}
+
+func (c ConversionConfiguration) apply(v float64) float64 {
+	if c.From != "" {
+		from, to := units[strings.ToLower(c.From)], units[strings.ToLower(c.To)]
+		v = (v*from.scale + from.offset - to.offset) / to.scale
+	}
+	if c.Multiply != 0 {
+		v *= c.Multiply
+	}
+	return v + c.Offset
+}
+
+// convertFields applies the conversion of each field in convert, which
+// makes it a float.  Fields not in the payload are ignored, names match
+// ignoring case.
+func convertFields(convert map[string]ConversionConfiguration, fields map[string]interface{}) error {
+	for name, c := range convert {
+		k, ok := fieldKey(fields, name)
+		if !ok {
+			continue
+		}
+		v := fields[k]
+
+		if err := c.validate(); err != nil {
+			return fmt.Errorf("field '%s': %s", k, err)
+		}
+
+		var f float64
+		switch v := v.(type) {
+		case float64:
+			f = v
+		case int64:
+			f = float64(v)
+		case uint64:
+			f = float64(v)
+		default:
+			return fmt.Errorf("field '%s': can't convert %T", k, v)
+		}
+		fields[k] = c.apply(f)
+	}
+	return nil
+}
@@ -0,0 +1,832 @@
+package mqti
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// probeTimeout bounds each connection Probe makes.
+const probeTimeout = 10 * time.Second
+
+// Severity ...
+type Severity int
+
+const (
+	// SeverityWarning marks config that works but is probably a mistake.
+	SeverityWarning Severity = iota
+	// SeverityError marks config that will fail at runtime.
+	SeverityError
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// Problem is a single finding reported by Validate.
+type Problem struct {
+	Severity Severity
+	Field    string
+	Message  string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s: %s", p.Severity, p.Field, p.Message)
+}
+
+type problems []Problem
+
+func (p *problems) errorf(field, format string, a ...interface{}) {
+	*p = append(*p, Problem{SeverityError, field, fmt.Sprintf(format, a...)})
+}
+
+func (p *problems) warnf(field, format string, a ...interface{}) {
+	*p = append(*p, Problem{SeverityWarning, field, fmt.Sprintf(format, a...)})
+}
+
+// ValidationError lists every problem found in a config with at least one
+// error.
+type ValidationError []Problem
+
+func (e ValidationError) Error() string {
+	s := make([]string, len(e))
+	for i, p := range e {
+		s[i] = p.String()
+	}
+	return strings.Join(s, "\n")
+}
+
+// Validate statically checks the loaded configuration and returns every
+// problem found, rather than failing at runtime on the first one.  It does
+// not contact the broker or any sink, see Probe for that.
+func Validate() []Problem {
+	config, err := GetConfig()
+	if err != nil {
+		return []Problem{{SeverityError, "config", err.Error()}}
+	}
+
+	return config.Problems()
+}
+
+// Validate returns a ValidationError listing every problem, warnings
+// included, when the config has any error, and nil otherwise.
+func (c *Config) Validate() error {
+	p := c.Problems()
+	for _, e := range p {
+		if e.Severity == SeverityError {
+			return ValidationError(p)
+		}
+	}
+	return nil
+}
+
+// Problems statically checks the config and returns every problem found.
+func (c *Config) Problems() []Problem {
+	var p problems
+
+	bs, err := c.brokers()
+	if err != nil {
+		p.errorf("mqtt", "%s", err)
+	}
+	for i, b := range bs {
+		validateMQTT(&p, brokerField(bs, i), b)
+	}
+
+	validateMQti(&p, c)
+	validateInfluxDB(&p, c)
+
+	if len(c.Mappings) == 0 && !c.Discovery.enabled() {
+		p.errorf("mappings", "no mappings defined")
+	}
+
+	enabled := 0
+	for _, m := range c.Mappings {
+		if m.enabled() {
+			enabled++
+		}
+	}
+	if len(c.Mappings) > 0 && enabled == 0 && !c.Discovery.enabled() {
+		p.warnf("mappings", "every mapping is disabled, nothing would be subscribed")
+	}
+
+	validateOutputs(&p, c.Outputs)
+	validateRoutes(&p, c)
+	validateMappings(&p, c, bs)
+
+	if c.Discovery.enabled() {
+		if err := ValidateTopicFilter(c.Discovery.Topic); err != nil {
+			p.errorf("discovery.topic", "%s", err)
+		}
+		for i, f := range c.Discovery.Allow {
+			if err := ValidateTopicFilter(f); err != nil {
+				p.errorf(fmt.Sprintf("discovery.allow[%d]", i), "%s", err)
+			}
+		}
+		if len(c.Discovery.Allow) == 0 {
+			p.warnf("discovery.allow", "not set, any client that can publish to %s chooses what is subscribed", c.Discovery.Topic)
+		}
+		if b := c.Discovery.Template.MQTT.Broker; b != "" && !brokerDefined(bs, b) {
+			p.errorf("discovery.template.mqtt.broker", "no broker named '%s'", b)
+		}
+		if c.Discovery.Template.InfluxDB.database() == "" && c.InfluxDB.defaultDatabase() == "" {
+			p.errorf("discovery.template.influxdb.database", "must be set")
+		}
+		if c.Discovery.Template.InfluxDB.Measurement == "" {
+			p.errorf("discovery.template.influxdb.measurement", "must be set")
+		}
+	}
+
+	return p
+}
+
+// Probe checks that the brokers and sinks of the loaded configuration can
+// be reached.
+func Probe() []Problem {
+	config, err := GetConfig()
+	if err != nil {
+		return []Problem{{SeverityError, "config", err.Error()}}
+	}
+
+	return config.Probe()
+}
+
+// Probe connects to every broker, and checks that InfluxDB, when
+// configured, and the outputs that can tell, e.g. postgres, are ready.
+func (c *Config) Probe() []Problem {
+	var p problems
+
+	// Broker config errors are up to Problems.
+	bs, _ := c.brokers()
+	for i, b := range bs {
+		if err := probeBroker(b); err != nil {
+			p.errorf(brokerField(bs, i), "unreachable: %s", err)
+		}
+	}
+
+	if c.InfluxDB.Host != "" {
+		influxDB, err := NewWriter(c)
+		if err == nil {
+			err = probeSink(influxDB)
+		}
+		if err != nil {
+			p.errorf("influxdb", "unreachable: %s", err)
+		}
+	}
+
+	names := make([]string, 0, len(c.Outputs))
+	for name := range c.Outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		sink, err := newOutput(c.Outputs[name])
+		if err != nil {
+			p.errorf("outputs."+name, "%s", err)
+			continue
+		}
+		if err = probeSink(sink); err != nil {
+			p.errorf("outputs."+name, "unreachable: %s", err)
+		}
+	}
+
+	return p
+}
+
+// probeBroker connects to b and disconnects.
+func probeBroker(b broker) error {
+	opts, err := b.publisherOptions()
+	if err != nil {
+		return err
+	}
+	// A client ID of its own and a clean session, kept in memory, so the
+	// session of a running mqti is left alone.
+	opts.ClientID = fmt.Sprintf("mqti-probe-%d", os.Getpid())
+	opts.CleanSession = true
+	opts.SetStore(MQTT.NewMemoryStore())
+	opts.WillEnabled = false
+	opts.AutoReconnect = false
+
+	client := MQTT.NewClient(opts)
+	t := client.Connect()
+	if !t.WaitTimeout(probeTimeout) {
+		return fmt.Errorf("no answer within %s", probeTimeout)
+	}
+	if err = t.Error(); err != nil {
+		return err
+	}
+	client.Disconnect(250)
+	return nil
+}
+
+// probeSink checks that sink is ready, then closes it.
+func probeSink(sink Sink) error {
+	if c, ok := sink.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	r, ok := sink.(readier)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	return r.ready(ctx)
+}
+
+// brokerField is the config key of the i-th broker.
+func brokerField(bs []broker, i int) string {
+	if len(bs) > 1 {
+		return fmt.Sprintf("mqtt[%d]", i)
+	}
+	return "mqtt"
+}
+
+func validateMQTT(p *problems, field string, b broker) {
+	if h, _ := b.config()["host"].(string); h == "" && len(b.GetStringSlice("hosts")) == 0 {
+		p.errorf(field+".host", "one of host or hosts must be set")
+	}
+
+	if o := b.hostsOrder(); o != hostsOrderOrdered && o != hostsOrderRandom {
+		p.errorf(field+".hosts_order", "'%s' must be one of ordered or random", o)
+	}
+
+	if _, err := b.clientID(); err != nil {
+		p.errorf(field+".client_id", "%s", err)
+	}
+
+	if id := b.GetString("client_id"); !b.cleanSession() && (len(id) == 0 || strings.Contains(id, ".Random")) {
+		p.warnf(field+".client_id", "changes on every start, so a persistent session can't be resumed; set clean_session or a stable client_id")
+	}
+
+	if pr := b.protocol(); !validMQTTProtocol(pr) {
+		p.errorf(field+".protocol", "'%s' must be one of tcp, ssl, tls, ws or wss", pr)
+	}
+
+	if ka, pt := b.GetDuration("keep_alive"), b.GetDuration("ping_timeout"); ka > 0 && pt >= ka {
+		p.warnf(field+".ping_timeout", "%s is not shorter than keep_alive %s", pt, ka)
+	}
+
+	if dir := b.GetString("store_dir"); len(dir) > 0 {
+		if fi, err := os.Stat(dir); err == nil && !fi.IsDir() {
+			p.errorf(field+".store_dir", "%s is not a directory", dir)
+		}
+		if b.cleanSession() {
+			p.warnf(field+".store_dir", "clean_session discards the stored messages on every connect")
+		}
+	}
+
+	if _, err := b.proxyURL(); err != nil {
+		p.errorf(field+".proxy_url", "%s", err)
+	}
+
+	if b.GetString("path") != "" && !b.webSocket() {
+		p.warnf(field+".path", "only used with the ws and wss protocols")
+	}
+
+	if w := b.GetInt("will_qos"); w < 0 || w > int(mQTTMaxQoS) {
+		p.errorf(field+".will_qos", "%d must be one of 0, 1 or 2", w)
+	}
+
+	if w := b.will(); len(w.Topic) == 0 && (len(w.Payload) > 0 || w.Retain) {
+		p.warnf(field+".will_topic", "must be set for the will to be used")
+	} else if len(w.Topic) > 0 && strings.ContainsAny(w.Topic, "+#") {
+		p.errorf(field+".will_topic", "'%s' must not contain wildcards", w.Topic)
+	}
+
+	if s := b.sharedSubscription(); s != sharedSubscriptionShare && s != sharedSubscriptionQueue {
+		p.errorf(field+".shared_subscription", "'%s' must be one of share or queue", s)
+	}
+
+	if _, err := b.protocolVersion(); err != nil {
+		p.errorf(field+".version", "%s", err)
+	}
+
+	if pol := b.onSubscribeFailure(); !validSubscribeFailurePolicy(pol) {
+		p.errorf(field+".on_subscribe_failure", "'%s' must be one of log, reconnect or fatal", pol)
+	}
+
+	if _, err := b.tlsCipherSuites(); err != nil {
+		p.errorf(field+".tls_cipher_suites", "%s", err)
+	}
+
+	if ca := b.GetString("tls_ca"); len(ca) > 0 {
+		if _, err := NewCertPool(ca); err != nil {
+			p.errorf(field+".tls_ca", "%s", err)
+		}
+	}
+
+	if v := b.GetString("tls_min_version"); len(v) > 0 {
+		if _, err := TLSVersion(v); err != nil {
+			p.errorf(field+".tls_min_version", "%s", err)
+		}
+	}
+
+	// crypto/tls has no PSK cipher suites, so say so rather than silently
+	// connecting without the key.
+	if b.IsSet("tls_psk_identity") || b.IsSet("tls_psk") {
+		p.errorf(field+".tls_psk", "TLS-PSK is not supported, Go's crypto/tls only implements certificate authentication")
+	}
+
+	if b.GetBool("tls_insecure_skip_verify") {
+		p.warnf(field+".tls_insecure_skip_verify", "the broker's certificate is not verified")
+	}
+
+	if (b.config()["tls_cert"] == nil) != (b.config()["tls_private_key"] == nil) {
+		p.warnf(field+".tls_cert", "tls_cert and tls_private_key must be set together, TLS client auth is disabled")
+	} else if b.tlsDefined() {
+		if _, err := b.tlsCertificate(); err != nil {
+			p.errorf(field+".tls_cert", "%s", err)
+		}
+	}
+
+	for _, k := range []string{"username_file", "password_file"} {
+		if f := b.GetString(k); len(f) > 0 {
+			if _, err := os.Stat(f); err != nil {
+				p.errorf(field+"."+k, "%s", err)
+			}
+		}
+	}
+
+	if (b.username() == "") != (b.password() == "") {
+		p.warnf(field+".username", "only one of username and password is set")
+	}
+}
+
+func validateMQti(p *problems, config *Config) {
+	if config.MQti.Workers <= 0 {
+		p.errorf("mqti.workers", "must be at least 1, nothing would be forwarded")
+	}
+
+	if _, err := config.MQti.StartupBuffer.overflow(); err != nil {
+		p.errorf("mqti.startup_buffer.overflow", "%s", err)
+	}
+
+	if name := config.MQti.DeadLetter; name != "" {
+		if _, ok := config.Outputs[strings.ToLower(name)]; !ok {
+			p.errorf("mqti.dead_letter", "no output named '%s'", name)
+		}
+	}
+}
+
+func validateInfluxDB(p *problems, config *Config) {
+	if config.InfluxDB.Host == "" {
+		p.errorf("influxdb.host", "must be set")
+	}
+
+	if (config.InfluxDB.Username == "") != (config.InfluxDB.Password == "") {
+		p.warnf("influxdb.username", "only one of username and password is set, authentication is disabled")
+	}
+
+	switch config.InfluxDB.Version {
+	case 0, influxDBVersion1:
+	case influxDBVersion2:
+		if config.InfluxDB.Token == "" {
+			p.errorf("influxdb.token", "must be set for version 2")
+		}
+		if config.InfluxDB.Organization == "" {
+			p.errorf("influxdb.org", "must be set for version 2")
+		}
+		if !validInfluxDBPrecision(config.InfluxDB.Precision) {
+			p.errorf("influxdb.precision", "'%s' must be one of ns, us, ms or s", config.InfluxDB.Precision)
+		}
+		if config.InfluxDB.Username != "" {
+			p.warnf("influxdb.username", "is ignored by version 2, which authenticates with token")
+		}
+	default:
+		p.errorf("influxdb.version", "%d must be 1 or 2", config.InfluxDB.Version)
+	}
+}
+
+func brokerDefined(bs []broker, name string) bool {
+	for _, b := range bs {
+		if b.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func validateOutputs(p *problems, outputs map[string]map[string]interface{}) {
+	for _, name := range sortedOutputs(outputs) {
+		kind, _ := outputs[name]["type"].(string)
+		if _, ok := sinkFactories[kind]; !ok {
+			p.errorf("outputs."+name+".type", "'%s' must be one of %s", kind, sinkKinds())
+		}
+	}
+}
+
+// outputIsInfluxDB is true when the named output writes to InfluxDB, ok
+// being false when there is no such output.
+func (c *Config) outputIsInfluxDB(name string) (influxDB bool, ok bool) {
+	if settings, ok := c.Outputs[strings.ToLower(name)]; ok {
+		return settings["type"] == "influxdb", true
+	}
+	return true, name == "" || strings.ToLower(name) == defaultOutput
+}
+
+// routesToInfluxDB is true when a point may be routed to InfluxDB, by a
+// route or for matching none.
+func (c *Config) routesToInfluxDB() bool {
+	catchAll := false
+	for _, r := range c.Routes {
+		for _, name := range r.Outputs {
+			if influxDB, _ := c.outputIsInfluxDB(name); influxDB {
+				return true
+			}
+		}
+		if r.always() {
+			catchAll = true
+			break
+		}
+	}
+	return !catchAll
+}
+
+func validateRoutes(p *problems, c *Config) {
+	for i, r := range c.Routes {
+		field := fmt.Sprintf("routes[%d]", i)
+
+		if r.When.Topic != "" {
+			if err := ValidateTopicFilter(r.When.Topic); err != nil {
+				p.errorf(field+".when.topic", "%s", err)
+			}
+		}
+		validateFilter(p, field+".when.json", r.When.JSON)
+
+		if len(r.Outputs) == 0 {
+			p.errorf(field+".outputs", "must list at least one output")
+		}
+		for j, name := range r.Outputs {
+			if _, ok := c.outputIsInfluxDB(name); !ok {
+				p.errorf(fmt.Sprintf("%s.outputs[%d]", field, j), "no output named '%s'", name)
+			}
+		}
+
+		if r.always() && i < len(c.Routes)-1 {
+			p.warnf(field+".when", "matches every message, the routes after it are never used")
+		}
+	}
+}
+
+func sortedOutputs(outputs map[string]map[string]interface{}) []string {
+	names := make([]string, 0, len(outputs))
+	for name := range outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func validateMappings(p *problems, c *Config, bs []broker) {
+	names := make(map[string]int)
+	targets := make(map[string]int)
+
+	for i, m := range c.Mappings {
+		field := fmt.Sprintf("mappings[%d]", i)
+
+		if m.Name != "" {
+			if j, ok := names[m.Name]; ok {
+				p.errorf(field+".name", "'%s' is also used by mappings[%d]", m.Name, j)
+			}
+			names[m.Name] = i
+		}
+
+		if err := ValidateTopicFilter(m.MQTT.Topic); err != nil {
+			p.errorf(field+".mqtt.topic", "%s", err)
+		}
+
+		if b := m.MQTT.Broker; b != "" && !brokerDefined(bs, b) {
+			p.errorf(field+".mqtt.broker", "no broker named '%s'", b)
+		}
+
+		if ts := m.MQTT.Timestamp; !ts.defined() && ts.Layout != "" {
+			p.warnf(field+".mqtt.timestamp.layout", "is ignored without timestamp.field")
+		}
+
+		if m.MQTT.QoS > mQTTMaxQoS {
+			p.errorf(field+".mqtt.qos", "%d must be one of 0, 1 or 2", m.MQTT.QoS)
+		}
+
+		if r := m.MQTT.TopicRegex; r != "" {
+			if _, err := regexp.Compile(r); err != nil {
+				p.errorf(field+".mqtt.topic_regex", "%s", err)
+			}
+		}
+
+		if n := len(m.MQTT.TopicTags); n > 0 {
+			wildcards := 0
+			for _, l := range strings.Split(m.MQTT.Topic, "/") {
+				if l == "+" || l == "#" {
+					wildcards++
+				}
+			}
+			if n > wildcards {
+				p.warnf(field+".mqtt.topic_tags", "names %d levels but topic '%s' has %d wildcards", n, m.MQTT.Topic, wildcards)
+			}
+		}
+
+		if g := m.MQTT.SharedGroup; strings.ContainsAny(g, "/+#") {
+			p.errorf(field+".mqtt.shared_group", "'%s' must not contain '/', '+' or '#'", g)
+		}
+
+		target := strings.Join([]string{m.MQTT.Topic, m.InfluxDB.database(), m.InfluxDB.Measurement}, "\x00")
+		if j, ok := targets[target]; ok {
+			p.warnf(field, "duplicates mappings[%d], every message would be written twice", j)
+		}
+		targets[target] = i
+
+		for j, step := range m.MQTT.Decode {
+			if !validDecodeStep(step) {
+				p.errorf(fmt.Sprintf("%s.mqtt.decode[%d]", field, j), "'%s' must be one of base64, gzip or zlib", step)
+			}
+		}
+		if m.MQTT.DecodeMaxSize < 0 {
+			p.errorf(field+".mqtt.decode_max_size", "must be positive")
+		}
+
+		if !validPayloadFormat(m.MQTT.PayloadFormat) {
+			p.errorf(field+".mqtt.payload_format", "'%s' must be one of json, xml, msgpack, cbor, protobuf, sparkplug, csv, binary or scalar", m.MQTT.PayloadFormat)
+		}
+		if m.MQTT.PayloadFormat == payloadFormatCSV {
+			c := m.MQTT.CSV
+			if !c.Header && len(c.Columns) == 0 {
+				p.errorf(field+".mqtt.csv", "columns must be set without a header")
+			}
+			if utf8.RuneCountInString(c.Delimiter) > 1 {
+				p.errorf(field+".mqtt.csv.delimiter", "'%s' must be a single character", c.Delimiter)
+			}
+		}
+		if m.MQTT.PayloadFormat == payloadFormatBinary {
+			validateBinary(p, field+".mqtt.binary", m.MQTT.Binary)
+		}
+		if m.MQTT.PayloadFormat == payloadFormatProtobuf {
+			if _, err := newProtobufDecoder(m.MQTT.Protobuf); err != nil {
+				p.errorf(field+".mqtt.protobuf", "%s", err)
+			}
+		}
+
+		if m.MQTT.ArrayPath != "" && m.MQTT.PayloadFormat == payloadFormatScalar {
+			p.warnf(field+".mqtt.array_path", "is ignored with payload_format scalar")
+		}
+		if len(m.MQTT.Fields) > 0 && m.MQTT.PayloadFormat == payloadFormatScalar {
+			p.warnf(field+".mqtt.fields", "is ignored with payload_format scalar")
+		}
+		if m.MQTT.Flatten && (len(m.MQTT.Fields) > 0 || m.MQTT.PayloadFormat == payloadFormatScalar) {
+			p.warnf(field+".mqtt.flatten", "is ignored with fields or payload_format scalar")
+		}
+		if m.MQTT.FlattenMaxDepth < 0 {
+			p.errorf(field+".mqtt.flatten_max_depth", "must not be negative")
+		}
+		for _, k := range sortedKeys(m.MQTT.Fields) {
+			if m.MQTT.Fields[k] == "" {
+				p.errorf(field+".mqtt.fields."+k, "path must not be empty")
+			}
+		}
+
+		if t := m.MQTT.Scalar.Type; len(t) > 0 && !validFieldType(t) {
+			p.errorf(field+".mqtt.scalar.type", "'%s' must be one of float, integer, boolean or string", t)
+		}
+
+		validateFilter(p, field+".mqtt.mungers.filter.json", m.MQTT.Mungers.Filter.JSON)
+		validateExec(p, field+".mqtt.mungers.exec", m.MQTT.Mungers.Exec)
+
+		if sm := m.MQTT.Mungers.Sample; (sm.Window > 0 || sm.Samples > 0) && !sm.defined() {
+			p.warnf(field+".mqtt.mungers.sample", "window and samples must both be set, sampling is disabled")
+		}
+
+		for j, r := range m.Rules {
+			rule := fmt.Sprintf("%s.rules[%d]", field, j)
+			validateFilter(p, rule+".when.json", r.When.JSON)
+			if len(r.When.JSON.And) == 0 && len(r.When.JSON.Or) == 0 && j < len(m.Rules)-1 {
+				p.warnf(rule+".when", "matches every message, the rules after it are never used")
+			}
+			if r.Then.Output != "" && len(r.Then.Outputs) > 0 {
+				p.warnf(rule+".then.output", "is ignored as outputs is set")
+			}
+			for k, name := range append([]string{r.Then.Output}, r.Then.Outputs...) {
+				if name == "" {
+					continue
+				}
+				key := rule + ".then.output"
+				if k > 0 {
+					key = fmt.Sprintf("%s.then.outputs[%d]", rule, k-1)
+				}
+				if _, ok := c.outputIsInfluxDB(name); !ok {
+					p.errorf(key, "no output named '%s'", name)
+				}
+			}
+		}
+
+		if _, err := newRoutingKeyer(m.RoutingKey); err != nil {
+			p.errorf(field+".routing_key.template", "%s", err)
+		}
+
+		if m.Output != "" && len(m.Outputs) > 0 {
+			p.warnf(field+".output", "is ignored as outputs is set")
+		}
+
+		toInfluxDB := false
+		for j, name := range m.outputs() {
+			key := field + ".output"
+			if len(m.Outputs) > 0 {
+				key = fmt.Sprintf("%s.outputs[%d]", field, j)
+			}
+
+			influxDB, ok := c.outputIsInfluxDB(name)
+			if !ok {
+				p.errorf(key, "no output named '%s'", name)
+			}
+			toInfluxDB = toInfluxDB || influxDB
+		}
+		if m.Output == "" && len(m.Outputs) == 0 && len(c.Routes) > 0 {
+			toInfluxDB = c.routesToInfluxDB()
+		}
+
+		if toInfluxDB && m.InfluxDB.database() == "" && c.InfluxDB.defaultDatabase() == "" {
+			p.errorf(field+".influxdb.database", "must be set")
+		}
+
+		if m.InfluxDB.Database != "" && m.InfluxDB.Bucket != "" {
+			p.errorf(field+".influxdb.bucket", "database and bucket are the same setting, set only one")
+		}
+		if c.InfluxDB.Version == influxDBVersion2 && m.InfluxDB.RetentionPolicy != "" {
+			p.warnf(field+".influxdb.retention_policy", "is ignored with InfluxDB 2.x, set the bucket instead")
+		}
+		if c.InfluxDB.Version != influxDBVersion2 && m.InfluxDB.Organization != "" {
+			p.warnf(field+".influxdb.org", "is only used with InfluxDB 2.x")
+		}
+
+		if m.InfluxDB.Measurement == "" {
+			p.errorf(field+".influxdb.measurement", "must be set")
+		} else if isMeasurementTemplate(m.InfluxDB.Measurement) {
+			if _, err := newMessageTemplate("measurement", m.InfluxDB.Measurement); err != nil {
+				p.errorf(field+".influxdb.measurement", "%s", err)
+			}
+		}
+
+		for _, k := range sortedKeys(m.InfluxDB.Schema.Fields) {
+			if t := m.InfluxDB.Schema.Fields[k]; !validFieldType(t) {
+				p.errorf(field+".influxdb.schema.fields."+k, "'%s' must be one of float, integer, boolean or string", t)
+			}
+		}
+
+		for _, k := range sortedKeys(m.InfluxDB.Rename) {
+			if m.InfluxDB.Rename[k] == "" {
+				p.errorf(field+".influxdb.rename."+k, "new name must not be empty")
+			}
+		}
+
+		for _, k := range sortedKeys(m.InfluxDB.Coerce) {
+			if t := m.InfluxDB.Coerce[k]; !validFieldType(t) {
+				p.errorf(field+".influxdb.coerce."+k, "'%s' must be one of float, integer, boolean or string", t)
+			}
+		}
+
+		convert := make([]string, 0, len(m.InfluxDB.Convert))
+		for k := range m.InfluxDB.Convert {
+			convert = append(convert, k)
+		}
+		sort.Strings(convert)
+		for _, k := range convert {
+			if err := m.InfluxDB.Convert[k].validate(); err != nil {
+				p.errorf(field+".influxdb.convert."+k, "%s", err)
+			}
+		}
+
+		bounds := make([]string, 0, len(m.InfluxDB.Bounds))
+		for k := range m.InfluxDB.Bounds {
+			bounds = append(bounds, k)
+		}
+		sort.Strings(bounds)
+		for _, k := range bounds {
+			b := m.InfluxDB.Bounds[k]
+			if b.Min != nil && b.Max != nil && *b.Min > *b.Max {
+				p.errorf(field+".influxdb.bounds."+k, "min %v is above max %v", *b.Min, *b.Max)
+			}
+		}
+
+		for _, l := range []struct {
+			key      string
+			patterns []string
+		}{
+			{"fields_include", m.InfluxDB.FieldsInclude},
+			{"fields_exclude", m.InfluxDB.FieldsExclude},
+			{"tags_include", m.InfluxDB.TagsInclude},
+			{"tags_exclude", m.InfluxDB.TagsExclude},
+		} {
+			for j, pattern := range l.patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					p.errorf(fmt.Sprintf("%s.influxdb.%s[%d]", field, l.key, j), "'%s': %s", pattern, err)
+				}
+			}
+		}
+
+		g := m.InfluxDB.Mungers.Geohash
+		if (g.LatitudeField != "" || g.LongitudeField != "" || g.ResultField != "") && !g.defined() {
+			p.warnf(field+".influxdb.mungers.geohash", "lat_field, lng_field and result_field must all be set, geohash munger is disabled")
+		}
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func validateFilter(p *problems, field string, f FilterJSONMungerConfiguration) {
+	for i, c := range f.And {
+		if len(c) == 0 {
+			p.warnf(fmt.Sprintf("%s.and[%d]", field, i), "empty clause")
+		}
+	}
+
+	for i, c := range f.Or {
+		if len(c) == 0 {
+			p.warnf(fmt.Sprintf("%s.or[%d]", field, i), "empty clause")
+		}
+	}
+}
+
+func validateExec(p *problems, field string, e ExecMungerConfiguration) {
+	if !e.defined() {
+		if e.Mode != "" {
+			p.errorf(field+".command", "must be set when mode is set")
+		}
+		return
+	}
+
+	if e.Mode != execModeFilter && e.Mode != execModeTransform {
+		p.errorf(field+".mode", "'%s' must be one of filter or transform", e.Mode)
+	}
+
+	if _, err := exec.LookPath(e.Command[0]); err != nil {
+		p.errorf(field+".command", "%s", err)
+	}
+}
+
+func validateBinary(p *problems, field string, b BinaryPayloadConfiguration) {
+	if len(b.Layout) == 0 {
+		p.errorf(field+".layout", "must be set with payload_format binary")
+	}
+	if !validBinaryEndian(b.Endian) {
+		p.errorf(field+".endian", "'%s' must be one of big or little", b.Endian)
+	}
+
+	for i, f := range b.Layout {
+		lf := fmt.Sprintf("%s.layout[%d]", field, i)
+		if f.Name == "" {
+			p.errorf(lf+".name", "must be set")
+		}
+		if _, ok := binaryTypeSizes[f.Type]; !ok {
+			p.errorf(lf+".type", "'%s' must be one of int8, uint8, int16, uint16, int32, uint32, int64, uint64, float32, float64 or bool", f.Type)
+		}
+		if f.Offset < 0 {
+			p.errorf(lf+".offset", "must not be negative")
+		}
+		if !validBinaryEndian(f.Endian) {
+			p.errorf(lf+".endian", "'%s' must be one of big or little", f.Endian)
+		}
+	}
+}
+
+// ValidateTopicFilter checks topic is a valid MQTT topic filter: non-empty,
+// with '+' only as a whole level and '#' only as the whole last level.
+func ValidateTopicFilter(topic string) error {
+	if topic == "" {
+		return fmt.Errorf("topic must not be empty")
+	}
+
+	if strings.ContainsRune(topic, 0) {
+		return fmt.Errorf("topic '%s' contains a null character", topic)
+	}
+
+	levels := strings.Split(topic, "/")
+	for i, l := range levels {
+		if strings.Contains(l, "+") && l != "+" {
+			return fmt.Errorf("topic '%s': '+' must occupy a whole level", topic)
+		}
+		if strings.Contains(l, "#") && (l != "#" || i != len(levels)-1) {
+			return fmt.Errorf("topic '%s': '#' must be the whole last level", topic)
+		}
+	}
+
+	return nil
+}
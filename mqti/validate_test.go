@@ -0,0 +1,32 @@
+package mqti
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ashmckenzie/go-mqti/mqti/mqtitest"
+)
+
+func TestProbe(t *testing.T) {
+	b := mqtitest.StartBroker(t)
+
+	config := testConfig(b, "sensors/+/temperature")
+	config.Outputs = map[string]map[string]interface{}{
+		"archive": {"type": "carrier-pigeon"},
+	}
+
+	problems := config.Probe()
+	if len(problems) != 1 {
+		t.Fatalf("got %v, want a problem with outputs.archive only", problems)
+	}
+	if p := problems[0]; p.Field != "outputs.archive" || !strings.Contains(p.Message, "unknown type") {
+		t.Errorf("got %s", p)
+	}
+
+	config = testConfig(b)
+	config.MQTT.(map[string]interface{})["port"] = "1"
+	problems = config.Probe()
+	if len(problems) != 1 || problems[0].Field != "mqtt" {
+		t.Errorf("got %v, want the broker unreachable", problems)
+	}
+}
@@ -0,0 +1,157 @@
+package mqti
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	victoriaMetricsDefaultBatchSize     int = 1000
+	victoriaMetricsDefaultFlushInterval     = time.Second
+	victoriaMetricsDefaultTimeout           = 30 * time.Second
+)
+
+type victoriaMetricsConfiguration struct {
+	// URL is VictoriaMetrics' own, e.g. http://victoriametrics:8428, or
+	// vminsert's with the tenant path, /insert/0/prometheus.
+	URL           string
+	Username      string
+	Password      string
+	BearerToken   string        `mapstructure:"bearer_token"`
+	BatchSize     int           `mapstructure:"batch_size"`
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+	Timeout       time.Duration
+}
+
+// victoriaMetricsLine is a line of /api/v1/import.
+type victoriaMetricsLine struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []float64         `json:"values"`
+	Timestamps []int64           `json:"timestamps"`
+}
+
+// victoriaMetricsSink imports points with VictoriaMetrics' native JSON
+// lines format, gzipped.  Every numeric or boolean field becomes a sample
+// of <measurement>_<field>, labelled with the point's tags and its
+// database as db, the way VictoriaMetrics names line protocol ones.
+// Lines are queued and imported batch_size at a time, at least every
+// flush_interval.
+type victoriaMetricsSink struct {
+	config victoriaMetricsConfiguration
+	client *http.Client
+}
+
+func newVictoriaMetricsSink(settings map[string]interface{}) (Sink, error) {
+	v := viper.New()
+	if err := v.MergeConfigMap(settings); err != nil {
+		return nil, err
+	}
+
+	var c victoriaMetricsConfiguration
+	if err := v.Unmarshal(&c); err != nil {
+		return nil, err
+	}
+	if c.URL == "" {
+		return nil, fmt.Errorf("url must be set")
+	}
+	c.URL = strings.TrimSuffix(c.URL, "/")
+	if c.BatchSize <= 0 {
+		c.BatchSize = victoriaMetricsDefaultBatchSize
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = victoriaMetricsDefaultFlushInterval
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = victoriaMetricsDefaultTimeout
+	}
+
+	s := &victoriaMetricsSink{config: c, client: &http.Client{Timeout: c.Timeout}}
+
+	return newBatchedSink(s, c.BatchSize, c.FlushInterval), nil
+}
+
+// encode encodes p as one line per field, skipping fields that aren't
+// numbers.
+func (s *victoriaMetricsSink) encode(p *Point) (interface{}, error) {
+	t := p.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	ms := t.UnixNano() / int64(time.Millisecond)
+
+	var lines [][]byte
+	for k, v := range p.Fields {
+		value, ok := numericValue(v)
+		if !ok {
+			continue
+		}
+
+		metric := make(map[string]string, len(p.Tags)+2)
+		for tag, tagValue := range p.Tags {
+			metric[tag] = tagValue
+		}
+		if p.Database != "" {
+			metric["db"] = p.Database
+		}
+		metric["__name__"] = p.Measurement + "_" + k
+
+		line, err := json.Marshal(victoriaMetricsLine{metric, []float64{value}, []int64{ms}})
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, nil
+}
+
+// writeBatch imports the lines of a batch of points in one request.
+func (s *victoriaMetricsSink) writeBatch(ctx context.Context, batch []interface{}) error {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	for _, lines := range batch {
+		for _, line := range lines.([][]byte) {
+			gz.Write(line)
+			gz.Write([]byte{'\n'})
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.config.URL+"/api/v1/import", &body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("User-Agent", "mqti/"+Version)
+	if s.config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.config.BearerToken)
+	} else if s.config.Username != "" {
+		req.SetBasicAuth(s.config.Username, s.config.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("import into %s failed: %s: %s", s.config.URL, resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	return nil
+}
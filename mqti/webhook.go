@@ -0,0 +1,220 @@
+package mqti
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	webhookDefaultMethod        string = http.MethodPost
+	webhookDefaultTimeout              = 10 * time.Second
+	webhookDefaultFlushInterval        = time.Second
+	webhookDefaultMaxRetries    int    = 3
+
+	webhookRetryInitialInterval = time.Second
+	webhookRetryMaxInterval     = 30 * time.Second
+)
+
+type webhookConfiguration struct {
+	URL     string
+	Method  string
+	Headers map[string]string
+	// Body is a template rendered with a webhookPoint, or with a list of
+	// them when batch_size is over 1.  Points are sent as JSON when empty.
+	Body          string
+	BatchSize     int           `mapstructure:"batch_size"`
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+	Timeout       time.Duration
+	// MaxRetries is how often requests failing with a network error, 429
+	// or a 5xx status are sent again, with exponential backoff.
+	MaxRetries *int `mapstructure:"max_retries"`
+	// Canonical encodes points with sorted keys when Body is empty, see
+	// CanonicalJSON.
+	Canonical bool
+}
+
+// webhookPoint is what body templates are rendered with, a point and the
+// data of its message, e.g. {{.Measurement}} {{.Topic}} {{json .Fields}}.
+type webhookPoint struct {
+	*Point
+	messageTemplateData
+}
+
+// webhookFuncs are the functions body templates can use besides the
+// builtin ones.
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// webhookSink sends points to an HTTP endpoint, one request per point, or
+// per batch_size points at least every flush_interval.
+type webhookSink struct {
+	config     webhookConfiguration
+	body       *template.Template
+	maxRetries int
+	client     *http.Client
+}
+
+func newWebhookSink(settings map[string]interface{}) (Sink, error) {
+	v := viper.New()
+	if err := v.MergeConfigMap(settings); err != nil {
+		return nil, err
+	}
+
+	var c webhookConfiguration
+	if err := v.Unmarshal(&c); err != nil {
+		return nil, err
+	}
+	if c.URL == "" {
+		return nil, fmt.Errorf("url must be set")
+	}
+	if c.Method == "" {
+		c.Method = webhookDefaultMethod
+	}
+	c.Method = strings.ToUpper(c.Method)
+	if c.Timeout <= 0 {
+		c.Timeout = webhookDefaultTimeout
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = webhookDefaultFlushInterval
+	}
+
+	s := &webhookSink{config: c, maxRetries: webhookDefaultMaxRetries, client: &http.Client{Timeout: c.Timeout}}
+	if c.MaxRetries != nil {
+		s.maxRetries = *c.MaxRetries
+	}
+
+	if c.Body != "" {
+		t, err := template.New("body").Funcs(webhookFuncs).Option("missingkey=zero").Parse(c.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid body template: %s", err)
+		}
+		s.body = t
+	}
+
+	if s.batched() {
+		return newBatchedSink(s, c.BatchSize, c.FlushInterval), nil
+	}
+	return s, nil
+}
+
+func (s *webhookSink) batched() bool {
+	return s.config.BatchSize > 1
+}
+
+// Write sends every point.
+func (s *webhookSink) Write(ctx context.Context, points []*Point) error {
+	for _, p := range points {
+		if err := s.send(ctx, []*Point{p}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *webhookSink) encode(p *Point) (interface{}, error) {
+	return p, nil
+}
+
+// writeBatch sends a batch of points as one request.
+func (s *webhookSink) writeBatch(ctx context.Context, batch []interface{}) error {
+	points := make([]*Point, len(batch))
+	for i, p := range batch {
+		points[i] = p.(*Point)
+	}
+	return s.send(ctx, points)
+}
+
+// render builds the body of a request for points.
+func (s *webhookSink) render(points []*Point) ([]byte, error) {
+	if s.body == nil {
+		if !s.batched() {
+			return marshalJSON(points[0], s.config.Canonical)
+		}
+		return marshalJSON(points, s.config.Canonical)
+	}
+
+	data := make([]webhookPoint, len(points))
+	for i, p := range points {
+		if p.Message == nil {
+			return nil, fmt.Errorf("http output body templates need the message a point was built from")
+		}
+		data[i] = webhookPoint{p, messageTemplateData{p.Message}}
+	}
+
+	var out bytes.Buffer
+	var err error
+	if !s.batched() {
+		err = s.body.Execute(&out, data[0])
+	} else {
+		err = s.body.Execute(&out, data)
+	}
+	return out.Bytes(), err
+}
+
+// send makes the request for points, retrying it with backoff while it
+// fails in a way that may pass.
+func (s *webhookSink) send(ctx context.Context, points []*Point) error {
+	body, err := s.render(points)
+	if err != nil {
+		return err
+	}
+
+	b := newBackoff(webhookRetryInitialInterval, webhookRetryMaxInterval)
+
+	for attempt := 0; ; attempt++ {
+		retry, err := s.request(ctx, body)
+		if err == nil || !retry || attempt >= s.maxRetries {
+			return err
+		}
+
+		d := b.duration()
+		Log.Warnf("Sending to %s failed, retrying in %s: %s", s.config.URL, d, err)
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// request makes one request, returning whether it is worth retrying when
+// it fails.
+func (s *webhookSink) request(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequest(s.config.Method, s.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mqti/"+Version)
+	for k, v := range s.config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		err = fmt.Errorf("%s %s failed: %s: %s", s.config.Method, s.config.URL, resp.Status, strings.TrimSpace(string(respBody)))
+		return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5, err
+	}
+
+	return false, nil
+}
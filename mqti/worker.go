@@ -10,16 +10,34 @@ func CreateWorkers(influxDB *InfluxDBConnection, jobs <-chan *MQTTMessage) {
 		Log.Fatal(err)
 	}
 
+	outputs, err := newSinks(config, influxDB, nil)
+	if err != nil {
+		Log.Fatal(err)
+	}
+
+	setActiveSinks(outputs)
+
 	for w := 1; w <= config.MQti.Workers; w++ {
-		createWorker(w, influxDB, jobs)
+		createWorker(w, jobs)
 	}
 }
 
-func createWorker(id int, influxDB *InfluxDBConnection, jobs <-chan *MQTTMessage) {
-	var err error
+// createWorker forwards jobs to the active outputs, which count those
+// they write as forwarded or failed.
+func createWorker(id int, jobs <-chan *MQTTMessage) {
 	for j := range jobs {
-		if err = influxDB.Forward(j); err != nil {
-			Log.Error(err)
-		}
+		forwardJob(j)
+	}
+}
+
+// forwardJob forwards j to the active outputs, counting it as rejected or
+// failed when no point can be built from it.
+func forwardJob(j *MQTTMessage) {
+	if err := forwardActive(j); isRejected(err) {
+		count(j.Name, statRejected)
+		Log.Warnf("Rejected %s: %s", j.Topic(), err)
+	} else if err != nil {
+		count(j.Name, statFailed)
+		Log.Error(err)
 	}
 }
@@ -0,0 +1,87 @@
+package mqti
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// decodeXML turns an XML document into the object JSON would give, so
+// mqtt.fields paths such as reading.sensor.@id or reading.temperature
+// pick values as an XPath would.  The root element is the only key,
+// elements holding only text become their value, parsed as a number or
+// boolean when possible, attributes are keyed by @name and the text of
+// elements with children or attributes by #text.  Repeated elements
+// become arrays.
+func decodeXML(payload []byte) (map[string]interface{}, error) {
+	d := xml.NewDecoder(bytes.NewReader(payload))
+
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no root element")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if start, ok := tok.(xml.StartElement); ok {
+			v, err := xmlElement(d, start)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{start.Name.Local: v}, nil
+		}
+	}
+}
+
+func xmlElement(d *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	element := make(map[string]interface{})
+	for _, a := range start.Attr {
+		element["@"+a.Name.Local] = xmlValue(a.Value)
+	}
+
+	var text strings.Builder
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			child, err := xmlElement(d, t)
+			if err != nil {
+				return nil, err
+			}
+
+			name := t.Name.Local
+			switch existing := element[name].(type) {
+			case nil:
+				element[name] = child
+			case []interface{}:
+				element[name] = append(existing, child)
+			default:
+				element[name] = []interface{}{existing, child}
+			}
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			s := strings.TrimSpace(text.String())
+			if len(element) == 0 {
+				return xmlValue(s), nil
+			}
+			if s != "" {
+				element["#text"] = xmlValue(s)
+			}
+			return element, nil
+		}
+	}
+}
+
+func xmlValue(s string) interface{} {
+	v, _ := parseScalar(s, "")
+	return v
+}